@@ -3,44 +3,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
 )
 
-// Conversation represents the conversation history
-type Conversation struct {
-	messages []anthropic.BetaMessageParam
-}
-
-// NewConversation creates a new conversation
-func NewConversation() *Conversation {
-	return &Conversation{
-		messages: []anthropic.BetaMessageParam{},
-	}
-}
-
-// AddUserMessage adds a user message to the conversation history
-func (c *Conversation) AddUserMessage(content string) {
-	c.messages = append(c.messages,
-		anthropic.NewBetaUserMessage(
-			anthropic.NewBetaTextBlock(content)))
-}
-
-// AddAssistantMessage adds an assistant message to the conversation history
-func (c *Conversation) AddAssistantMessage(message anthropic.BetaMessage) {
-	c.messages = append(c.messages, message.ToParam())
-}
-
-// AddToolResults adds tool results to the conversation history
-func (c *Conversation) AddToolResults(results []anthropic.BetaContentBlockParamUnion) {
-	c.messages = append(c.messages,
-		anthropic.NewBetaUserMessage(results...))
-}
-
 // AnthropicClient wraps the Anthropic SDK client and provides high-level methods
 type AnthropicClient struct {
 	client             *anthropic.Client
@@ -49,6 +24,39 @@ type AnthropicClient struct {
 	systemPrompt       string
 	tools              *toolProviders
 	debug              bool
+
+	// OutputLimiter keeps tool results within their output budgets, or
+	// is nil to send tool output in full
+	OutputLimiter *OutputLimiter
+
+	// MaxRetries is how often a request that failed with a transient
+	// error is retried
+	MaxRetries int
+
+	// MaxTokens is the maximum number of tokens to generate per
+	// response
+	MaxTokens int64
+
+	// CompactThreshold is the estimated conversation size in tokens
+	// above which older turns are summarized, or 0 to never compact
+	// automatically
+	CompactThreshold int
+
+	// Prompter, if not nil, asks the user for the answer to the prompt
+	// of a command that waits for input. If secret is set, the answer
+	// must not be shown. An empty answer leaves the prompt to the model.
+	Prompter func(prompt string, secret bool) (string, error)
+
+	// Approver, if not nil, asks the user before commands run and
+	// files are edited
+	Approver *Approver
+
+	// Redactor, if not nil, scrubs secrets from tool results before
+	// they are sent
+	Redactor *Redactor
+
+	// AuditLog, if not nil, records every tool call
+	AuditLog *AuditLog
 }
 
 // NewAnthropicClient creates a new Anthropic client with the specified configuration
@@ -64,6 +72,9 @@ func NewAnthropicClient(apiKey, modelName, systemPrompt string, tools *toolProvi
 		systemPrompt:       systemPrompt,
 		tools:              tools,
 		debug:              debug,
+		MaxRetries:         defaultMaxRetries,
+		MaxTokens:          defaultMaxTokensForModel(model),
+		CompactThreshold:   defaultCompactThreshold,
 	}
 }
 
@@ -178,6 +189,104 @@ text editor and bash tool requirements.`
 	fmt.Println(modelList)
 }
 
+// minMaxTokens is the smallest output budget that a request is sent
+// with, even when the conversation nearly fills the context window
+const minMaxTokens = 1024
+
+// maxContinuations limits how often a response that was cut off by the
+// output budget is automatically continued
+const maxContinuations = 5
+
+// defaultMaxTokensForModel returns the largest output budget that the
+// model supports
+func defaultMaxTokensForModel(model anthropic.Model) int64 {
+	modelStr := string(model)
+	switch {
+	case strings.Contains(modelStr, "claude-opus-4") ||
+		strings.Contains(modelStr, "claude-4-opus"):
+		return 32000
+	case strings.Contains(modelStr, "claude-sonnet-4") ||
+		strings.Contains(modelStr, "claude-4-sonnet") ||
+		strings.Contains(modelStr, "claude-3-7") ||
+		strings.Contains(modelStr, "claude-3.7"):
+		return 64000
+	default:
+		return 8192
+	}
+}
+
+// requestMaxTokens returns the output budget for the next request. It
+// is reduced when the conversation leaves less room than MaxTokens in
+// the context window, since the API rejects requests whose input and
+// output budget exceed the window. Responses cut short by the reduced
+// budget are continued automatically.
+func (ac *AnthropicClient) requestMaxTokens(conversation *Conversation) int64 {
+	room := int64(contextWindow(ac.model) - conversation.EstimatedTokens() -
+		minMaxTokens)
+	return max(min(ac.MaxTokens, room), minMaxTokens)
+}
+
+// toolParams returns the definitions of the tools offered to the model
+func (ac *AnthropicClient) toolParams() []anthropic.BetaToolUnionParam {
+	tools := []anthropic.BetaToolUnionParam{
+		bashToolParam(),
+		// Use the appropriate text editor tool for the model
+		getTextEditorToolForModel(ac.model),
+	}
+	if ac.tools != nil && ac.tools.Jobs != nil {
+		tools = append(tools, jobsToolParam())
+	}
+	return tools
+}
+
+// bashToolParam returns the definition of the bash tool. It has the
+// built-in bash tool's input plus a timeout, which the built-in tool's
+// fixed schema cannot have.
+func bashToolParam() anthropic.BetaToolUnionParam {
+	return anthropic.BetaToolUnionParam{
+		OfTool: &anthropic.BetaToolParam{
+			Name: "bash",
+			Description: anthropic.String("Run commands in a bash shell. " +
+				"The working directory and environment persist between " +
+				"commands unless the shell is restarted. Commands that " +
+				"run longer than the timeout are killed; set `timeout` " +
+				"for commands that are known to take long, such as " +
+				"builds and test suites."),
+			InputSchema: anthropic.BetaToolInputSchemaParam{
+				Properties: map[string]any{
+					"command": map[string]any{
+						"type":        "string",
+						"description": "The bash command to run",
+					},
+					"restart": map[string]any{
+						"type":        "boolean",
+						"description": "Restart the shell instead of running a command",
+					},
+					"timeout": map[string]any{
+						"type": "number",
+						"description": "Seconds the command may run before " +
+							"it is killed, instead of the default timeout",
+					},
+				},
+			},
+		},
+	}
+}
+
+// systemParams returns the system prompt blocks, or nil if there is no
+// system prompt
+func (ac *AnthropicClient) systemParams() []anthropic.BetaTextBlockParam {
+	if ac.systemPrompt == "" {
+		return nil
+	}
+	return []anthropic.BetaTextBlockParam{
+		{
+			Text: ac.systemPrompt,
+			Type: "text",
+		},
+	}
+}
+
 // toolUseInfo holds information about a tool use block
 type toolUseInfo struct {
 	ID    string
@@ -185,59 +294,140 @@ type toolUseInfo struct {
 	Input json.RawMessage
 }
 
-// currentToolUse holds the state of a tool use being accumulated
-type currentToolUse struct {
-	ID    string
-	Name  string
-	Input string
-}
-
-// SendMessage sends a message to the Anthropic API and handles the streaming response
+// SendMessage sends the conversation to the Anthropic API, prints the
+// streaming response and adds it to the conversation. A response that
+// is cut off by the output budget is continued automatically, and a
+// tool use that was cut off is never returned. Transient API failures
+// are retried; a stream that broke after some text was shown resumes
+// from where it stopped. It returns the tool uses that the model
+// requested.
 func (ac *AnthropicClient) SendMessage(ctx context.Context, conversation *Conversation) ([]toolUseInfo, error) {
-	// Get the appropriate text editor tool for the selected model
-	textEditorTool := getTextEditorToolForModel(ac.model)
-
-	toolParams := []anthropic.BetaToolUnionParam{
-		// Use the built-in Bash20250124 tool
-		anthropic.BetaToolUnionParam{
-			OfBashTool20250124: &anthropic.BetaToolBash20250124Param{
-				Name: "bash",
-			},
-		},
-		// Use the appropriate text editor tool for the model
-		textEditorTool,
+	fmt.Print("\nGollum: ")
+
+	var message anthropic.BetaMessage
+	continuations, retries := 0, 0
+	for {
+		messages := conversation.messages
+		if len(message.Content) > 0 {
+			// Prefill the partial response so that the model picks up
+			// where it stopped
+			message.Content = trimTrailingSpace(message.Content)
+			messages = append(slices.Clone(messages), assistantParam(message))
+		}
+
+		response, err := ac.streamMessage(ctx, messages,
+			ac.requestMaxTokens(conversation))
+		message = mergeContinuation(message, response)
+		if err != nil {
+			if ctx.Err() != nil {
+				recordPartial(conversation, message, interruptedNote)
+				return nil, context.Cause(ctx)
+			}
+
+			// A tool use that was being streamed is incomplete
+			message.Content, _ = dropTruncatedToolUse(message.Content)
+			if !isRetryable(err) || retries >= ac.MaxRetries {
+				recordPartial(conversation, message, failedNote)
+				return nil, err
+			}
+			if len(toolUsesOf(message)) > 0 {
+				// Run the tool calls that did arrive; the model
+				// continues after seeing their results
+				break
+			}
+
+			retries++
+			delay := retryDelay(err, retries)
+			if len(trimTrailingSpace(message.Content)) > 0 {
+				fmt.Printf("\n\n[%s; retrying in %.1fs (attempt %d of "+
+					"%d). The response continues from where it "+
+					"stopped.]\n\n", retryReason(err), delay.Seconds(),
+					retries, ac.MaxRetries)
+			} else {
+				message = anthropic.BetaMessage{}
+				fmt.Printf("\n[%s; retrying in %.1fs (attempt %d of "+
+					"%d)]\n", retryReason(err), delay.Seconds(), retries,
+					ac.MaxRetries)
+			}
+			if ac.debug {
+				fmt.Fprintf(os.Stderr, "[DEBUG] Retrying after: %v\n", err)
+			}
+			if err := sleepContext(ctx, delay); err != nil {
+				recordPartial(conversation, message, interruptedNote)
+				return nil, err
+			}
+			continue
+		}
+
+		if message.StopReason != anthropic.BetaStopReasonMaxTokens {
+			break
+		}
+
+		// The last block was cut off. Text can be continued, but a
+		// truncated tool use has incomplete input and must not run.
+		var dropped bool
+		message.Content, dropped = dropTruncatedToolUse(message.Content)
+		if dropped {
+			fmt.Printf("\n[Response hit the output limit in the middle " +
+				"of a tool call; the incomplete call was dropped]\n")
+		}
+		if len(toolUsesOf(message)) > 0 {
+			// Run the complete tool calls; the model continues after
+			// seeing their results
+			break
+		}
+		if len(trimTrailingSpace(message.Content)) == 0 {
+			return nil, fmt.Errorf("response exceeded the output limit "+
+				"of %d tokens before producing any text; try a larger "+
+				"-max-tokens", ac.MaxTokens)
+		}
+		if continuations == maxContinuations {
+			fmt.Printf("\n[Response truncated after %d continuations]\n",
+				maxContinuations)
+			break
+		}
+		continuations++
+		if ac.debug {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Continuing response cut off "+
+				"at max_tokens (continuation %d)\n", continuations)
+		}
 	}
 
-	// Build the message parameters
+	// Add assistant message to conversation
+	conversation.AddAssistantMessage(message)
+	conversation.RecordUsage(message.Usage)
+	if ac.debug {
+		printCacheUsage(os.Stderr, message.Usage)
+	}
+
+	return toolUsesOf(message), nil
+}
+
+// streamMessage streams a single response to messages, printing text
+// as it arrives, and returns the accumulated message
+func (ac *AnthropicClient) streamMessage(ctx context.Context,
+	messages []anthropic.BetaMessageParam, maxTokens int64) (
+	anthropic.BetaMessage, error) {
+	// Build the message parameters with prompt cache breakpoints on
+	// the system prompt, tools and conversation prefix
 	params := anthropic.BetaMessageNewParams{
 		Model:     ac.model,
-		MaxTokens: 8192, // Increased from 1024 to allow for longer responses
-		Messages:  conversation.messages,
-		Tools:     toolParams,
+		MaxTokens: maxTokens,
+		Messages:  cachedMessages(messages),
+		Tools:     cachedTools(ac.toolParams()),
+		System:    cachedSystem(ac.systemParams()),
 		Betas: []anthropic.AnthropicBeta{
 			anthropic.AnthropicBetaComputerUse2025_01_24,
 		},
 	}
 
-	// Add system prompt if provided
-	if ac.systemPrompt != "" {
-		params.System = []anthropic.BetaTextBlockParam{
-			{
-				Text: ac.systemPrompt,
-				Type: "text",
-			},
-		}
-	}
-
-	stream := ac.client.Beta.Messages.NewStreaming(ctx, params)
-
-	fmt.Print("\nGollum: ")
+	// Retries are handled by SendMessage, which can also resume a
+	// stream that broke part way through
+	stream := ac.client.Beta.Messages.NewStreaming(ctx, params,
+		option.WithMaxRetries(0))
+	defer stream.Close()
 
 	message := anthropic.BetaMessage{}
-	toolUseBlocks := []toolUseInfo{}
-
-	current := currentToolUse{}
-	inToolUse := false
 
 	// Process the stream
 	for stream.Next() {
@@ -257,12 +447,23 @@ func (ac *AnthropicClient) SendMessage(ctx context.Context, conversation *Conver
 			}
 		}
 
+		// A tool use that was cut off by max_tokens has invalid input
+		// JSON, which cannot be accumulated. Replace it with an empty
+		// object; the block is dropped once the stop reason arrives.
+		if _, ok := event.AsAny().(anthropic.BetaRawContentBlockStopEvent); ok {
+			if n := len(message.Content); n > 0 &&
+				message.Content[n-1].Type == "tool_use" &&
+				!json.Valid(message.Content[n-1].Input) {
+				message.Content[n-1].Input = json.RawMessage("{}")
+			}
+		}
+
 		err := message.Accumulate(event)
 		if err != nil {
 			if ac.debug {
 				fmt.Fprintf(os.Stderr, "[DEBUG] Accumulate error for event type %T: %v\n", event.AsAny(), err)
 			}
-			return toolUseBlocks, fmt.Errorf("error accumulating message: %v", err)
+			return message, fmt.Errorf("error accumulating message: %w", err)
 		}
 
 		// Handle different event types
@@ -270,13 +471,9 @@ func (ac *AnthropicClient) SendMessage(ctx context.Context, conversation *Conver
 		case anthropic.BetaRawContentBlockStartEvent:
 			// Check what type of content block this is
 			if event.ContentBlock.Type == "tool_use" {
-				inToolUse = true
-				current.ID = event.ContentBlock.ID
-				current.Name = event.ContentBlock.Name
-				current.Input = ""
-				if current.Name == "bash" {
+				if event.ContentBlock.Name == "bash" {
 					fmt.Printf("\n[Preparing to execute bash command locally...]\n")
-				} else if current.Name == ac.TextEditorToolName {
+				} else if event.ContentBlock.Name == ac.TextEditorToolName {
 					fmt.Printf("\n[Preparing to execute text editor command...]\n")
 				}
 			}
@@ -285,65 +482,179 @@ func (ac *AnthropicClient) SendMessage(ctx context.Context, conversation *Conver
 			// Handle text deltas
 			if delta := event.Delta; delta.Type == "text_delta" {
 				fmt.Print(delta.Text)
-			} else if delta.Type == "input_json_delta" && inToolUse {
-				// Accumulate tool input
-				current.Input += delta.PartialJSON
-			}
-
-		case anthropic.BetaRawContentBlockStopEvent:
-			if inToolUse && (current.Name == "bash" || current.Name == ac.TextEditorToolName) {
-				// Parse and store the tool use
-				toolUseBlocks = append(toolUseBlocks, toolUseInfo{
-					ID:    current.ID,
-					Name:  current.Name,
-					Input: json.RawMessage(current.Input),
-				})
-				inToolUse = false
 			}
 		}
 	}
 
 	// Check for stream errors
 	if err := stream.Err(); err != nil {
-		return toolUseBlocks, fmt.Errorf("stream error: %v", err)
+		return message, fmt.Errorf("stream error: %w", err)
+	}
+	if message.StopReason == "" {
+		return message, errIncompleteStream
 	}
 
-	// Add assistant message to conversation
-	conversation.AddAssistantMessage(message)
+	return message, nil
+}
+
+// Notes that mark a response that was cut short
+const (
+	interruptedNote = "[Response interrupted by the user]"
+	failedNote      = "[Response incomplete: the API request failed]"
+)
+
+// recordPartial adds the text of a response that was cut short while
+// streaming to the conversation, followed by note so that the model
+// knows what happened. Tool uses are dropped since they never ran.
+// Nothing is added if no text was streamed, unless the user interrupted.
+func recordPartial(conversation *Conversation, partial anthropic.BetaMessage, note string) {
+	var content []anthropic.BetaContentBlockUnion
+	for _, block := range partial.Content {
+		if block.Type == "text" {
+			content = append(content, block)
+		}
+	}
+	content = trimTrailingSpace(content)
+	if len(content) == 0 && note != interruptedNote {
+		return
+	}
+	content = append(content,
+		anthropic.BetaContentBlockUnion{Type: "text", Text: note})
+	conversation.AddAssistantMessage(anthropic.BetaMessage{Content: content})
+}
+
+// toolUsesOf returns the tool uses requested in message
+func toolUsesOf(message anthropic.BetaMessage) []toolUseInfo {
+	toolUses := []toolUseInfo{}
+	for _, block := range message.Content {
+		if block.Type == "tool_use" {
+			toolUses = append(toolUses, toolUseInfo{
+				ID:    block.ID,
+				Name:  block.Name,
+				Input: block.Input,
+			})
+		}
+	}
+	return toolUses
+}
+
+// dropTruncatedToolUse removes the last block of a response that was
+// cut off by max_tokens if that block is a tool use
+func dropTruncatedToolUse(content []anthropic.BetaContentBlockUnion) (
+	[]anthropic.BetaContentBlockUnion, bool) {
+	if n := len(content); n > 0 && content[n-1].Type == "tool_use" {
+		return content[:n-1], true
+	}
+	return content, false
+}
+
+// trimTrailingSpace removes trailing whitespace from the final text
+// block of a partial response, dropping the block if nothing is left.
+// The API rejects prefilled assistant messages that end in whitespace.
+func trimTrailingSpace(content []anthropic.BetaContentBlockUnion) []anthropic.BetaContentBlockUnion {
+	n := len(content)
+	if n == 0 || content[n-1].Type != "text" {
+		return content
+	}
+	content = slices.Clone(content)
+	content[n-1].Text = strings.TrimRightFunc(content[n-1].Text,
+		unicode.IsSpace)
+	if content[n-1].Text == "" {
+		return content[:n-1]
+	}
+	return content
+}
 
-	return toolUseBlocks, nil
+// mergeContinuation appends the content of a continuation response to
+// the partial response it continues. Text that continues the partial
+// response's final text block is joined to it. The stop reason and
+// usage are taken from the continuation.
+func mergeContinuation(partial, continuation anthropic.BetaMessage) anthropic.BetaMessage {
+	if len(partial.Content) == 0 {
+		return continuation
+	}
+
+	content := slices.Clone(partial.Content)
+	next := continuation.Content
+	if n := len(content); n > 0 && len(next) > 0 &&
+		content[n-1].Type == "text" && next[0].Type == "text" {
+		content[n-1].Text += next[0].Text
+		next = next[1:]
+	}
+
+	merged := partial
+	merged.Content = append(content, next...)
+	merged.StopReason = continuation.StopReason
+	merged.StopSequence = continuation.StopSequence
+	merged.Usage = continuation.Usage
+	return merged
 }
 
-// ExecuteTools executes the provided tool use blocks and adds results to conversation
-func (ac *AnthropicClient) ExecuteTools(toolUseBlocks []toolUseInfo, conversation *Conversation) {
+// ExecuteTools executes the provided tool use blocks and adds results to conversation.
+// Once ctx is cancelled, the running command is killed and the remaining
+// tool uses are answered with an error instead of being run. Each call is
+// written to the audit log as soon as it returns, so that the log keeps
+// it even if Gollum dies during the batch.
+func (ac *AnthropicClient) ExecuteTools(ctx context.Context, toolUseBlocks []toolUseInfo, conversation *Conversation) {
 	var results []anthropic.BetaContentBlockParamUnion
 
 	fmt.Println("\n[Executing tool commands...]")
 
 	// Process each tool use
 	for _, toolUse := range toolUseBlocks {
-		if toolUse.Name == "bash" {
-			toolUseResult := ac.onBashToolUse(toolUse)
-			results = append(results, toolUseResult)
+		entry := &AuditEntry{
+			Time:      time.Now(),
+			Session:   conversation.ID,
+			ToolUseID: toolUse.ID,
+			Tool:      toolUse.Name,
+			Input:     toolUse.Input,
+			Dir:       ac.workingDir(toolUse.Name),
+		}
+		var result anthropic.BetaContentBlockParamUnion
+		if ctx.Err() != nil {
+			result = anthropic.NewBetaToolResultBlock(
+				toolUse.ID,
+				"Not run: interrupted by the user",
+				true, // isError
+			)
+		} else if toolUse.Name == "bash" {
+			result = ac.onBashToolUse(ctx, toolUse, entry)
 		} else if toolUse.Name == "str_replace_editor" || toolUse.Name == "str_replace_based_edit_tool" {
-			toolUseResult := ac.onTextEditorToolUse(toolUse)
-			results = append(results, toolUseResult)
+			result = ac.onTextEditorToolUse(toolUse, entry)
+		} else if toolUse.Name == jobsToolName && ac.tools.Jobs != nil {
+			result = ac.onJobsToolUse(ctx, toolUse, entry)
+		} else {
+			// Every tool use needs a result, or the next request fails
+			result = anthropic.NewBetaToolResultBlock(
+				toolUse.ID,
+				fmt.Sprintf("Error: unknown tool %q", toolUse.Name),
+				true, // isError
+			)
+		}
+		entry.DurationMS = time.Since(entry.Time).Milliseconds()
+
+		// Secrets in the output must not leave the machine, and the
+		// log describes the result as it is sent
+		ac.Redactor.RedactResults([]anthropic.BetaContentBlockParamUnion{result})
+		entry.recordResult(result)
+		if err := ac.AuditLog.Append(entry); err != nil {
+			fmt.Printf("Warning: could not write the audit log: %v\n", err)
 		}
+		results = append(results, result)
 	}
-
-	// Add tool results to conversation
 	conversation.AddToolResults(results)
 }
 
 // onBashToolUse handles bash tool execution
-func (ac *AnthropicClient) onBashToolUse(toolUse toolUseInfo) anthropic.BetaContentBlockParamUnion {
+func (ac *AnthropicClient) onBashToolUse(ctx context.Context, toolUse toolUseInfo, entry *AuditEntry) anthropic.BetaContentBlockParamUnion {
 	// Create tool result
 	var toolResult anthropic.BetaContentBlockParamUnion
 
 	// Parse the command from the input
 	var input struct {
-		Command string `json:"command"`
-		Restart bool   `json:"restart"`
+		Command string  `json:"command"`
+		Restart bool    `json:"restart"`
+		Timeout float64 `json:"timeout"`
 	}
 	err := json.Unmarshal(toolUse.Input, &input)
 	if err != nil {
@@ -371,30 +682,122 @@ func (ac *AnthropicClient) onBashToolUse(toolUse toolUseInfo) anthropic.BetaCont
 
 	fmt.Printf("\n$ %s\n", input.Command)
 
-	// Execute the command locally
-	stdout, stderr, err := ac.tools.Bash.ExecuteCommand(input.Command)
+	// The user may deny the command or change it first
+	approval, err := ac.Approver.ApproveCommand(input.Command)
+	entry.approved(approval, err)
 	if err != nil {
+		fmt.Printf("Denied: %s\n", err)
+		return anthropic.NewBetaToolResultBlock(
+			toolUse.ID,
+			fmt.Sprintf("Error: %v", err),
+			true, // isError
+		)
+	}
+	if approval.Command != input.Command {
+		fmt.Printf("$ %s\n", approval.Command)
+		input.Command = approval.Command
+	}
+
+	// The model may give a command longer than the default timeout
+	if input.Timeout > 0 {
+		ctx = WithCommandTimeout(ctx,
+			time.Duration(input.Timeout*float64(time.Second)))
+	}
+
+	// Execute the command locally
+	start := time.Now()
+	stdout, stderr, err := ac.tools.Bash.ExecuteCommand(ctx, input.Command)
+	stdout, stderr, err = ac.answerPrompts(ctx, stdout, stderr, err)
+	elapsed := time.Since(start)
+	entry.exited(err)
+	var waitErr *InputWaitError
+	if errors.As(err, &waitErr) {
+		fmt.Printf("\n[Waiting for input after %q]\n", waitErr.Prompt)
+	} else if err != nil {
 		fmt.Printf("Error: %s\n", err)
 	}
 
-	var content string
-	if err == nil {
-		content = stdout
-	} else {
-		content = stderr
+	// Tell the model where the next command will run
+	var cwd string
+	if reporter, ok := ac.tools.Bash.(CwdReporter); ok {
+		cwd = reporter.Cwd()
+	}
+
+	// Both streams matter whether or not the command failed: a failing
+	// test run explains itself on stdout and a working build may warn
+	// on stderr
+	content := approval.Note + commandSummary(err, elapsed, cwd) +
+		ac.OutputLimiter.Limit(bashOutput, commandStreams(stdout, stderr))
+
+	var timeoutErr *TimeoutError
+	switch {
+	case waitErr != nil:
+		content += fmt.Sprintf("\nThe command is waiting for input after "+
+			"%q. The next bash command is typed into it followed by "+
+			"Enter; send ^C to interrupt it or ^D to end its input.",
+			waitErr.Prompt)
+	case errors.As(err, &timeoutErr) && ac.tools.Jobs != nil:
+		content += "\nThe command was stopped. Start long-running " +
+			"commands, such as servers and watchers, with the jobs tool."
+	case errors.As(err, &timeoutErr):
+		content += "\nThe command was stopped. Run long-running commands " +
+			"in the background with their output redirected to a file."
+	case ctx.Err() != nil:
+		content += "\nThe command was interrupted by the user."
 	}
 
 	toolResult = anthropic.NewBetaToolResultBlock(
 		toolUse.ID,
 		content,
-		err != nil, // isError
+		err != nil && waitErr == nil, // isError
 	)
 
 	return toolResult
 }
 
+// indentLines returns text with prefix before each line, ending in a
+// newline, so that it stands apart from the messages around it
+func indentLines(text, prefix string) string {
+	if text == "" {
+		return prefix + "(empty)\n"
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	return prefix + strings.Join(lines, prefix) + "\n"
+}
+
+// secretPrompt matches prompts whose answers must not be shown
+var secretPrompt = regexp.MustCompile(
+	`(?i)password|passphrase|passcode|\bpin\b|token|secret`)
+
+// answerPrompts lets the user answer the prompts of a command that waits
+// for input. A prompt that the user leaves unanswered goes to the model.
+func (ac *AnthropicClient) answerPrompts(ctx context.Context, stdout, stderr string, err error) (string, string, error) {
+	var waitErr *InputWaitError
+	for ac.Prompter != nil && errors.As(err, &waitErr) {
+		fmt.Printf("\n[The command is waiting for input. Answer it, " +
+			"or press Enter to leave it to the assistant.]\n")
+		secret := secretPrompt.MatchString(waitErr.Prompt)
+		answer, promptErr := ac.Prompter(waitErr.Prompt+" ", secret)
+		if promptErr != nil || answer == "" {
+			break
+		}
+
+		// The model learns that the prompt was answered, but not a
+		// secret answer
+		if secret {
+			stdout += "[the user entered the answer]\n"
+		} else {
+			stdout += fmt.Sprintf("[the user answered %q]\n", answer)
+		}
+		var more, moreStderr string
+		more, moreStderr, err = ac.tools.Bash.ExecuteCommand(ctx, answer)
+		stdout, stderr = stdout+more, stderr+moreStderr
+	}
+	return stdout, stderr, err
+}
+
 // onTextEditorToolUse handles text editor tool execution
-func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.BetaContentBlockParamUnion {
+func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo, entry *AuditEntry) anthropic.BetaContentBlockParamUnion {
 	// Create tool result
 	var toolResult anthropic.BetaContentBlockParamUnion
 
@@ -429,6 +832,18 @@ func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.Be
 	var output string
 	var execErr error
 
+	// approveEdit asks before the file changes and records its contents
+	// beforehand
+	entry.Path = ac.auditPath(input.Path)
+	approveEdit := func() error {
+		decision, err := ac.Approver.ApproveEdit(input.Path)
+		entry.approved(Approval{Decision: decision}, err)
+		if err == nil {
+			entry.BeforeHash = ac.fileHash(input.Path)
+		}
+		return err
+	}
+
 	// Use the actual tool name from the tool use for logging
 	toolName := toolUse.Name
 
@@ -465,25 +880,35 @@ func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.Be
 		}
 		fmt.Printf("%s\n", viewMsg)
 
-		rawOutput, execErr := ac.tools.TextEditor.View(input.Path, start, end)
+		rawOutput, err := ac.tools.TextEditor.View(input.Path, start, end)
+		execErr = err
 		if execErr == nil {
-			// Add line numbers to the output
-			output = addLineNumbers(rawOutput, start)
+			// Add line numbers to the output and keep it within the
+			// editor's output budget
+			output = ac.OutputLimiter.Limit(editorOutput,
+				addLineNumbers(rawOutput, start))
 		}
 
 	case "str_replace":
 		fmt.Printf("\n[%s] String replace in: %s\n  Replacing: %q\n  With: %q\n",
 			toolName, input.Path, input.OldStr, input.NewStr)
 
-		execErr = ac.tools.TextEditor.StringReplace(input.Path, input.OldStr, input.NewStr)
+		execErr = approveEdit()
+		if execErr == nil {
+			execErr = ac.tools.TextEditor.StringReplace(input.Path, input.OldStr, input.NewStr)
+		}
 		if execErr == nil {
 			output = "String replacement completed successfully"
 		}
 
 	case "create":
-		fmt.Printf("\n[%s] Creating file: %s\n", toolName, input.Path)
+		fmt.Printf("\n[%s] Creating file: %s\n  Content:\n%s",
+			toolName, input.Path, indentLines(input.FileText, "    "))
 
-		execErr = ac.tools.TextEditor.Create(input.Path, input.FileText)
+		execErr = approveEdit()
+		if execErr == nil {
+			execErr = ac.tools.TextEditor.Create(input.Path, input.FileText)
+		}
 		if execErr == nil {
 			output = fmt.Sprintf("File %s created successfully", input.Path)
 		}
@@ -492,10 +917,18 @@ func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.Be
 		if input.InsertLine == nil {
 			execErr = fmt.Errorf("insert_line is required for insert command")
 		} else {
-			fmt.Printf("\n[%s] Inserting text in: %s (after line %d)\n",
-				toolName, input.Path, *input.InsertLine)
+			// The built-in tool sends the text as new_str
+			text := input.NewText
+			if text == "" {
+				text = input.NewStr
+			}
+			fmt.Printf("\n[%s] Inserting text in: %s (after line %d)\n  Text:\n%s",
+				toolName, input.Path, *input.InsertLine, indentLines(text, "    "))
 
-			execErr = ac.tools.TextEditor.Insert(input.Path, *input.InsertLine, input.NewText)
+			execErr = approveEdit()
+			if execErr == nil {
+				execErr = ac.tools.TextEditor.Insert(input.Path, *input.InsertLine, text)
+			}
 			if execErr == nil {
 				output = "Text insertion completed successfully"
 			}
@@ -504,7 +937,10 @@ func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.Be
 	case "undo_edit":
 		fmt.Printf("\n[%s] Undoing last edit in: %s\n", toolName, input.Path)
 
-		execErr = ac.tools.TextEditor.UndoEdit(input.Path)
+		execErr = approveEdit()
+		if execErr == nil {
+			execErr = ac.tools.TextEditor.UndoEdit(input.Path)
+		}
 		if execErr == nil {
 			output = "Undo completed successfully"
 		}
@@ -512,9 +948,13 @@ func (ac *AnthropicClient) onTextEditorToolUse(toolUse toolUseInfo) anthropic.Be
 	default:
 		execErr = fmt.Errorf("unknown text editor command: %s", input.Command)
 	}
+	if entry.Approval != "" && entry.Approval != decisionDenied {
+		entry.AfterHash = ac.fileHash(input.Path)
+	}
 
 	if execErr != nil {
 		fmt.Printf("Error: %s\n", execErr)
+		entry.Error = execErr.Error()
 		toolResult = anthropic.NewBetaToolResultBlock(
 			toolUse.ID,
 			fmt.Sprintf("Error: %v", execErr),
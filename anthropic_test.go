@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func textBlock(text string) anthropic.BetaContentBlockUnion {
+	return anthropic.BetaContentBlockUnion{Type: "text", Text: text}
+}
+
+func toolUseBlock(id, input string) anthropic.BetaContentBlockUnion {
+	return anthropic.BetaContentBlockUnion{
+		Type:  "tool_use",
+		ID:    id,
+		Name:  "bash",
+		Input: json.RawMessage(input),
+	}
+}
+
+func TestDefaultMaxTokensForModel(t *testing.T) {
+	tests := []struct {
+		model string
+		want  int64
+	}{
+		{"claude-opus-4-0", 32000},
+		{"claude-opus-4-20250514", 32000},
+		{"claude-sonnet-4-0", 64000},
+		{"claude-3-7-sonnet-latest", 64000},
+		{"claude-3-5-sonnet-latest", 8192},
+		{"claude-3-5-haiku-latest", 8192},
+	}
+	for _, tt := range tests {
+		got := defaultMaxTokensForModel(anthropic.Model(tt.model))
+		if got != tt.want {
+			t.Errorf("defaultMaxTokensForModel(%q) = %d, want %d",
+				tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestRequestMaxTokens(t *testing.T) {
+	ac := &AnthropicClient{
+		model:     anthropic.ModelClaudeSonnet4_0,
+		MaxTokens: 64000,
+	}
+
+	c := NewConversation()
+	c.AddUserMessage("hello")
+	if got := ac.requestMaxTokens(c); got != 64000 {
+		t.Errorf("requestMaxTokens() for short conversation = %d, "+
+			"want 64000", got)
+	}
+
+	// A large conversation leaves only the rest of the window
+	c.RecordUsage(anthropic.BetaUsage{InputTokens: 180000})
+	if got := ac.requestMaxTokens(c); got != 200000-180000-minMaxTokens {
+		t.Errorf("requestMaxTokens() for large conversation = %d, want %d",
+			got, 200000-180000-minMaxTokens)
+	}
+
+	// The budget never drops below the minimum
+	c.RecordUsage(anthropic.BetaUsage{InputTokens: 199900})
+	if got := ac.requestMaxTokens(c); got != minMaxTokens {
+		t.Errorf("requestMaxTokens() for full conversation = %d, want %d",
+			got, minMaxTokens)
+	}
+}
+
+func TestDropTruncatedToolUse(t *testing.T) {
+	content := []anthropic.BetaContentBlockUnion{
+		textBlock("Let me check"),
+		toolUseBlock("toolu_1", `{"command":"ls"}`),
+		toolUseBlock("toolu_2", `{}`),
+	}
+
+	got, dropped := dropTruncatedToolUse(content)
+	if !dropped || len(got) != 2 || got[1].ID != "toolu_1" {
+		t.Errorf("dropTruncatedToolUse() = %v, %v, want the last tool "+
+			"use dropped", got, dropped)
+	}
+
+	got, dropped = dropTruncatedToolUse(content[:1])
+	if dropped || len(got) != 1 {
+		t.Errorf("dropTruncatedToolUse() on text = %v, %v, want text kept",
+			got, dropped)
+	}
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []anthropic.BetaContentBlockUnion
+		want    []string
+	}{
+		{
+			name:    "trailing newlines",
+			content: []anthropic.BetaContentBlockUnion{textBlock("Hello\n\n")},
+			want:    []string{"Hello"},
+		},
+		{
+			name: "whitespace only",
+			content: []anthropic.BetaContentBlockUnion{
+				textBlock("First"),
+				toolUseBlock("toolu_1", `{}`),
+				textBlock(" \n"),
+			},
+			want: []string{"First", ""},
+		},
+		{
+			name:    "empty",
+			content: nil,
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := strings.Clone(textOf(tt.content))
+			got := trimTrailingSpace(tt.content)
+			var texts []string
+			for _, block := range got {
+				texts = append(texts, block.Text)
+			}
+			if strings.Join(texts, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("trimTrailingSpace() = %q, want %q", texts, tt.want)
+			}
+			if textOf(tt.content) != original {
+				t.Errorf("trimTrailingSpace() modified its input")
+			}
+		})
+	}
+}
+
+// textOf returns the concatenated text of content
+func textOf(content []anthropic.BetaContentBlockUnion) string {
+	var text strings.Builder
+	for _, block := range content {
+		text.WriteString(block.Text)
+	}
+	return text.String()
+}
+
+func TestMergeContinuation(t *testing.T) {
+	partial := anthropic.BetaMessage{
+		ID:         "msg_1",
+		Content:    []anthropic.BetaContentBlockUnion{textBlock("The answer")},
+		StopReason: anthropic.BetaStopReasonMaxTokens,
+	}
+	continuation := anthropic.BetaMessage{
+		ID: "msg_2",
+		Content: []anthropic.BetaContentBlockUnion{
+			textBlock(" is 42."),
+			toolUseBlock("toolu_1", `{"command":"ls"}`),
+		},
+		StopReason: anthropic.BetaStopReasonToolUse,
+		Usage:      anthropic.BetaUsage{InputTokens: 10, OutputTokens: 5},
+	}
+
+	merged := mergeContinuation(partial, continuation)
+	if merged.ID != "msg_1" {
+		t.Errorf("merged ID = %q, want msg_1", merged.ID)
+	}
+	if len(merged.Content) != 2 ||
+		merged.Content[0].Text != "The answer is 42." ||
+		merged.Content[1].ID != "toolu_1" {
+		t.Errorf("merged content = %+v, want joined text and tool use",
+			merged.Content)
+	}
+	if merged.StopReason != anthropic.BetaStopReasonToolUse {
+		t.Errorf("merged stop reason = %q, want tool_use",
+			merged.StopReason)
+	}
+	if merged.Usage.OutputTokens != 5 {
+		t.Errorf("merged usage = %+v, want the continuation's usage",
+			merged.Usage)
+	}
+	if partial.Content[0].Text != "The answer" {
+		t.Errorf("mergeContinuation() modified the partial message")
+	}
+
+	uses := toolUsesOf(merged)
+	if len(uses) != 1 || uses[0].ID != "toolu_1" ||
+		string(uses[0].Input) != `{"command":"ls"}` {
+		t.Errorf("toolUsesOf(merged) = %+v, want toolu_1", uses)
+	}
+
+	// The first response is taken as is
+	if got := mergeContinuation(anthropic.BetaMessage{}, continuation); got.ID != "msg_2" {
+		t.Errorf("mergeContinuation() of empty partial = %q, want msg_2",
+			got.ID)
+	}
+}
+
+func TestMergedContinuationParam(t *testing.T) {
+	// Blocks decoded from a response carry their raw JSON, which
+	// ToParam prefers over the fields that merging modifies
+	var partial, continuation anthropic.BetaMessage
+	if err := json.Unmarshal([]byte(`{"role":"assistant","content":`+
+		`[{"type":"text","text":"The answer"}]}`), &partial); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"role":"assistant","content":`+
+		`[{"type":"text","text":" is 42."}]}`), &continuation); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConversation()
+	c.AddAssistantMessage(mergeContinuation(partial, continuation))
+	got := c.messages[0]
+	if got.Role != anthropic.BetaMessageParamRoleAssistant ||
+		len(got.Content) != 1 || got.Content[0].OfText == nil ||
+		got.Content[0].OfText.Text != "The answer is 42." {
+		t.Errorf("merged message param = %+v, want joined text", got)
+	}
+}
+
+func TestAnswerPrompts(t *testing.T) {
+	tool := NewPtyBashTool()
+	defer tool.stopSession()
+	ac := newTestClient("http://localhost")
+	ac.tools.Bash = tool
+
+	var prompts []string
+	ac.Prompter = func(prompt string, secret bool) (string, error) {
+		prompts = append(prompts, fmt.Sprintf("%s/%v", prompt, secret))
+		if secret {
+			return "hunter2", nil
+		}
+		return "", nil // leave it to the model
+	}
+
+	stdout, stderr, err := tool.ExecuteCommand(context.Background(),
+		`read -s -p "Password: " pw; echo; read -p "Name? " name; echo "$name"`)
+	stdout, _, err = ac.answerPrompts(context.Background(), stdout, stderr, err)
+
+	wantPrompts := []string{"Password: /true", "Name? /false"}
+	if !slices.Equal(prompts, wantPrompts) {
+		t.Errorf("prompts = %q, want %q", prompts, wantPrompts)
+	}
+	var waitErr *InputWaitError
+	if !errors.As(err, &waitErr) {
+		t.Errorf("answerPrompts() error = %v, want *InputWaitError", err)
+	}
+	if strings.Contains(stdout, "hunter2") {
+		t.Errorf("answerPrompts() output %q reveals the secret", stdout)
+	}
+	want := "Password: [the user entered the answer]\n\nName? "
+	if stdout != want {
+		t.Errorf("answerPrompts() output = %q, want %q", stdout, want)
+	}
+}
+
+func TestBashToolTimeout(t *testing.T) {
+	if _, ok := bashToolParam().OfTool.InputSchema.Properties.(map[string]any)["timeout"]; !ok {
+		t.Error("the bash tool has no timeout")
+	}
+
+	ac := newTestClient("http://localhost")
+	start := time.Now()
+	result := ac.onBashToolUse(context.Background(), toolUseInfo{
+		ID:    "toolu_1",
+		Name:  "bash",
+		Input: json.RawMessage(`{"command":"echo started; sleep 10","timeout":0.3}`),
+	}, &AuditEntry{}).OfToolResult
+	text := result.Content[0].OfText.Text
+	if !result.IsError.Value || !strings.Contains(text, "timed out after 0.3s") ||
+		!strings.Contains(text, "started") {
+		t.Errorf("result = %q, want a timeout with the partial output", text)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command with a 0.3s timeout took %v", elapsed)
+	}
+}
+
+func TestIndentLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", "  (empty)\n"},
+		{"one", "  one\n"},
+		{"one\n", "  one\n"},
+		{"one\ntwo\n", "  one\n  two\n"},
+		{"one\n\nthree", "  one\n  \n  three\n"},
+	}
+	for _, tt := range tests {
+		if got := indentLines(tt.text, "  "); got != tt.want {
+			t.Errorf("indentLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTextEditorInsertsNewStr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("one\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ac := newTestClient("http://localhost")
+	result := ac.onTextEditorToolUse(toolUseInfo{
+		ID:   "toolu_1",
+		Name: "str_replace_based_edit_tool",
+		Input: json.RawMessage(`{"command":"insert","path":"` + path +
+			`","insert_line":1,"new_str":"two"}`),
+	}, &AuditEntry{}).OfToolResult
+	if result.IsError.Value {
+		t.Fatalf("insert failed: %s", result.Content[0].OfText.Text)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\ntwo\nthree\n" {
+		t.Errorf("file after insert = %q", data)
+	}
+}
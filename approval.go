@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Approval modes say which tool uses run without asking the user
+const (
+	approveAlways    = "always"     // commands and edits run without asking
+	approveEditsOnly = "edits-only" // edits run without asking, commands need approval
+	approveNever     = "never"      // commands and edits need approval
+)
+
+// Approval decisions, as recorded in the audit log
+const (
+	decisionNotAsked     = "not-asked"     // the approval mode lets it run
+	decisionUser         = "user"          // the user approved it
+	decisionSessionRule  = "session-rule"  // a rule the user made this session approved it
+	decisionPolicy       = "policy"        // a policy rule allowed it
+	decisionEdited       = "edited"        // the user changed the command, then ran it
+	decisionDenied       = "denied"        // the user denied it
+	decisionPolicyDenied = "policy-denied" // a policy rule denied it
+)
+
+// DeniedError reports that the user did not allow a command or edit
+type DeniedError struct {
+	// What was denied, "command" or "edit"
+	What string
+
+	// Reason is the user's explanation for the model, if any
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("the user denied this %s", e.What)
+	}
+	return fmt.Sprintf("the user denied this %s: %s", e.What, e.Reason)
+}
+
+// Approver asks the user before commands run and files are edited. A
+// nil Approver approves everything.
+type Approver struct {
+	// Mode is the approval mode
+	Mode string
+
+	// Prompter asks the user a question. Without one, everything
+	// that needs approval is denied.
+	Prompter func(prompt string, secret bool) (string, error)
+
+	// Editor lets the user edit a command before it runs, or is nil
+	// to have the user type the new command with Prompter
+	Editor func(prompt, text string) (string, error)
+
+	// Policy, if not nil, allows, denies or asks about commands
+	// before the approval mode applies
+	Policy *Policy
+
+	mutex    sync.Mutex
+	patterns []string        // command patterns approved for the session
+	files    map[string]bool // files whose edits are approved for the session
+}
+
+// newApprover returns an Approver for mode
+func newApprover(mode string) (*Approver, error) {
+	switch mode {
+	case approveAlways, approveEditsOnly, approveNever:
+		return &Approver{Mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unknown approval mode %q (want %s, %s or %s)",
+		mode, approveAlways, approveEditsOnly, approveNever)
+}
+
+// Approval is the outcome of approving a command
+type Approval struct {
+	// Command is the command to run, which the user may have edited
+	Command string
+
+	// Note tells the model how the command was approved, if that is
+	// worth knowing
+	Note string
+
+	// Decision says who decided, such as decisionUser
+	Decision string
+}
+
+// ApproveCommand decides whether command may run, by the policy or by
+// asking the user. It returns the command to run or an error that is a
+// *PolicyError or a *DeniedError; either way, the approval holds the
+// decision.
+func (a *Approver) ApproveCommand(command string) (Approval, error) {
+	if a == nil {
+		return Approval{Command: command, Decision: decisionNotAsked}, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	decision := a.Policy.Check(command)
+	switch decision.Action {
+	case policyDeny:
+		err := &PolicyError{Rule: decision.Rules[0], Match: decision.Match}
+		return Approval{Decision: decisionPolicyDenied}, err
+	case policyAllow:
+		rules := formatRules(decision.Rules)
+		fmt.Printf("[Allowed by policy %s]\n", rules)
+		return Approval{Command: command, Decision: decisionPolicy,
+			Note: fmt.Sprintf("[allowed by policy %s]\n", rules)}, nil
+	case policyAsk:
+		var note string
+		if len(decision.Rules) > 0 {
+			fmt.Printf("[Policy rule %v asks about %q]\n", decision.Rules[0],
+				decision.Match)
+			note = fmt.Sprintf("[policy rule %v made the user decide "+
+				"on %q]\n", decision.Rules[0], decision.Match)
+		} else {
+			fmt.Printf("[The policy cannot check %q]\n", decision.Match)
+			note = fmt.Sprintf("[the policy could not check %q, so the "+
+				"user decided]\n", decision.Match)
+		}
+		approval, err := a.ask(command, false)
+		approval.Note = note + approval.Note
+		return approval, err
+	}
+
+	if a.Mode == approveAlways {
+		return Approval{Command: command, Decision: decisionNotAsked}, nil
+	}
+	for _, pattern := range a.patterns {
+		if matchCommandPattern(pattern, command) {
+			fmt.Printf("[Approved by the session rule %q]\n", pattern)
+			return Approval{Command: command, Decision: decisionSessionRule}, nil
+		}
+	}
+	return a.ask(command, true)
+}
+
+// ask asks the user whether command may run. If remember is set, the
+// user may approve commands like it for the rest of the session.
+func (a *Approver) ask(command string, remember bool) (Approval, error) {
+	if a.Prompter == nil {
+		return Approval{Decision: decisionDenied}, &DeniedError{What: "command",
+			Reason: "there is no one to approve it"}
+	}
+
+	var pattern string
+	if remember {
+		pattern = commandPattern(command)
+	}
+	question := "Run it? [y]es, [n]o, [e]dit: "
+	if pattern != "" {
+		question = fmt.Sprintf("Run it? [y]es, [a]lways for %q, [n]o, [e]dit: ",
+			pattern)
+	}
+	for {
+		answer, err := a.Prompter(question, false)
+		if err != nil {
+			return Approval{Decision: decisionDenied}, &DeniedError{What: "command"}
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return Approval{Command: command, Decision: decisionUser}, nil
+		case "a", "always":
+			if pattern != "" {
+				a.patterns = append(a.patterns, pattern)
+				return Approval{Command: command, Decision: decisionUser}, nil
+			}
+		case "n", "no":
+			return Approval{Decision: decisionDenied},
+				&DeniedError{What: "command", Reason: a.reason()}
+		case "e", "edit":
+			edited, err := a.edit(command)
+			if err == nil && strings.TrimSpace(edited) != "" && edited != command {
+				return Approval{Command: edited, Decision: decisionEdited,
+					Note: fmt.Sprintf("[the user changed the command to: %s]\n",
+						edited)}, nil
+			}
+		}
+	}
+}
+
+// formatRules lists policy rules for the user and the model
+func formatRules(rules []*PolicyRule) string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.String()
+	}
+	if len(names) == 1 {
+		return "rule " + names[0]
+	}
+	return "rules " + strings.Join(names, ", ")
+}
+
+// ApproveEdit asks the user whether the file at path may be edited. It
+// returns the decision and nil or a *DeniedError.
+func (a *Approver) ApproveEdit(path string) (string, error) {
+	if a == nil || a.Mode == approveAlways || a.Mode == approveEditsOnly {
+		return decisionNotAsked, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.files[path] {
+		return decisionSessionRule, nil
+	}
+	if a.Prompter == nil {
+		return decisionDenied, &DeniedError{What: "edit",
+			Reason: "there is no one to approve it"}
+	}
+
+	for {
+		answer, err := a.Prompter(
+			"Apply it? [y]es, [a]ll edits to this file, [n]o: ", false)
+		if err != nil {
+			return decisionDenied, &DeniedError{What: "edit"}
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return decisionUser, nil
+		case "a", "all":
+			if a.files == nil {
+				a.files = make(map[string]bool)
+			}
+			a.files[path] = true
+			return decisionUser, nil
+		case "n", "no":
+			return decisionDenied, &DeniedError{What: "edit", Reason: a.reason()}
+		}
+	}
+}
+
+// reason asks the user why they denied a command or edit
+func (a *Approver) reason() string {
+	reason, err := a.Prompter("Reason for the assistant (optional): ", false)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(reason)
+}
+
+// edit lets the user change command
+func (a *Approver) edit(command string) (string, error) {
+	if a.Editor != nil {
+		return a.Editor("$ ", command)
+	}
+	return a.Prompter("New command: ", false)
+}
+
+// commandPattern returns the pattern that approves commands like
+// command for the rest of the session: the program and its subcommand,
+// if any, with any arguments. Only simple commands get a pattern.
+func commandPattern(command string) string {
+	if !simpleCommand(command) {
+		return ""
+	}
+	words := strings.Fields(command)
+	if len(words) == 0 {
+		return ""
+	}
+	prefix := words[0]
+	if len(words) > 1 && isSubcommand(words[1]) {
+		prefix += " " + words[1]
+	}
+	return prefix + " *"
+}
+
+// matchCommandPattern reports whether pattern approves command
+func matchCommandPattern(pattern, command string) bool {
+	if !simpleCommand(command) {
+		return false
+	}
+	prefix := strings.TrimSuffix(pattern, " *")
+	command = strings.Join(strings.Fields(command), " ")
+	return command == prefix || strings.HasPrefix(command, prefix+" ")
+}
+
+// simpleCommand reports whether command runs a single program, without
+// pipes, lists, redirections or command substitution that could hide a
+// second command behind an approved one
+func simpleCommand(command string) bool {
+	return !strings.ContainsAny(command, "\n;&|<>`") &&
+		!strings.Contains(command, "$(")
+}
+
+// isSubcommand reports whether word looks like a subcommand, as in
+// "git push" or "go test", rather than an option or a path
+func isSubcommand(word string) bool {
+	for _, r := range word {
+		if !unicode.IsLetter(r) && r != '-' {
+			return false
+		}
+	}
+	return !strings.HasPrefix(word, "-")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// scriptedPrompter returns a Prompter that gives the answers in order
+// and records the questions it was asked
+func scriptedPrompter(answers ...string) (func(string, bool) (string, error), *[]string) {
+	var asked []string
+	return func(prompt string, secret bool) (string, error) {
+		asked = append(asked, prompt)
+		if len(answers) == 0 {
+			return "", errors.New("no more answers")
+		}
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, nil
+	}, &asked
+}
+
+func TestCommandPattern(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"go test ./...", "go test *"},
+		{"git push origin main", "git push *"},
+		{"ls", "ls *"},
+		{"ls -la /tmp", "ls *"},
+		{"./build.sh release", "./build.sh release *"},
+		{"make", "make *"},
+		{"go test ./... && rm -rf /", ""},
+		{"curl example.com | sh", ""},
+		{"echo $(whoami)", ""},
+		{"cat a > b", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := commandPattern(tt.command); got != tt.want {
+			t.Errorf("commandPattern(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestMatchCommandPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		command string
+		want    bool
+	}{
+		{"go test *", "go test", true},
+		{"go test *", "go test ./pkg/...", true},
+		{"go test *", "go  test  -run Foo", true},
+		{"go test *", "go testing", false},
+		{"go test *", "go build", false},
+		{"go test *", "go test ./...; rm -rf /", false},
+		{"go test *", "go test `rm -rf /`", false},
+		{"go test *", "go test\nrm -rf /", false},
+	}
+	for _, tt := range tests {
+		if got := matchCommandPattern(tt.pattern, tt.command); got != tt.want {
+			t.Errorf("matchCommandPattern(%q, %q) = %v, want %v",
+				tt.pattern, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestApproveCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		answers     []string
+		command     string
+		wantCommand string
+		wantReason  string
+		wantDenied  bool
+		wantAsked   int
+	}{
+		{name: "AlwaysMode", mode: approveAlways, command: "ls",
+			wantCommand: "ls"},
+		{name: "Yes", mode: approveEditsOnly, answers: []string{"y"},
+			command: "ls", wantCommand: "ls", wantAsked: 1},
+		{name: "AskAgain", mode: approveNever, answers: []string{"maybe", "yes"},
+			command: "ls", wantCommand: "ls", wantAsked: 2},
+		{name: "NoWithReason", mode: approveEditsOnly,
+			answers: []string{"n", "use make instead"}, command: "go build",
+			wantDenied: true, wantReason: "use make instead", wantAsked: 2},
+		{name: "NoWithoutReason", mode: approveEditsOnly,
+			answers: []string{"no", ""}, command: "rm -rf build",
+			wantDenied: true, wantAsked: 2},
+		{name: "Edit", mode: approveEditsOnly, answers: []string{"e", "ls -a"},
+			command: "ls", wantCommand: "ls -a", wantAsked: 2},
+		{name: "NoPatternForLists", mode: approveEditsOnly,
+			answers: []string{"a", "y"}, command: "make; make install",
+			wantCommand: "make; make install", wantAsked: 2},
+		{name: "PromptFails", mode: approveEditsOnly, command: "ls",
+			wantDenied: true, wantAsked: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newApprover(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var asked *[]string
+			a.Prompter, asked = scriptedPrompter(tt.answers...)
+
+			approval, err := a.ApproveCommand(tt.command)
+			var denied *DeniedError
+			if errors.As(err, &denied) != tt.wantDenied {
+				t.Fatalf("ApproveCommand() error = %v, want denied %v", err, tt.wantDenied)
+			}
+			if tt.wantDenied && denied.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", denied.Reason, tt.wantReason)
+			}
+			if !tt.wantDenied && approval.Command != tt.wantCommand {
+				t.Errorf("ApproveCommand() = %q, want %q", approval.Command, tt.wantCommand)
+			}
+			if len(*asked) != tt.wantAsked {
+				t.Errorf("asked %q, want %d questions", *asked, tt.wantAsked)
+			}
+		})
+	}
+
+	t.Run("SessionPattern", func(t *testing.T) {
+		a, _ := newApprover(approveEditsOnly)
+		var asked *[]string
+		a.Prompter, asked = scriptedPrompter("a")
+		for _, command := range []string{"go test ./...", "go test -run Foo ."} {
+			if _, err := a.ApproveCommand(command); err != nil {
+				t.Errorf("ApproveCommand(%q) error = %v", command, err)
+			}
+		}
+		if _, err := a.ApproveCommand("go test ./... && git push"); err == nil {
+			t.Error("a list was approved by the session pattern")
+		}
+		if len(*asked) != 2 {
+			t.Errorf("asked %q, want the pattern question and one more", *asked)
+		}
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		a, _ := newApprover(approveAlways)
+		a.Policy = testPolicy(t, "allow go test *", "ask git push *", "deny rm *")
+		var asked *[]string
+		a.Prompter, asked = scriptedPrompter("y", "n", "")
+
+		approval, err := a.ApproveCommand("go test ./...")
+		if err != nil || !strings.HasPrefix(approval.Note, "[allowed by policy rule `allow go test *` (") {
+			t.Errorf("allowed command = %+v, %v", approval, err)
+		}
+		approval, err = a.ApproveCommand("ls && git push")
+		if err != nil || approval.Command != "ls && git push" ||
+			!strings.HasPrefix(approval.Note, "[policy rule `ask git push *` (") {
+			t.Errorf("asked command = %+v, %v", approval, err)
+		}
+		var denied *DeniedError
+		if _, err := a.ApproveCommand("git push"); !errors.As(err, &denied) {
+			t.Errorf("ApproveCommand(git push) error = %v, want the user's denial", err)
+		}
+		var policyErr *PolicyError
+		if _, err := a.ApproveCommand("go test ./... && rm -rf /"); !errors.As(err, &policyErr) ||
+			policyErr.Match != "rm -rf /" {
+			t.Errorf("ApproveCommand(rm) error = %v, want a policy denial", err)
+		}
+		// The user was asked in always mode, without a session pattern
+		if len(*asked) != 3 || strings.Contains((*asked)[0], "[a]lways") {
+			t.Errorf("asked %q, want two questions and a reason", *asked)
+		}
+	})
+
+	t.Run("NoPrompter", func(t *testing.T) {
+		a, _ := newApprover(approveNever)
+		if _, err := a.ApproveCommand("ls"); err == nil {
+			t.Error("command approved without anyone to ask")
+		}
+	})
+}
+
+func TestApproveEdit(t *testing.T) {
+	a, _ := newApprover(approveEditsOnly)
+	a.Prompter, _ = scriptedPrompter()
+	if decision, err := a.ApproveEdit("main.go"); err != nil || decision != decisionNotAsked {
+		t.Errorf("edits-only mode asked about an edit: %q, %v", decision, err)
+	}
+
+	a, _ = newApprover(approveNever)
+	var asked *[]string
+	a.Prompter, asked = scriptedPrompter("a", "n", "not that file")
+	for _, want := range []string{decisionUser, decisionSessionRule} {
+		if decision, err := a.ApproveEdit("main.go"); err != nil || decision != want {
+			t.Errorf("ApproveEdit(main.go) = %q, %v, want %q", decision, err, want)
+		}
+	}
+	decision, err := a.ApproveEdit("go.mod")
+	if decision != decisionDenied {
+		t.Errorf("ApproveEdit(go.mod) decision = %q, want %q", decision, decisionDenied)
+	}
+	want := "the user denied this edit: not that file"
+	if err == nil || err.Error() != want {
+		t.Errorf("ApproveEdit(go.mod) error = %v, want %q", err, want)
+	}
+	if len(*asked) != 3 {
+		t.Errorf("asked %q, want 3 questions", *asked)
+	}
+}
+
+func TestNewApprover(t *testing.T) {
+	for _, mode := range []string{approveAlways, approveEditsOnly, approveNever} {
+		if _, err := newApprover(mode); err != nil {
+			t.Errorf("newApprover(%q) error = %v", mode, err)
+		}
+	}
+	if _, err := newApprover("sometimes"); err == nil {
+		t.Error("newApprover(sometimes) succeeded")
+	}
+}
+
+func TestDeniedToolResults(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	dir := t.TempDir()
+	ac := newTestClient("http://localhost")
+	ac.tools.Bash = NewStatelessBashTool()
+	ac.tools.TextEditor = NewSimpleTextEditorTool()
+	ac.Approver, _ = newApprover(approveNever)
+	ac.Approver.Prompter, _ = scriptedPrompter(
+		"n", "too risky", // the command
+		"e", "echo edited", // the second command
+		"n", "", // the edit
+	)
+
+	entry := &AuditEntry{}
+	result := ac.onBashToolUse(context.Background(), toolUseInfo{
+		ID:    "toolu_1",
+		Name:  "bash",
+		Input: json.RawMessage(`{"command":"touch ` + filepath.Join(dir, "x") + `"}`),
+	}, entry).OfToolResult
+	want := "Error: the user denied this command: too risky"
+	if !result.IsError.Value || result.Content[0].OfText.Text != want {
+		t.Errorf("denied command result = %q (error %v), want %q",
+			result.Content[0].OfText.Text, result.IsError.Value, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x")); err == nil {
+		t.Error("denied command ran")
+	}
+	if entry.Approval != decisionDenied || entry.ExitStatus != nil {
+		t.Errorf("denied command entry = %+v", entry)
+	}
+
+	entry = &AuditEntry{}
+	result = ac.onBashToolUse(context.Background(), toolUseInfo{
+		ID:    "toolu_2",
+		Name:  "bash",
+		Input: json.RawMessage(`{"command":"echo original"}`),
+	}, entry).OfToolResult
+	text := result.Content[0].OfText.Text
+	if result.IsError.Value ||
+		!strings.HasPrefix(text, "[the user changed the command to: echo edited]\n") ||
+		!strings.Contains(text, "<stdout>\nedited\n</stdout>") {
+		t.Errorf("edited command result = %q", text)
+	}
+	if entry.Approval != decisionEdited || entry.ExitStatus == nil || *entry.ExitStatus != 0 {
+		t.Errorf("edited command entry = %+v", entry)
+	}
+
+	path := filepath.Join(dir, "new.txt")
+	result = ac.onTextEditorToolUse(toolUseInfo{
+		ID:    "toolu_3",
+		Name:  "str_replace_based_edit_tool",
+		Input: json.RawMessage(`{"command":"create","path":"` + path + `","file_text":"hi"}`),
+	}, &AuditEntry{}).OfToolResult
+	want = "Error: the user denied this edit"
+	if !result.IsError.Value || result.Content[0].OfText.Text != want {
+		t.Errorf("denied edit result = %q (error %v), want %q",
+			result.Content[0].OfText.Text, result.IsError.Value, want)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("denied edit was applied")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// AuditEntry records one tool call
+type AuditEntry struct {
+	Time      time.Time       `json:"time"`
+	Session   string          `json:"session"`
+	ToolUseID string          `json:"tool_use_id"`
+	Tool      string          `json:"tool"`
+	Input     json.RawMessage `json:"input"`
+
+	// Dir is the working directory of the call, which relative paths
+	// in its input are relative to
+	Dir string `json:"dir,omitempty"`
+
+	// Approval is the approval decision, such as decisionUser, and
+	// ApprovalDetail what the model was told about it or why the call
+	// was denied
+	Approval       string `json:"approval,omitempty"`
+	ApprovalDetail string `json:"approval_detail,omitempty"`
+
+	// ExitStatus is the exit status of a command that ran to the end
+	ExitStatus *int   `json:"exit_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	IsError    bool   `json:"is_error"`
+
+	DurationMS int64 `json:"duration_ms"`
+
+	// ResultSize and ResultHash describe the result as it was sent,
+	// after redaction
+	ResultSize int    `json:"result_size"`
+	ResultHash string `json:"result_hash"`
+
+	// Path is the file of a text editor call, absolute and with its
+	// links resolved, and BeforeHash and AfterHash its contents around
+	// an edit. A missing file has no hash.
+	Path       string `json:"path,omitempty"`
+	BeforeHash string `json:"before_hash,omitempty"`
+	AfterHash  string `json:"after_hash,omitempty"`
+}
+
+// approved records how a call was approved or why it was not
+func (e *AuditEntry) approved(approval Approval, err error) {
+	e.Approval, e.ApprovalDetail = approval.Decision, strings.TrimSpace(approval.Note)
+	if err != nil {
+		e.ApprovalDetail = err.Error()
+	}
+}
+
+// exited records how a command ended
+func (e *AuditEntry) exited(err error) {
+	var exitErr *ExitError
+	switch {
+	case err == nil:
+		e.ExitStatus = new(int)
+	case errors.As(err, &exitErr):
+		e.ExitStatus = &exitErr.Status
+		e.Error = err.Error()
+	default:
+		e.Error = err.Error()
+	}
+}
+
+// recordResult records the size and hash of the result text
+func (e *AuditEntry) recordResult(result anthropic.BetaContentBlockParamUnion) {
+	var text strings.Builder
+	if result.OfToolResult != nil {
+		e.IsError = result.OfToolResult.IsError.Value
+		for _, content := range result.OfToolResult.Content {
+			if content.OfText != nil {
+				text.WriteString(content.OfText.Text)
+			}
+		}
+	}
+	e.ResultSize = text.Len()
+	e.ResultHash = contentHash([]byte(text.String()))
+}
+
+// contentHash returns the SHA-256 hash of data
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fileReader is implemented by text editor tools that can read a file's
+// raw contents, so that edits can be hashed
+type fileReader interface {
+	readFile(path string) ([]byte, error)
+}
+
+// pathResolver is implemented by text editor tools that can tell which
+// file a path refers to, so that the log names it however it was given
+type pathResolver interface {
+	resolve(path string) (string, error)
+	workingDir() (string, error)
+}
+
+// workingDir returns the directory that relative paths in a call of
+// the tool are relative to. Commands run where the last one left off,
+// or else where the text editor works, which is on the remote host
+// with -remote.
+func (ac *AnthropicClient) workingDir(tool string) string {
+	if tool == "bash" || tool == jobsToolName {
+		if reporter, ok := ac.tools.Bash.(CwdReporter); ok {
+			if cwd := reporter.Cwd(); cwd != "" {
+				return cwd
+			}
+		}
+	}
+	if resolver, ok := ac.tools.TextEditor.(pathResolver); ok {
+		if dir, err := resolver.workingDir(); err == nil {
+			return dir
+		}
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// auditPath returns the path of the file that a text editor call uses,
+// as the workspace checks it, or path itself if it cannot be resolved
+func (ac *AnthropicClient) auditPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if resolver, ok := ac.tools.TextEditor.(pathResolver); ok {
+		if resolved, err := resolver.resolve(path); err == nil {
+			return resolved
+		}
+	}
+	return path
+}
+
+// fileHash returns the hash of the file at path, or the empty string if
+// it cannot be read
+func (ac *AnthropicClient) fileHash(path string) string {
+	reader, ok := ac.tools.TextEditor.(fileReader)
+	if !ok {
+		return ""
+	}
+	data, err := reader.readFile(path)
+	if err != nil {
+		return ""
+	}
+	return contentHash(data)
+}
+
+// AuditLog is an append-only JSONL file with one entry per tool call
+type AuditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// defaultAuditLogPath returns where the audit log is kept unless -audit-log
+// says otherwise, which is the same for every project on the machine
+func defaultAuditLogPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gollum", "audit.jsonl")
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it
+// if needed. Only the user can read it, since inputs may hold secrets.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: f}, nil
+}
+
+// Append writes an entry to the log in a single write, so that
+// several Gollums can share a log
+func (l *AuditLog) Append(entry *AuditEntry) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the log
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// auditFilter selects audit entries
+type auditFilter struct {
+	// Session is a session ID or a prefix of one
+	Session string
+
+	Tool string
+
+	// Path selects text editor calls on the path or below it, and
+	// commands that mention it
+	Path string
+}
+
+// match reports whether the filter selects entry
+func (f auditFilter) match(entry *AuditEntry) bool {
+	if !strings.HasPrefix(entry.Session, f.Session) {
+		return false
+	}
+	if f.Tool != "" && entry.Tool != f.Tool {
+		return false
+	}
+	if f.Path == "" {
+		return true
+	}
+	if entry.Path != "" {
+		path := filepath.Clean(f.Path)
+		if filepath.IsAbs(entry.Path) && !filepath.IsAbs(path) {
+			path, _ = filepath.Abs(path)
+		}
+		rel, err := filepath.Rel(path, entry.Path)
+		return err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	var input struct {
+		Command string `json:"command"`
+	}
+	json.Unmarshal(entry.Input, &input)
+	return strings.Contains(input.Command, f.Path)
+}
+
+// readAuditLog calls fn with each entry in the log that the filter
+// selects. Lines that are not valid entries are skipped.
+func readAuditLog(r io.Reader, filter auditFilter, fn func(*AuditEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if filter.match(&entry) {
+			fn(&entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// printAuditEntry writes an entry for people to read
+func printAuditEntry(w io.Writer, entry *AuditEntry) {
+	status := "ok"
+	switch {
+	case entry.ExitStatus != nil:
+		status = fmt.Sprintf("exit %d", *entry.ExitStatus)
+	case entry.Error != "":
+		status = entry.Error
+	case entry.IsError:
+		status = "error"
+	}
+	approval := entry.Approval
+	if approval == "" {
+		approval = "-"
+	}
+	fmt.Fprintf(w, "%s  %s  %s  approval: %s  %s  %v  %d bytes\n",
+		entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Session,
+		entry.Tool, approval, status,
+		time.Duration(entry.DurationMS)*time.Millisecond, entry.ResultSize)
+
+	var input map[string]any
+	json.Unmarshal(entry.Input, &input)
+	switch {
+	case entry.Tool == "bash":
+		if command, ok := input["command"].(string); ok {
+			fmt.Fprintf(w, "    %s$ %s\n", entry.Dir, command)
+		} else if input["restart"] == true {
+			fmt.Fprintf(w, "    restart\n")
+		}
+	case entry.Path != "":
+		fmt.Fprintf(w, "    %v %s\n", input["command"], entry.Path)
+		if entry.BeforeHash != "" || entry.AfterHash != "" {
+			fmt.Fprintf(w, "    before %s\n    after  %s\n",
+				orNone(entry.BeforeHash), orNone(entry.AfterHash))
+		}
+	default:
+		fmt.Fprintf(w, "    %s\n", entry.Input)
+	}
+	if entry.ApprovalDetail != "" {
+		fmt.Fprintf(w, "    %s\n", entry.ApprovalDetail)
+	}
+}
+
+// orNone shows a missing hash
+func orNone(hash string) string {
+	if hash == "" {
+		return "(none)"
+	}
+	return hash
+}
+
+// runAudit runs the audit subcommand, which prints the audit log
+func runAudit(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	var filter auditFilter
+	logPath := flags.String("log", defaultAuditLogPath(), "Audit log to read")
+	flags.StringVar(&filter.Session, "session", "", "Only show the session with this ID or ID prefix")
+	flags.StringVar(&filter.Tool, "tool", "", "Only show calls of this tool, such as bash or jobs")
+	flags.StringVar(&filter.Path, "path", "", "Only show edits of this file or directory and commands that mention it")
+	asJSON := flags.Bool("json", false, "Print the matching entries as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	f, err := os.Open(*logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(stdout)
+	count := 0
+	err = readAuditLog(f, filter, func(entry *AuditEntry) {
+		count++
+		if *asJSON {
+			encoder.Encode(entry)
+			return
+		}
+		printAuditEntry(stdout, entry)
+	})
+	if err == nil && count == 0 && !*asJSON {
+		fmt.Fprintln(stdout, "No matching tool calls")
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The session protocol runs commands in a long-lived bash process that
+// reads its script from a pipe. Each command is sent as a single line
+// that evaluates the command with stdin from /dev/null, so commands
+// that read stdin cannot swallow the rest of the protocol. When the
+// command finishes, bash prints a marker with the exit status and the
+// working directory to stdout and a marker to stderr. The markers
+// contain a random nonce that never appears literally in the input, so
+// neither command output nor `set -v` tracing can fake them.
+
+// markerPrefix starts every end-of-command marker
+const markerPrefix = "__GOLLUM_"
+
+// newNonce returns a random string that identifies one command's
+// markers
+func newNonce() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ansiCQuote quotes s as a bash $'...' string, which can hold any text,
+// including newlines, on a single line
+func ansiCQuote(s string) string {
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' || c == '\'':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// sessionInput returns the line that runs command in the session and
+// prints the end markers for nonce. The command is evaluated in the
+// shell itself rather than a subshell, so cd and export persist.
+func sessionInput(command, nonce string) string {
+	return fmt.Sprintf("{ eval %s\n} </dev/null; "+
+		"printf '%s%%s %%d %%s\\n' %s \"$?\" \"$PWD\"; "+
+		"printf '%s%%s\\n' %s >&2\n",
+		ansiCQuote(command), markerPrefix, nonce, markerPrefix, nonce)
+}
+
+// markerResult is the output of a command read from one of the
+// session's pipes
+type markerResult struct {
+	// output is everything the command wrote before the marker
+	output string
+
+	// trailer is the rest of the marker line, which holds the exit
+	// status and working directory on stdout
+	trailer string
+
+	// found is false if the pipe ended before the marker, which
+	// means that the session ended
+	found bool
+}
+
+// markerScanner finds the end marker in a command's output as the
+// output arrives, echoing the output before the marker. The marker may
+// follow output that does not end with a newline.
+type markerScanner struct {
+	marker string
+	echo   io.Writer
+
+	buf      []byte
+	echoed   int
+	searched int
+	markerAt int
+}
+
+// newMarkerScanner returns a scanner for marker that echoes to echo
+func newMarkerScanner(marker string, echo io.Writer) *markerScanner {
+	return &markerScanner{marker: marker, echo: echo, markerAt: -1}
+}
+
+// feed adds output and reports whether the marker line is complete
+func (m *markerScanner) feed(p []byte) bool {
+	m.buf = append(m.buf, p...)
+
+	if m.markerAt < 0 {
+		if i := bytes.Index(m.buf[m.searched:], []byte(m.marker)); i >= 0 {
+			m.markerAt = m.searched + i
+		} else {
+			m.searched = max(0, len(m.buf)-len(m.marker)+1)
+		}
+	}
+
+	if m.markerAt >= 0 {
+		m.echoTo(m.markerAt)
+		rest := m.buf[m.markerAt+len(m.marker):]
+		return bytes.IndexByte(rest, '\n') >= 0
+	}
+
+	// Hold back anything that may be the start of the marker
+	m.echoTo(len(m.buf) - partialMarker(m.buf[m.echoed:], m.marker))
+	return false
+}
+
+// echoTo echoes the output up to end
+func (m *markerScanner) echoTo(end int) {
+	if end > m.echoed {
+		m.echo.Write(m.buf[m.echoed:end])
+		m.echoed = end
+	}
+}
+
+// pending returns the output that has arrived so far
+func (m *markerScanner) pending() string {
+	if m.markerAt >= 0 {
+		return string(m.buf[:m.markerAt])
+	}
+	return string(m.buf)
+}
+
+// result returns the command's output. If the marker was not found,
+// all the output is returned and anything held back is echoed.
+func (m *markerScanner) result() markerResult {
+	if m.markerAt < 0 {
+		m.echoTo(len(m.buf))
+		return markerResult{output: string(m.buf)}
+	}
+	rest := m.buf[m.markerAt+len(m.marker):]
+	line, _, found := bytes.Cut(rest, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return markerResult{
+		output:  string(m.buf[:m.markerAt]),
+		trailer: strings.TrimPrefix(string(line), " "),
+		found:   found,
+	}
+}
+
+// readUntilMarker reads r until the line with marker and returns the
+// output before it. The output is echoed as it arrives.
+func readUntilMarker(r io.Reader, marker string, echo io.Writer) markerResult {
+	if flusher, ok := echo.(interface{ Flush() }); ok {
+		defer flusher.Flush()
+	}
+
+	scanner := newMarkerScanner(marker, echo)
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if scanner.feed(chunk[:n]) || err != nil {
+			return scanner.result()
+		}
+	}
+}
+
+// partialMarker returns the length of the longest suffix of b that is a
+// prefix of marker
+func partialMarker(b []byte, marker string) int {
+	for n := min(len(b), len(marker)-1); n > 0; n-- {
+		if bytes.HasSuffix(b, []byte(marker[:n])) {
+			return n
+		}
+	}
+	return 0
+}
+
+// parseStatusTrailer parses the exit status and working directory from
+// the trailer of the stdout marker
+func parseStatusTrailer(trailer string) (status int, cwd string, err error) {
+	statusStr, cwd, _ := strings.Cut(trailer, " ")
+	status, err = strconv.Atoi(statusStr)
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed command status %q", trailer)
+	}
+	return status, cwd, nil
+}
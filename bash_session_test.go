@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestANSICQuote(t *testing.T) {
+	tests := []string{
+		"echo hello",
+		"it's a \\ backslash",
+		"line one\nline two\ttabbed",
+		"bell\a and escape\x1b[0m",
+		"unicode: héllo ✓",
+	}
+	for _, input := range tests {
+		out, err := exec.Command("bash", "-c",
+			"printf %s "+ansiCQuote(input)).Output()
+		if err != nil {
+			t.Fatalf("bash failed for %q: %v", input, err)
+		}
+		if string(out) != input {
+			t.Errorf("ansiCQuote(%q) round trip = %q", input, out)
+		}
+	}
+}
+
+func TestReadUntilMarker(t *testing.T) {
+	const marker = markerPrefix + "0123abcd"
+	tests := []struct {
+		name    string
+		input   string
+		want    markerResult
+		wantOut string
+	}{
+		{
+			name:    "complete lines",
+			input:   "one\ntwo\n" + marker + " 0 /tmp\nlater",
+			want:    markerResult{output: "one\ntwo\n", trailer: "0 /tmp", found: true},
+			wantOut: "one\ntwo\n",
+		},
+		{
+			name:    "partial line",
+			input:   "no newline" + marker + " 1 /\n",
+			want:    markerResult{output: "no newline", trailer: "1 /", found: true},
+			wantOut: "no newline\n",
+		},
+		{
+			name:    "marker prefix in output",
+			input:   markerPrefix + "\n" + marker + "\n",
+			want:    markerResult{output: markerPrefix + "\n", found: true},
+			wantOut: markerPrefix + "\n",
+		},
+		{
+			name:    "end of file",
+			input:   "session ended\n",
+			want:    markerResult{output: "session ended\n"},
+			wantOut: "session ended\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Read one byte at a time to split the marker
+			var echo strings.Builder
+			stdout, _ := newEchoWriters(&echo)
+			got := readUntilMarker(
+				iotest.OneByteReader(strings.NewReader(tt.input)), marker,
+				stdout)
+			if got != tt.want {
+				t.Errorf("readUntilMarker() = %+v, want %+v", got, tt.want)
+			}
+			if echo.String() != tt.wantOut {
+				t.Errorf("echoed %q, want %q", echo.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestParseStatusTrailer(t *testing.T) {
+	status, cwd, err := parseStatusTrailer("2 /path/with space")
+	if err != nil || status != 2 || cwd != "/path/with space" {
+		t.Errorf("parseStatusTrailer() = %d, %q, %v", status, cwd, err)
+	}
+	if _, _, err := parseStatusTrailer("garbage"); err == nil {
+		t.Errorf("parseStatusTrailer(garbage) succeeded")
+	}
+}
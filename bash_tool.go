@@ -2,9 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// defaultCommandTimeout is how long a command may run before it is
+// killed
+const defaultCommandTimeout = 2 * time.Minute
+
+// killWaitDelay bounds how long a killed command's output pipes are
+// drained, in case a process outside its process group holds them open
+const killWaitDelay = time.Second
+
 // BashTool is the interface expected by Claude's bash tool use
 type BashTool interface {
 	// ExecuteCommand runs the given command in bash. Its output
@@ -12,14 +29,96 @@ type BashTool interface {
 	// standard error is returned in stderr. If the command
 	// returns an successful exit code, then err is nil. If the
 	// command returned an error exit code, then err will be an
-	// error value.
-	ExecuteCommand(command string) (stdout string, stderr string, err error)
+	// error value. If ctx is cancelled or the command times out,
+	// the command and the processes it started are killed, the
+	// output so far is returned and err wraps the cause, which is
+	// a *TimeoutError for a timeout.
+	ExecuteCommand(ctx context.Context, command string) (stdout string, stderr string, err error)
 
 	// Restart resets the persistent bash session (if any) that is
 	// used across multiple invocations of ExecuteCommand.
 	Restart() (message string, err error)
 }
 
+// CwdReporter is implemented by bash tools whose commands share a
+// working directory
+type CwdReporter interface {
+	// Cwd returns the working directory after the last command, or
+	// the empty string if it is not known
+	Cwd() string
+}
+
+// Bash tool modes that can be selected on the command line
+const (
+	bashModeStateful  = "stateful"
+	bashModeStateless = "stateless"
+	bashModePty       = "pty"
+)
+
+// bashToolOptions configures the bash tool
+type bashToolOptions struct {
+	// Timeout is how long a command may run
+	Timeout time.Duration
+
+	// Echo, if not nil, receives the output of commands as it arrives
+	Echo io.Writer
+
+	// Limits caps the resources of commands
+	Limits ResourceLimits
+
+	// Sandbox, if not nil, confines commands
+	Sandbox *Sandbox
+
+	// Env controls the environment of commands
+	Env *Environment
+
+	// Remote, if not nil, runs commands on a remote host
+	Remote *Remote
+}
+
+// newBashTool creates the bash tool for mode with the given options
+func newBashTool(mode string, opts bashToolOptions) (BashTool, error) {
+	if opts.Remote != nil {
+		if mode != bashModeStateful || opts.Sandbox != nil {
+			return nil, fmt.Errorf("a remote host only supports the %s "+
+				"bash mode without a sandbox", bashModeStateful)
+		}
+		tool := &SSHBashTool{remote: opts.Remote, Timeout: opts.Timeout,
+			Echo: opts.Echo, Limits: opts.Limits, Env: opts.Env}
+		if err := tool.startSession(); err != nil {
+			return nil, err
+		}
+		return tool, nil
+	}
+	if err := opts.Limits.Check(); err != nil {
+		return nil, err
+	}
+	if opts.Sandbox != nil {
+		if err := opts.Sandbox.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch mode {
+	case bashModeStateful:
+		tool := &StatefulBashTool{Timeout: opts.Timeout, Echo: opts.Echo,
+			Limits: opts.Limits, Sandbox: opts.Sandbox, Env: opts.Env}
+		tool.startSession()
+		return tool, nil
+	case bashModeStateless:
+		return &StatelessBashTool{Timeout: opts.Timeout, Echo: opts.Echo,
+			Limits: opts.Limits, Sandbox: opts.Sandbox, Env: opts.Env}, nil
+	case bashModePty:
+		tool := &PtyBashTool{Timeout: opts.Timeout, Echo: opts.Echo,
+			Limits: opts.Limits, Sandbox: opts.Sandbox, Env: opts.Env}
+		tool.startSession()
+		return tool, nil
+	}
+	return nil, fmt.Errorf("unknown bash mode %q (want %s, %s or %s)", mode,
+		bashModeStateful, bashModeStateless, bashModePty)
+}
+
+// checkBashCommand checks command for syntax errors without running it
 func checkBashCommand(command string) (stdout string, stderr string, err error) {
 	var stdoutBuffer, stderrBuffer bytes.Buffer
 
@@ -28,9 +127,208 @@ func checkBashCommand(command string) (stdout string, stderr string, err error)
 	cmd.Stdout = &stdoutBuffer
 	cmd.Stderr = &stderrBuffer
 
-	err = cmd.Run()
+	err = exitError(cmd.Run())
 	stdout = stdoutBuffer.String()
 	stderr = stderrBuffer.String()
 
 	return
 }
+
+// ExitError reports that a command exited with a nonzero status. If it
+// was killed by a signal, Signal is set and Status follows the shell's
+// convention of 128 plus the signal number.
+type ExitError struct {
+	Status int
+	Signal syscall.Signal
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("exit status %d (killed by signal: %v)",
+			e.Status, e.Signal)
+	}
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// shellExitError returns the error for a command whose status the shell
+// reported as $?, or nil if it succeeded
+func shellExitError(status int) error {
+	switch {
+	case status == 0:
+		return nil
+	case status > 128 && status < 128+65:
+		return &ExitError{Status: status, Signal: syscall.Signal(status - 128)}
+	}
+	return &ExitError{Status: status}
+}
+
+// exitError turns the *exec.ExitError of a finished process into an
+// *ExitError. Other errors are returned unchanged.
+func exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return processExitError(exitErr.ProcessState)
+}
+
+// processExitError returns the error for a process that ended with
+// state, or nil if it succeeded. Since bash exits with 128 plus the
+// signal number when a command it ran was killed, such statuses are
+// reported as signals too.
+func processExitError(state *os.ProcessState) error {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &ExitError{Status: 128 + int(status.Signal()), Signal: status.Signal()}
+	}
+	return shellExitError(state.ExitCode())
+}
+
+// commandSummary sums up for the model how a command ended, how long it
+// ran and, if known, the working directory that the next command runs in
+func commandSummary(err error, elapsed time.Duration, cwd string) string {
+	var status string
+	var limitErr *LimitError
+	var exitErr *ExitError
+	var waitErr *InputWaitError
+	switch {
+	case err == nil:
+		status = "exit status 0"
+	case errors.As(err, &limitErr):
+		status = limitErr.Error()
+	case errors.As(err, &exitErr):
+		status = exitErr.Error()
+	case errors.As(err, &waitErr):
+		status = "still running, waiting for input"
+	default:
+		status = err.Error()
+	}
+
+	summary := fmt.Sprintf("[%s; elapsed %v", status,
+		elapsed.Round(time.Millisecond))
+	if cwd != "" {
+		summary += "; cwd: " + cwd
+	}
+	return summary + "]\n"
+}
+
+// commandStreams labels a command's standard out and standard error
+// for the model
+func commandStreams(stdout, stderr string) string {
+	return fmt.Sprintf("<stdout>\n%s</stdout>\n<stderr>\n%s</stderr>",
+		withNewline(stdout), withNewline(stderr))
+}
+
+// withNewline ends non-empty output with a newline, so that the label
+// after it starts on its own line
+func withNewline(output string) string {
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		return output + "\n"
+	}
+	return output
+}
+
+// TimeoutError is the cause of a command being killed because it ran
+// longer than its timeout
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %gs", e.Timeout.Seconds())
+}
+
+// commandTimeoutKey is the context key for per-call command timeouts
+type commandTimeoutKey struct{}
+
+// WithCommandTimeout returns a context that makes commands run with it
+// time out after d instead of after the tool's default timeout. Zero
+// disables the timeout.
+func WithCommandTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, commandTimeoutKey{}, d)
+}
+
+// commandContext returns the context to run a command with. It is
+// cancelled with a *TimeoutError after the timeout set on ctx with
+// WithCommandTimeout, or else after defaultTimeout.
+func commandContext(ctx context.Context, defaultTimeout time.Duration) (
+	context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if d, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &TimeoutError{timeout})
+}
+
+// interruptedError returns the error for a command that was stopped
+// because ctx was cancelled or timed out
+func interruptedError(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if _, ok := cause.(*TimeoutError); ok {
+		return fmt.Errorf("command %w", cause)
+	}
+	return fmt.Errorf("command interrupted: %w", cause)
+}
+
+// stderrPrefix sets lines written to standard error apart from
+// standard output when a command's output is echoed
+const stderrPrefix = "stderr| "
+
+// echoWriter copies a command's output to a terminal line by line as
+// it arrives. The writers for standard out and standard error share a
+// mutex so that their lines are not mixed up.
+type echoWriter struct {
+	w       io.Writer
+	mutex   *sync.Mutex
+	prefix  string
+	partial []byte
+}
+
+// newEchoWriters returns writers that echo standard out and standard
+// error to w. If w is nil, the writers discard their output.
+func newEchoWriters(w io.Writer) (stdout, stderr *echoWriter) {
+	if w == nil {
+		w = io.Discard
+	}
+	mutex := &sync.Mutex{}
+	return &echoWriter{w: w, mutex: mutex},
+		&echoWriter{w: w, mutex: mutex, prefix: stderrPrefix}
+}
+
+// Write echoes the complete lines in p and holds back the rest until
+// its line is complete
+func (e *echoWriter) Write(p []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.partial = append(e.partial, p...)
+	for {
+		i := bytes.IndexByte(e.partial, '\n')
+		if i < 0 {
+			break
+		}
+		e.writeLine(e.partial[:i+1])
+		e.partial = e.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush echoes a final line that has no newline
+func (e *echoWriter) Flush() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.partial) > 0 {
+		e.writeLine(append(e.partial, '\n'))
+		e.partial = nil
+	}
+}
+
+// writeLine echoes a line. Errors are ignored since echoing is only a
+// courtesy to the user and must not fail the command.
+func (e *echoWriter) writeLine(line []byte) {
+	io.WriteString(e.w, e.prefix)
+	e.w.Write(line)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // testBashTool tests any BashTool implementation with common functionality
@@ -90,7 +95,7 @@ func testBashTool(t *testing.T, tool BashTool) {
 				t.Skip("Skipping on Windows")
 			}
 
-			stdout, stderr, err := tool.ExecuteCommand(tt.command)
+			stdout, stderr, err := tool.ExecuteCommand(context.Background(), tt.command)
 
 			if tt.shouldError {
 				if err == nil {
@@ -114,6 +119,63 @@ func testBashTool(t *testing.T, tool BashTool) {
 		})
 	}
 
+	t.Run("Interrupt", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Skipping on Windows")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+
+		// The background sleep must be killed along with the shell
+		start := time.Now()
+		stdout, _, err := tool.ExecuteCommand(ctx,
+			"echo started; sleep 30 & sleep 30; echo finished")
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("interrupted command took %v to return", elapsed)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled error, got %v", err)
+		}
+		if stdout != "started\n" {
+			t.Errorf("expected partial output %q, got %q", "started\n", stdout)
+		}
+
+		// The tool remains usable after an interrupt
+		stdout, _, err = tool.ExecuteCommand(context.Background(),
+			"echo 'after interrupt'")
+		if err != nil {
+			t.Errorf("command after interrupt failed: %v", err)
+		}
+		if stdout != "after interrupt\n" {
+			t.Errorf("expected 'after interrupt\\n', got %q", stdout)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Skipping on Windows")
+		}
+
+		ctx := WithCommandTimeout(context.Background(), 300*time.Millisecond)
+		stdout, _, err := tool.ExecuteCommand(ctx,
+			"echo started; sleep 30 & sleep 30; echo finished")
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("expected *TimeoutError, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "timed out after 0.3s") {
+			t.Errorf("expected error to mention the timeout, got %v", err)
+		}
+		if stdout != "started\n" {
+			t.Errorf("expected partial output %q, got %q", "started\n", stdout)
+		}
+	})
+
 	// Test restart functionality
 	t.Run("RestartFunctionality", func(t *testing.T) {
 		msg, err := tool.Restart()
@@ -125,6 +187,7 @@ func testBashTool(t *testing.T, tool BashTool) {
 		validMessages := []string{
 			"Bash session restarted",
 			"Stateful bash session restarted",
+			"Remote bash session restarted",
 		}
 		validMessage := false
 		for _, validMsg := range validMessages {
@@ -138,7 +201,7 @@ func testBashTool(t *testing.T, tool BashTool) {
 		}
 
 		// Test command execution after restart
-		stdout, stderr, err := tool.ExecuteCommand("echo 'after restart'")
+		stdout, stderr, err := tool.ExecuteCommand(context.Background(), "echo 'after restart'")
 		if err != nil {
 			t.Errorf("command after restart failed: %v", err)
 		}
@@ -151,6 +214,59 @@ func testBashTool(t *testing.T, tool BashTool) {
 	})
 }
 
+func TestNewBashTool(t *testing.T) {
+	tool, err := newBashTool(bashModeStateless, bashToolOptions{Timeout: time.Minute})
+	if stateless, ok := tool.(*StatelessBashTool); err != nil || !ok ||
+		stateless.Timeout != time.Minute {
+		t.Errorf("newBashTool(stateless) = %#v, %v", tool, err)
+	}
+
+	tool, err = newBashTool(bashModeStateful, bashToolOptions{Timeout: time.Minute})
+	if stateful, ok := tool.(*StatefulBashTool); err != nil || !ok ||
+		stateful.Timeout != time.Minute {
+		t.Errorf("newBashTool(stateful) = %#v, %v", tool, err)
+	} else {
+		stateful.stopSession()
+	}
+
+	tool, err = newBashTool(bashModePty, bashToolOptions{Timeout: time.Minute})
+	if ptyTool, ok := tool.(*PtyBashTool); err != nil || !ok ||
+		ptyTool.Timeout != time.Minute {
+		t.Errorf("newBashTool(pty) = %#v, %v", tool, err)
+	} else {
+		ptyTool.stopSession()
+	}
+
+	if _, err := newBashTool("bogus", bashToolOptions{}); err == nil {
+		t.Errorf("newBashTool(bogus) succeeded")
+	}
+}
+
+func TestEchoWriter(t *testing.T) {
+	var out strings.Builder
+	stdout, stderr := newEchoWriters(&out)
+
+	stdout.Write([]byte("first li"))
+	stderr.Write([]byte("warning\n"))
+	stdout.Write([]byte("ne\nsecond"))
+	if want := stderrPrefix + "warning\nfirst line\n"; out.String() != want {
+		t.Errorf("echo before flush = %q, want %q", out.String(), want)
+	}
+
+	stdout.Flush()
+	stderr.Flush()
+	want := stderrPrefix + "warning\nfirst line\nsecond\n"
+	if out.String() != want {
+		t.Errorf("echo after flush = %q, want %q", out.String(), want)
+	}
+
+	// Without a terminal the output is discarded
+	stdout, _ = newEchoWriters(nil)
+	if n, err := stdout.Write([]byte("x\n")); n != 2 || err != nil {
+		t.Errorf("Write() to nil echo = %d, %v, want 2, nil", n, err)
+	}
+}
+
 func TestStatelessBashTool(t *testing.T) {
 	tool := NewStatelessBashTool()
 	if tool == nil {
@@ -162,6 +278,46 @@ func TestStatelessBashTool(t *testing.T) {
 
 	// Run common tests
 	testBashTool(t, tool)
+
+	t.Run("Echo", func(t *testing.T) {
+		var echo strings.Builder
+		tool := NewStatelessBashTool()
+		tool.Echo = &echo
+
+		stdout, _, err := tool.ExecuteCommand(context.Background(),
+			"echo out; sleep 0.1; echo err >&2; sleep 0.1; printf partial")
+		if err != nil {
+			t.Fatalf("command failed: %v", err)
+		}
+		if stdout != "out\npartial" {
+			t.Errorf("expected captured stdout %q, got %q", "out\npartial", stdout)
+		}
+		want := "out\n" + stderrPrefix + "err\npartial\n"
+		if echo.String() != want {
+			t.Errorf("expected echo %q, got %q", want, echo.String())
+		}
+	})
+
+	t.Run("DefaultTimeout", func(t *testing.T) {
+		tool := NewStatelessBashTool()
+		tool.Timeout = 200 * time.Millisecond
+
+		start := time.Now()
+		_, _, err := tool.ExecuteCommand(context.Background(), "sleep 30")
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != tool.Timeout {
+			t.Errorf("expected *TimeoutError after %v, got %v", tool.Timeout, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("timed out command took %v to return", elapsed)
+		}
+
+		// A per-call timeout overrides the default
+		ctx := WithCommandTimeout(context.Background(), 0)
+		if _, _, err := tool.ExecuteCommand(ctx, "sleep 0.5"); err != nil {
+			t.Errorf("command without timeout failed: %v", err)
+		}
+	})
 }
 
 func TestStatefulBashTool(t *testing.T) {
@@ -203,14 +359,14 @@ func TestStatefulBashTool(t *testing.T) {
 		for _, tt := range persistenceTests {
 			t.Run(tt.name, func(t *testing.T) {
 				// Setup
-				_, _, err := tool.ExecuteCommand(tt.setupCommand)
+				_, _, err := tool.ExecuteCommand(context.Background(), tt.setupCommand)
 				if err != nil {
 					t.Errorf("setup command %q failed: %v", tt.setupCommand, err)
 					return
 				}
 
 				// Test
-				stdout, _, err := tool.ExecuteCommand(tt.testCommand)
+				stdout, _, err := tool.ExecuteCommand(context.Background(), tt.testCommand)
 				if err != nil {
 					t.Errorf("test command %q failed: %v", tt.testCommand, err)
 					return
@@ -229,7 +385,7 @@ func TestStatefulBashTool(t *testing.T) {
 
 	t.Run("RestartClearsState", func(t *testing.T) {
 		// Set a variable
-		_, _, err := tool.ExecuteCommand("export RESTART_TEST=value")
+		_, _, err := tool.ExecuteCommand(context.Background(), "export RESTART_TEST=value")
 		if err != nil {
 			t.Errorf("export command failed: %v", err)
 		}
@@ -241,7 +397,7 @@ func TestStatefulBashTool(t *testing.T) {
 		}
 
 		// Check that variable is cleared
-		stdout, _, err := tool.ExecuteCommand("echo $RESTART_TEST")
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo $RESTART_TEST")
 		if err != nil {
 			t.Errorf("echo variable after restart failed: %v", err)
 		}
@@ -278,7 +434,7 @@ func TestStatefulBashTool(t *testing.T) {
 
 		for _, tt := range exitTests {
 			t.Run(tt.name, func(t *testing.T) {
-				_, _, err := tool.ExecuteCommand(tt.command)
+				_, _, err := tool.ExecuteCommand(context.Background(), tt.command)
 
 				if tt.shouldError {
 					if err == nil {
@@ -294,6 +450,100 @@ func TestStatefulBashTool(t *testing.T) {
 				}
 			})
 		}
+
+		// The ended session must not be stopped again, since its
+		// process group may belong to someone else by now
+		if tool.cmd != nil {
+			t.Error("the ended session is still set")
+		}
+		if _, err := tool.Restart(); err != nil {
+			t.Errorf("Restart() after exit error = %v", err)
+		}
+		if stdout, _, err := tool.ExecuteCommand(context.Background(), "echo back"); err != nil || stdout != "back\n" {
+			t.Errorf("command after exit = %q, %v", stdout, err)
+		}
+	})
+
+	t.Run("ProtocolEdgeCases", func(t *testing.T) {
+		edgeTests := []struct {
+			name           string
+			command        string
+			expectedStdout string
+			expectedStderr string
+		}{
+			{
+				name:           "NoTrailingNewline",
+				command:        "printf partial; printf oops >&2",
+				expectedStdout: "partial",
+				expectedStderr: "oops",
+			},
+			{
+				name:           "ReadsStdin",
+				command:        "cat; read line; echo \"got:$line\"",
+				expectedStdout: "got:\n",
+			},
+			{
+				name:           "SpoofedMarker",
+				command:        "echo " + markerPrefix + "0 0 /; echo after",
+				expectedStdout: markerPrefix + "0 0 /\nafter\n",
+			},
+			{
+				name:           "Tracing",
+				command:        "set -x; echo traced; set +x",
+				expectedStdout: "traced\n",
+				expectedStderr: "++ echo traced\n++ set +x\n",
+			},
+			{
+				name:           "MultiLine",
+				command:        "for i in 1 2; do\n  echo \"line $i\"\ndone",
+				expectedStdout: "line 1\nline 2\n",
+			},
+			{
+				name:           "HereDocument",
+				command:        "cat <<'EOF'\nit's $HOME\nEOF",
+				expectedStdout: "it's $HOME\n",
+			},
+		}
+
+		for _, tt := range edgeTests {
+			t.Run(tt.name, func(t *testing.T) {
+				stdout, stderr, err := tool.ExecuteCommand(context.Background(), tt.command)
+				if err != nil {
+					t.Errorf("command %q failed: %v", tt.command, err)
+				}
+				if stdout != tt.expectedStdout {
+					t.Errorf("stdout mismatch for %q: expected %q, got %q", tt.command, tt.expectedStdout, stdout)
+				}
+				if stderr != tt.expectedStderr {
+					t.Errorf("stderr mismatch for %q: expected %q, got %q", tt.command, tt.expectedStderr, stderr)
+				}
+			})
+		}
+	})
+
+	t.Run("Cwd", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, _, err := tool.ExecuteCommand(context.Background(), "cd "+dir); err != nil {
+			t.Fatalf("cd failed: %v", err)
+		}
+		if got := tool.Cwd(); got != dir {
+			t.Errorf("expected cwd %q, got %q", dir, got)
+		}
+	})
+
+	t.Run("Exec", func(t *testing.T) {
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "exec echo replaced")
+		if err == nil || !strings.Contains(err.Error(), "bash session ended") {
+			t.Errorf("expected session ended error, got %v", err)
+		}
+		if stdout != "replaced\n" {
+			t.Errorf("expected 'replaced\\n', got %q", stdout)
+		}
+
+		stdout, _, err = tool.ExecuteCommand(context.Background(), "echo 'new session'")
+		if err != nil || stdout != "new session\n" {
+			t.Errorf("command after exec = %q, %v", stdout, err)
+		}
 	})
 
 	t.Run("SessionRecovery", func(t *testing.T) {
@@ -304,7 +554,7 @@ func TestStatefulBashTool(t *testing.T) {
 		}
 
 		// Next command should recover automatically
-		stdout, _, err := tool.ExecuteCommand("echo 'recovered'")
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo 'recovered'")
 		if err != nil {
 			t.Errorf("command after session death failed: %v", err)
 		}
@@ -313,3 +563,107 @@ func TestStatefulBashTool(t *testing.T) {
 		}
 	})
 }
+
+func TestExitError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{0, ""},
+		{1, "exit status 1"},
+		{128, "exit status 128"},
+		{137, "exit status 137 (killed by signal: killed)"},
+		{255, "exit status 255"},
+	}
+	for _, tt := range tests {
+		err := shellExitError(tt.status)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("shellExitError(%d) = %v, want nil", tt.status, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("shellExitError(%d) = %v, want %q", tt.status, err, tt.want)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// Every tool reports the signal that killed a command
+	tools := map[string]BashTool{
+		"stateless": NewStatelessBashTool(),
+		"stateful":  NewStatefulBashTool(),
+	}
+	for name, tool := range tools {
+		_, _, err := tool.ExecuteCommand(context.Background(), "bash -c 'kill -TERM $$'")
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) || exitErr.Status != 143 ||
+			exitErr.Signal != syscall.SIGTERM {
+			t.Errorf("%s: killed command error = %#v, want status 143 "+
+				"and SIGTERM", name, err)
+		}
+		if stateful, ok := tool.(*StatefulBashTool); ok {
+			stateful.stopSession()
+		}
+	}
+}
+
+func TestCommandSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		cwd  string
+		want string
+	}{
+		{"success", nil, "/tmp", "[exit status 0; elapsed 1.5s; cwd: /tmp]\n"},
+		{"failure", &ExitError{Status: 2}, "", "[exit status 2; elapsed 1.5s]\n"},
+		{
+			"signal",
+			&ExitError{Status: 137, Signal: syscall.SIGKILL},
+			"",
+			"[exit status 137 (killed by signal: killed); elapsed 1.5s]\n",
+		},
+		{
+			"timeout",
+			fmt.Errorf("command %w", &TimeoutError{time.Second}),
+			"",
+			"[command timed out after 1s; elapsed 1.5s]\n",
+		},
+		{
+			"limit",
+			&LimitError{Limit: "fsize=1M", Err: &ExitError{Status: 153}},
+			"",
+			"[resource limit fsize=1M exceeded (exit status 153); elapsed 1.5s]\n",
+		},
+		{
+			"waiting",
+			&InputWaitError{Prompt: "Name?"},
+			"",
+			"[still running, waiting for input; elapsed 1.5s]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := commandSummary(tt.err, 1500*time.Millisecond, tt.cwd)
+			if got != tt.want {
+				t.Errorf("commandSummary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandStreams(t *testing.T) {
+	got := commandStreams("FAIL: TestFoo\n", "warning: deprecated")
+	want := "<stdout>\nFAIL: TestFoo\n</stdout>\n" +
+		"<stderr>\nwarning: deprecated\n</stderr>"
+	if got != want {
+		t.Errorf("commandStreams() = %q, want %q", got, want)
+	}
+
+	if got, want := commandStreams("", ""), "<stdout>\n</stdout>\n<stderr>\n</stderr>"; got != want {
+		t.Errorf("commandStreams() of no output = %q, want %q", got, want)
+	}
+}
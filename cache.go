@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Prompt caching lets the API reuse the processed prefix of a request.
+// A request may have up to four cache breakpoints. Gollum places them
+// on the system prompt, on the tool definitions, on the latest message
+// (which becomes the stable prefix of the next tool loop iteration),
+// and on the user message before it so that the previous request's
+// cache entry is found even after a long assistant turn.
+
+// cacheControl returns the cache breakpoint used for all requests
+func cacheControl() anthropic.BetaCacheControlEphemeralParam {
+	return anthropic.NewBetaCacheControlEphemeralParam()
+}
+
+// cachedSystem returns the system prompt blocks with a cache
+// breakpoint after the last block
+func cachedSystem(system []anthropic.BetaTextBlockParam) []anthropic.BetaTextBlockParam {
+	if len(system) == 0 {
+		return system
+	}
+	system = slices.Clone(system)
+	system[len(system)-1].CacheControl = cacheControl()
+	return system
+}
+
+// cachedTools returns the tool definitions with a cache breakpoint
+// after the last tool. The tool definitions must be freshly built,
+// since the last one is modified in place.
+func cachedTools(tools []anthropic.BetaToolUnionParam) []anthropic.BetaToolUnionParam {
+	if len(tools) == 0 {
+		return tools
+	}
+	if cc := tools[len(tools)-1].GetCacheControl(); cc != nil {
+		*cc = cacheControl()
+	}
+	return tools
+}
+
+// withCacheControl returns a copy of block with a cache breakpoint. The
+// block variants are pointers that are shared with the conversation
+// history, so the variant is copied rather than modified. ok is false
+// for blocks that cannot carry a breakpoint.
+func withCacheControl(block anthropic.BetaContentBlockParamUnion) (
+	cached anthropic.BetaContentBlockParamUnion, ok bool) {
+	switch {
+	case block.OfText != nil:
+		text := *block.OfText
+		text.CacheControl = cacheControl()
+		return anthropic.BetaContentBlockParamUnion{OfText: &text}, true
+	case block.OfToolUse != nil:
+		toolUse := *block.OfToolUse
+		toolUse.CacheControl = cacheControl()
+		return anthropic.BetaContentBlockParamUnion{OfToolUse: &toolUse}, true
+	case block.OfToolResult != nil:
+		result := *block.OfToolResult
+		result.CacheControl = cacheControl()
+		return anthropic.BetaContentBlockParamUnion{OfToolResult: &result}, true
+	case block.OfImage != nil:
+		image := *block.OfImage
+		image.CacheControl = cacheControl()
+		return anthropic.BetaContentBlockParamUnion{OfImage: &image}, true
+	}
+	return block, false
+}
+
+// cachedMessage returns a copy of message with a cache breakpoint on
+// its last block that can carry one
+func cachedMessage(message anthropic.BetaMessageParam) (
+	anthropic.BetaMessageParam, bool) {
+	for i := len(message.Content) - 1; i >= 0; i-- {
+		cached, ok := withCacheControl(message.Content[i])
+		if !ok {
+			continue
+		}
+		message.Content = slices.Clone(message.Content)
+		message.Content[i] = cached
+		return message, true
+	}
+	return message, false
+}
+
+// cachedMessages returns the messages with cache breakpoints on the
+// latest message and on the user message before it. The conversation
+// history itself is not modified.
+func cachedMessages(messages []anthropic.BetaMessageParam) []anthropic.BetaMessageParam {
+	if len(messages) == 0 {
+		return messages
+	}
+	messages = slices.Clone(messages)
+
+	last := len(messages) - 1
+	messages[last], _ = cachedMessage(messages[last])
+
+	for i := last - 1; i >= 0; i-- {
+		if messages[i].Role != anthropic.BetaMessageParamRoleUser {
+			continue
+		}
+		if cached, ok := cachedMessage(messages[i]); ok {
+			messages[i] = cached
+			break
+		}
+	}
+	return messages
+}
+
+// printCacheUsage writes the token usage of a response, including the
+// prompt cache reads and writes, for debugging
+func printCacheUsage(w io.Writer, usage anthropic.BetaUsage) {
+	fmt.Fprintf(w, "[DEBUG] Usage: input=%d cache_write=%d cache_read=%d "+
+		"output=%d\n", usage.InputTokens, usage.CacheCreationInputTokens,
+		usage.CacheReadInputTokens, usage.OutputTokens)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// hasCacheControl reports whether block carries a cache breakpoint
+func hasCacheControl(block anthropic.BetaContentBlockParamUnion) bool {
+	cc := block.GetCacheControl()
+	return cc != nil && cc.Type == "ephemeral"
+}
+
+func TestCachedMessages(t *testing.T) {
+	c := newTestConversation()
+
+	cached := cachedMessages(c.messages)
+
+	if len(cached) != len(c.messages) {
+		t.Fatalf("cachedMessages() returned %d messages, want %d",
+			len(cached), len(c.messages))
+	}
+
+	var breakpoints []int
+	for i, message := range cached {
+		for _, block := range message.Content {
+			if hasCacheControl(block) {
+				breakpoints = append(breakpoints, i)
+			}
+		}
+	}
+	// The latest message and the tool result message before it
+	if len(breakpoints) != 2 || breakpoints[0] != 2 || breakpoints[1] != 4 {
+		t.Errorf("breakpoints on messages %v, want [2 4]", breakpoints)
+	}
+
+	// The conversation history is not modified
+	for i, message := range c.messages {
+		for _, block := range message.Content {
+			if hasCacheControl(block) {
+				t.Errorf("conversation message %d was modified", i)
+			}
+		}
+	}
+}
+
+func TestCachedMessagesEmpty(t *testing.T) {
+	if got := cachedMessages(nil); len(got) != 0 {
+		t.Errorf("cachedMessages(nil) = %v, want empty", got)
+	}
+}
+
+func TestWithCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		block  anthropic.BetaContentBlockParamUnion
+		wantOK bool
+	}{
+		{
+			name:   "Text",
+			block:  anthropic.NewBetaTextBlock("hello"),
+			wantOK: true,
+		},
+		{
+			name: "ToolUse",
+			block: anthropic.NewBetaToolUseBlock("toolu_1",
+				map[string]any{"command": "ls"}, "bash"),
+			wantOK: true,
+		},
+		{
+			name:   "ToolResult",
+			block:  anthropic.NewBetaToolResultBlock("toolu_1", "out", false),
+			wantOK: true,
+		},
+		{
+			name: "Thinking",
+			block: anthropic.BetaContentBlockParamUnion{
+				OfThinking: &anthropic.BetaThinkingBlockParam{},
+			},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cached, ok := withCacheControl(tt.block)
+			if ok != tt.wantOK {
+				t.Fatalf("withCacheControl() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !hasCacheControl(cached) {
+				t.Error("cached block has no breakpoint")
+			}
+			if hasCacheControl(tt.block) {
+				t.Error("original block was modified")
+			}
+		})
+	}
+}
+
+func TestCachedSystemAndTools(t *testing.T) {
+	client := &AnthropicClient{
+		model:        anthropic.ModelClaudeSonnet4_0,
+		systemPrompt: "You are Gollum",
+	}
+
+	system := client.systemParams()
+	cachedSys := cachedSystem(system)
+	if cachedSys[0].CacheControl.Type != "ephemeral" {
+		t.Error("system prompt has no breakpoint")
+	}
+	if system[0].CacheControl.Type != "" {
+		t.Error("original system prompt was modified")
+	}
+
+	tools := cachedTools(client.toolParams())
+	if cc := tools[len(tools)-1].GetCacheControl(); cc == nil ||
+		cc.Type != "ephemeral" {
+		t.Error("last tool has no breakpoint")
+	}
+	if cc := tools[0].GetCacheControl(); cc != nil && cc.Type != "" {
+		t.Error("only the last tool should have a breakpoint")
+	}
+}
+
+func TestPrintCacheUsage(t *testing.T) {
+	var buf bytes.Buffer
+	printCacheUsage(&buf, anthropic.BetaUsage{
+		InputTokens:              10,
+		CacheCreationInputTokens: 2000,
+		CacheReadInputTokens:     30000,
+		OutputTokens:             50,
+	})
+	want := "input=10 cache_write=2000 cache_read=30000 output=50"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("printCacheUsage() = %q, want it to contain %q",
+			buf.String(), want)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// defaultCompactThreshold is the estimated conversation size, in
+// tokens, above which older turns are automatically summarized. It
+// leaves headroom below the 200k token context window of the
+// supported models.
+const defaultCompactThreshold = 150000
+
+// compactKeepDivisor divides the compaction threshold to give how many
+// tokens at the end of the conversation are kept verbatim when
+// compacting, a quarter of it
+const compactKeepDivisor = 4
+
+// charsPerToken is the rough number of characters per token used to
+// estimate the size of messages
+const charsPerToken = 4
+
+// summaryMaxTokens is the output budget for conversation summaries
+const summaryMaxTokens = 8192
+
+// compactSystemPrompt instructs the model how to summarize
+const compactSystemPrompt = `You summarize conversations between a user
+and an AI coding assistant that runs bash commands and edits files on
+the user's machine. The summary replaces the transcript in the
+assistant's context, so the assistant must be able to continue the work
+from the summary alone.
+
+Preserve the user's goals and instructions, decisions that were made,
+files that were created or modified, important commands and their
+results, errors and how they were resolved, and any work that is still
+outstanding. Be concise but complete. Do not address the user.`
+
+// compactedPrefix introduces the summary in the compacted conversation
+const compactedPrefix = "This conversation was compacted to save " +
+	"space. Summary of the earlier part of the conversation:\n\n"
+
+// estimateTokens roughly estimates the number of tokens in messages
+// from the size of their JSON encoding
+func estimateTokens(messages []anthropic.BetaMessageParam) int {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return 0
+	}
+	return len(data) / charsPerToken
+}
+
+// compactionSplit returns the index of the first message to keep
+// verbatim when compacting so that roughly keepTokens remain. The kept
+// messages always start with an assistant message, so every tool
+// result that is kept still follows the tool use it answers. It
+// returns 0 if there is nothing that can be summarized.
+func compactionSplit(messages []anthropic.BetaMessageParam,
+	keepTokens int) int {
+	split := 0
+	kept := 0
+	for i := len(messages) - 1; i > 0; i-- {
+		kept += estimateTokens(messages[i : i+1])
+		if messages[i].Role != anthropic.BetaMessageParamRoleAssistant {
+			continue
+		}
+		if kept > keepTokens && split != 0 {
+			break
+		}
+		split = i
+	}
+	return split
+}
+
+// Compact replaces the messages before index split with a summary
+func (c *Conversation) Compact(split int, summary string) {
+	compacted := []anthropic.BetaMessageParam{
+		anthropic.NewBetaUserMessage(
+			anthropic.NewBetaTextBlock(compactedPrefix + summary)),
+	}
+	c.messages = append(compacted, c.messages[split:]...)
+	c.resetUsage()
+	c.changed()
+}
+
+// Summarize asks the model to summarize messages, following any extra
+// instructions from the user
+func (ac *AnthropicClient) Summarize(ctx context.Context,
+	messages []anthropic.BetaMessageParam, instructions string) (
+	string, error) {
+	var transcript strings.Builder
+	if err := writeMarkdownTranscript(&transcript,
+		&Conversation{messages: messages}); err != nil {
+		return "", err
+	}
+
+	prompt := "Summarize this transcript:\n\n" + transcript.String()
+	if instructions != "" {
+		prompt += "\n\nAdditional instructions for the summary: " +
+			instructions
+	}
+
+	message, err := ac.client.Beta.Messages.New(ctx,
+		anthropic.BetaMessageNewParams{
+			Model:     ac.model,
+			MaxTokens: summaryMaxTokens,
+			System: []anthropic.BetaTextBlockParam{
+				{Text: compactSystemPrompt},
+			},
+			Messages: []anthropic.BetaMessageParam{
+				anthropic.NewBetaUserMessage(
+					anthropic.NewBetaTextBlock(prompt)),
+			},
+		}, option.WithMaxRetries(ac.MaxRetries))
+	if err != nil {
+		return "", fmt.Errorf("summary request failed: %w", err)
+	}
+
+	var summary []string
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			summary = append(summary, block.Text)
+		}
+	}
+	if len(summary) == 0 {
+		return "", fmt.Errorf("summary response contained no text")
+	}
+	return strings.Join(summary, "\n"), nil
+}
+
+// CompactConversation summarizes the older part of the conversation,
+// keeping roughly keepTokens of the most recent messages verbatim. It
+// returns the estimated size before and after compaction.
+func (ac *AnthropicClient) CompactConversation(ctx context.Context,
+	conversation *Conversation, keepTokens int, instructions string) (
+	before, after int, err error) {
+	before = conversation.EstimatedTokens()
+	split := compactionSplit(conversation.messages, keepTokens)
+	if split == 0 {
+		return before, before, fmt.Errorf(
+			"conversation is too short to compact")
+	}
+
+	fmt.Printf("\n[Compacting conversation: summarizing %d of %d messages...]\n",
+		split, len(conversation.messages))
+	summary, err := ac.Summarize(ctx, conversation.messages[:split],
+		instructions)
+	if err != nil {
+		return before, before, err
+	}
+
+	conversation.Compact(split, summary)
+	return before, conversation.EstimatedTokens(), nil
+}
+
+// AutoCompact compacts the conversation if its estimated size exceeds
+// the client's compaction threshold. Failures are reported but do not
+// stop the conversation, since the request may still fit.
+func (ac *AnthropicClient) AutoCompact(ctx context.Context,
+	conversation *Conversation) {
+	if ac.CompactThreshold <= 0 ||
+		conversation.EstimatedTokens() <= ac.CompactThreshold {
+		return
+	}
+
+	before, after, err := ac.CompactConversation(ctx, conversation,
+		ac.CompactThreshold/compactKeepDivisor, "")
+	if err != nil {
+		fmt.Printf("[Automatic compaction failed: %v]\n", err)
+		return
+	}
+	fmt.Printf("[Conversation compacted from ~%d to ~%d tokens]\n",
+		before, after)
+}
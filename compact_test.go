@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// newLongTestConversation returns a conversation of n tool loop
+// iterations, each with a tool result of roughly size characters
+func newLongTestConversation(n, size int) *Conversation {
+	c := NewConversation()
+	c.AddUserMessage("refactor everything")
+	for i := 0; i < n; i++ {
+		id := "toolu_" + strings.Repeat("x", i+1)
+		c.messages = append(c.messages, anthropic.BetaMessageParam{
+			Role: anthropic.BetaMessageParamRoleAssistant,
+			Content: []anthropic.BetaContentBlockParamUnion{
+				anthropic.NewBetaToolUseBlock(id,
+					map[string]any{"command": "make"}, "bash"),
+			},
+		})
+		c.AddToolResults([]anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaToolResultBlock(id, strings.Repeat("o", size),
+				false),
+		})
+	}
+	return c
+}
+
+func TestEstimateTokens(t *testing.T) {
+	small := newLongTestConversation(1, 100).EstimatedTokens()
+	large := newLongTestConversation(1, 4000).EstimatedTokens()
+
+	if small <= 0 {
+		t.Errorf("EstimatedTokens() = %d, want > 0", small)
+	}
+	if diff := large - small; diff < 900 || diff > 1100 {
+		t.Errorf("3900 more characters estimated as %d more tokens, "+
+			"want about %d", diff, 3900/charsPerToken)
+	}
+}
+
+func TestCompactionSplit(t *testing.T) {
+	// Each iteration is roughly 1000 tokens
+	c := newLongTestConversation(10, 4000)
+
+	tests := []struct {
+		name       string
+		keepTokens int
+		wantSplit  int
+	}{
+		{name: "KeepNothing", keepTokens: 0, wantSplit: 19},
+		{name: "KeepThreeIterations", keepTokens: 3500, wantSplit: 15},
+		{name: "KeepEverything", keepTokens: 1000000, wantSplit: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split := compactionSplit(c.messages, tt.keepTokens)
+			if split != tt.wantSplit {
+				t.Errorf("compactionSplit(%d) = %d, want %d",
+					tt.keepTokens, split, tt.wantSplit)
+			}
+			if c.messages[split].Role !=
+				anthropic.BetaMessageParamRoleAssistant {
+				t.Errorf("kept messages start with a %s message",
+					c.messages[split].Role)
+			}
+		})
+	}
+}
+
+func TestCompactionSplitNothingToSummarize(t *testing.T) {
+	c := NewConversation()
+	c.AddUserMessage("hello")
+	if split := compactionSplit(c.messages, 0); split != 0 {
+		t.Errorf("compactionSplit() = %d, want 0", split)
+	}
+}
+
+func TestConversationCompact(t *testing.T) {
+	c := newLongTestConversation(10, 4000)
+	split := compactionSplit(c.messages, 3500)
+	before := c.EstimatedTokens()
+
+	c.Compact(split, "the user wants a refactor")
+
+	if len(c.messages) != 21-split+1 {
+		t.Fatalf("Compact() left %d messages, want %d",
+			len(c.messages), 21-split+1)
+	}
+	first := c.messages[0]
+	if first.Role != anthropic.BetaMessageParamRoleUser ||
+		!strings.HasSuffix(first.Content[0].OfText.Text,
+			"the user wants a refactor") {
+		t.Errorf("first message = %+v, want summary", first)
+	}
+
+	// Every kept tool result still follows its tool use
+	for i, message := range c.messages {
+		for _, block := range message.Content {
+			if block.OfToolResult == nil {
+				continue
+			}
+			previous := c.messages[i-1].Content[0].OfToolUse
+			if previous == nil || previous.ID != block.OfToolResult.ToolUseID {
+				t.Errorf("tool result %s at %d lost its tool use",
+					block.OfToolResult.ToolUseID, i)
+			}
+		}
+	}
+
+	if after := c.EstimatedTokens(); after >= before/2 {
+		t.Errorf("EstimatedTokens() after Compact() = %d, want much less "+
+			"than %d", after, before)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Conversation represents the conversation history
+type Conversation struct {
+	// ID identifies the conversation's session on disk
+	ID string
+
+	// Created is the time at which the conversation was started
+	Created time.Time
+
+	messages []anthropic.BetaMessageParam
+
+	// store is where the conversation is saved after every change,
+	// or nil if the conversation only lives in memory
+	store *SessionStore
+
+	// saved reports whether the conversation has been written to its
+	// store, so that rewinding to an empty history is saved too
+	saved bool
+
+	// usageTokens is the size of the conversation in tokens as reported
+	// by the API when it had usageMessages messages
+	usageTokens   int
+	usageMessages int
+}
+
+// NewConversation creates a new conversation
+func NewConversation() *Conversation {
+	now := time.Now()
+	return &Conversation{
+		ID:       newSessionID(now),
+		Created:  now,
+		messages: []anthropic.BetaMessageParam{},
+	}
+}
+
+// newSessionID returns a new session ID that sorts by creation time
+func newSessionID(now time.Time) string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// Persist attaches the conversation to a session store. From then on
+// the conversation is saved to the store whenever it changes.
+func (c *Conversation) Persist(store *SessionStore) error {
+	c.store = store
+	return c.save()
+}
+
+// save writes the conversation to its session store, if it has one.
+// Empty conversations are not saved so that sessions which never got
+// a prompt do not clutter the session directory.
+func (c *Conversation) save() error {
+	if c.store == nil || (len(c.messages) == 0 && !c.saved) {
+		return nil
+	}
+	if err := c.store.Save(c); err != nil {
+		return err
+	}
+	c.saved = true
+	return nil
+}
+
+// changed is called after every modification of the message history
+func (c *Conversation) changed() {
+	if err := c.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving session %s: %v\n", c.ID, err)
+	}
+}
+
+// AddUserMessage adds a user message to the conversation history
+func (c *Conversation) AddUserMessage(content string) {
+	c.messages = append(c.messages,
+		anthropic.NewBetaUserMessage(
+			anthropic.NewBetaTextBlock(content)))
+	c.changed()
+}
+
+// AddAssistantMessage adds an assistant message to the conversation history
+func (c *Conversation) AddAssistantMessage(message anthropic.BetaMessage) {
+	c.messages = append(c.messages, assistantParam(message))
+	c.changed()
+}
+
+// assistantParam converts a response to a message parameter. Unlike
+// ToParam, which decodes each block from the raw JSON of the response,
+// it takes text from the Text field so that text joined from several
+// responses is kept.
+func assistantParam(message anthropic.BetaMessage) anthropic.BetaMessageParam {
+	param := anthropic.BetaMessageParam{
+		Role:    anthropic.BetaMessageParamRoleAssistant,
+		Content: make([]anthropic.BetaContentBlockParamUnion, len(message.Content)),
+	}
+	for i, block := range message.Content {
+		if block.Type == "text" {
+			param.Content[i] = anthropic.NewBetaTextBlock(block.Text)
+		} else {
+			param.Content[i] = block.ToParam()
+		}
+	}
+	return param
+}
+
+// AddToolResults adds tool results to the conversation history
+func (c *Conversation) AddToolResults(results []anthropic.BetaContentBlockParamUnion) {
+	c.messages = append(c.messages,
+		anthropic.NewBetaUserMessage(results...))
+	c.changed()
+}
+
+// FirstPrompt returns the text of the first user message, or the empty
+// string if the user has not said anything yet.
+func (c *Conversation) FirstPrompt() string {
+	for _, message := range c.messages {
+		if message.Role != anthropic.BetaMessageParamRoleUser {
+			continue
+		}
+		for _, block := range message.Content {
+			if block.OfText != nil {
+				return block.OfText.Text
+			}
+		}
+	}
+	return ""
+}
+
+// closeDanglingToolUses adds error results for any tool uses in the
+// final assistant message. This happens when Gollum died while tools
+// were running, and the API rejects tool uses without results.
+func (c *Conversation) closeDanglingToolUses() {
+	if len(c.messages) == 0 {
+		return
+	}
+	last := c.messages[len(c.messages)-1]
+	if last.Role != anthropic.BetaMessageParamRoleAssistant {
+		return
+	}
+
+	var results []anthropic.BetaContentBlockParamUnion
+	for _, block := range last.Content {
+		if block.OfToolUse != nil {
+			results = append(results, anthropic.NewBetaToolResultBlock(
+				block.OfToolUse.ID,
+				"Tool execution was interrupted",
+				true, // isError
+			))
+		}
+	}
+	if len(results) > 0 {
+		c.AddToolResults(results)
+	}
+}
+
+// userPrompt is a message typed by the user, as opposed to a user
+// message that only carries tool results
+type userPrompt struct {
+	// Index is the position of the message in the history
+	Index int
+
+	// Text is what the user typed
+	Text string
+}
+
+// UserPrompts returns the messages typed by the user, oldest first
+func (c *Conversation) UserPrompts() []userPrompt {
+	var prompts []userPrompt
+	for i, message := range c.messages {
+		if message.Role != anthropic.BetaMessageParamRoleUser {
+			continue
+		}
+		var texts []string
+		for _, block := range message.Content {
+			if block.OfText != nil {
+				texts = append(texts, block.OfText.Text)
+			}
+		}
+		if len(texts) > 0 {
+			prompts = append(prompts, userPrompt{
+				Index: i,
+				Text:  strings.Join(texts, "\n"),
+			})
+		}
+	}
+	return prompts
+}
+
+// printUserPrompts writes a numbered list of user prompts to w, in the
+// numbering that Rewind expects
+func printUserPrompts(w io.Writer, prompts []userPrompt) {
+	if len(prompts) == 0 {
+		fmt.Fprintln(w, "No prompts in this conversation yet")
+		return
+	}
+	for i, prompt := range prompts {
+		fmt.Fprintf(w, "  %2d. %s\n", i+1, summarizePrompt(prompt.Text, 70))
+	}
+}
+
+// Rewind drops the n-th user prompt (counting from 1) and everything
+// after it from the history. It returns the text of the dropped prompt
+// so that the user can edit and resend it.
+func (c *Conversation) Rewind(n int) (string, error) {
+	prompts := c.UserPrompts()
+	if n < 1 || n > len(prompts) {
+		return "", fmt.Errorf("no prompt %d (conversation has %d prompts)",
+			n, len(prompts))
+	}
+	prompt := prompts[n-1]
+	c.messages = c.messages[:prompt.Index]
+	c.resetUsage()
+	c.changed()
+	return prompt.Text, nil
+}
+
+// Fork returns a copy of the conversation under a new session ID. The
+// copy is saved to the same store as the original, and changes to one
+// do not affect the other.
+func (c *Conversation) Fork() (*Conversation, error) {
+	fork := NewConversation()
+	fork.messages = slices.Clone(c.messages)
+	if c.store == nil {
+		return fork, nil
+	}
+	if err := fork.Persist(c.store); err != nil {
+		return nil, err
+	}
+	return fork, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// newTestConversation returns a conversation with two prompts, the
+// first of which led to a tool use
+func newTestConversation() *Conversation {
+	c := NewConversation()
+	c.AddUserMessage("first prompt")
+	c.messages = append(c.messages, anthropic.BetaMessageParam{
+		Role: anthropic.BetaMessageParamRoleAssistant,
+		Content: []anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaToolUseBlock("toolu_1",
+				map[string]any{"command": "ls"}, "bash"),
+		},
+	})
+	c.AddToolResults([]anthropic.BetaContentBlockParamUnion{
+		anthropic.NewBetaToolResultBlock("toolu_1", "main.go", false),
+	})
+	c.messages = append(c.messages, anthropic.BetaMessageParam{
+		Role: anthropic.BetaMessageParamRoleAssistant,
+		Content: []anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaTextBlock("There is main.go"),
+		},
+	})
+	c.AddUserMessage("second prompt")
+	return c
+}
+
+func TestConversationUserPrompts(t *testing.T) {
+	prompts := newTestConversation().UserPrompts()
+
+	want := []userPrompt{
+		{Index: 0, Text: "first prompt"},
+		{Index: 4, Text: "second prompt"},
+	}
+	if len(prompts) != len(want) {
+		t.Fatalf("UserPrompts() = %+v, want %+v", prompts, want)
+	}
+	for i := range want {
+		if prompts[i] != want[i] {
+			t.Errorf("UserPrompts()[%d] = %+v, want %+v",
+				i, prompts[i], want[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	printUserPrompts(&buf, prompts)
+	if !strings.Contains(buf.String(), " 2. second prompt") {
+		t.Errorf("printUserPrompts() = %q, want numbered prompts",
+			buf.String())
+	}
+}
+
+func TestConversationRewind(t *testing.T) {
+	tests := []struct {
+		name         string
+		n            int
+		wantText     string
+		wantMessages int
+		wantErr      bool
+	}{
+		{name: "LastPrompt", n: 2, wantText: "second prompt", wantMessages: 4},
+		{name: "FirstPrompt", n: 1, wantText: "first prompt", wantMessages: 0},
+		{name: "Zero", n: 0, wantErr: true, wantMessages: 5},
+		{name: "TooLarge", n: 3, wantErr: true, wantMessages: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConversation()
+			text, err := c.Rewind(tt.n)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Rewind(%d) should have failed", tt.n)
+				}
+			} else if err != nil {
+				t.Fatalf("Rewind(%d) error = %v", tt.n, err)
+			}
+			if text != tt.wantText {
+				t.Errorf("Rewind(%d) = %q, want %q", tt.n, text, tt.wantText)
+			}
+			if len(c.messages) != tt.wantMessages {
+				t.Errorf("Rewind(%d) left %d messages, want %d",
+					tt.n, len(c.messages), tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestConversationRewindToEmptyIsSaved(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+	c := NewConversation()
+	if err := c.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	c.AddUserMessage("only prompt")
+
+	if _, err := c.Rewind(1); err != nil {
+		t.Fatalf("Rewind() error = %v", err)
+	}
+	loaded, err := store.Load(c.ID)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(loaded.messages) != 0 {
+		t.Errorf("saved session has %d messages, want 0",
+			len(loaded.messages))
+	}
+}
+
+func TestConversationFork(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+	original := newTestConversation()
+	if err := original.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+
+	fork, err := original.Fork()
+	if err != nil {
+		t.Fatalf("Fork() error = %v", err)
+	}
+	if fork.ID == original.ID {
+		t.Error("Fork() should create a new session ID")
+	}
+
+	// Rewinding the fork leaves the original untouched
+	if _, err := fork.Rewind(1); err != nil {
+		t.Fatalf("Rewind() error = %v", err)
+	}
+	fork.AddUserMessage("another approach")
+	if len(original.messages) != 5 {
+		t.Errorf("original has %d messages after fork changed, want 5",
+			len(original.messages))
+	}
+
+	for _, c := range []*Conversation{original, fork} {
+		loaded, err := store.Load(c.ID)
+		if err != nil {
+			t.Fatalf("Load(%s) error = %v", c.ID, err)
+		}
+		if len(loaded.messages) != len(c.messages) {
+			t.Errorf("session %s saved with %d messages, want %d",
+				c.ID, len(loaded.messages), len(c.messages))
+		}
+	}
+}
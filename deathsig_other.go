@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// setParentDeathSignal is a no-op on platforms without a parent death
+// signal
+func setParentDeathSignal(cmd *exec.Cmd) {}
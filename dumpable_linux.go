@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// protectProcess makes Gollum undumpable, which makes its /proc files
+// owned by root, so that commands running as the same user cannot read
+// the environment it started with from /proc/PID/environ or attach to
+// it with ptrace
+func protectProcess() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL,
+		syscall.PR_SET_DUMPABLE, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// protectProcess is a no-op on platforms without PR_SET_DUMPABLE
+func protectProcess() error {
+	return nil
+}
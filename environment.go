@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// alwaysDenied are the variables that commands never see, because they
+// hold Gollum's own credentials
+var alwaysDenied = []string{"ANTHROPIC_API_KEY", "ANTHROPIC_AUTH_TOKEN"}
+
+// defaultDenied are the variables that commands do not see unless they
+// are allowed, since their names suggest secrets
+var defaultDenied = []string{
+	"ANTHROPIC_*", "*_API_KEY", "*_APIKEY", "*_TOKEN", "*_SECRET",
+	"*_SECRET_*", "*PASSWORD*", "*_CREDENTIALS",
+}
+
+// cleanVariables are the only variables that commands inherit in a
+// clean environment
+var cleanVariables = []string{"PATH", "HOME", "LANG"}
+
+// Environment controls which of Gollum's environment variables commands
+// inherit. A nil Environment passes everything but the denied
+// variables.
+type Environment struct {
+	// Clean passes only PATH, HOME and LANG, and the Allow variables
+	Clean bool
+
+	// Allow are names or glob patterns of variables that are passed
+	// even though a deny list matches them. Gollum's API key is never
+	// passed.
+	Allow []string
+
+	// Deny are names or glob patterns of variables that are not
+	// passed, besides the built-in ones
+	Deny []string
+
+	// Set are extra variables for commands, as NAME=value
+	Set []string
+}
+
+// newEnvironment returns the environment for commands from the
+// comma-separated patterns in allow and deny and the NAME=value
+// variables in set
+func newEnvironment(clean bool, allow, deny string, set []string) (*Environment, error) {
+	e := &Environment{Clean: clean, Allow: splitList(allow), Deny: splitList(deny)}
+	for _, pattern := range append(e.Allow, e.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid variable pattern %q: %w", pattern, err)
+		}
+	}
+	for _, variable := range set {
+		name, _, ok := strings.Cut(variable, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid variable %q (want NAME=value)", variable)
+		}
+		if matchAny(alwaysDenied, name) {
+			return nil, fmt.Errorf("%s cannot be passed to commands", name)
+		}
+		e.Set = append(e.Set, variable)
+	}
+	return e, nil
+}
+
+// Environ returns the environment that commands run with
+func (e *Environment) Environ() []string {
+	if e == nil {
+		e = &Environment{}
+	}
+	// Not nil, which exec.Cmd takes to mean the whole environment
+	env := []string{}
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if e.passes(name) {
+			env = append(env, variable)
+		}
+	}
+	return append(env, e.Set...)
+}
+
+// hideCredentials removes Gollum's credentials from its environment
+// once the client holds them. That does not change the environment
+// Gollum started with, which /proc/PID/environ shows, so unless protect
+// is false it also makes Gollum's /proc files unreadable to commands.
+func hideCredentials(protect bool) error {
+	for _, name := range alwaysDenied {
+		os.Unsetenv(name)
+	}
+	if !protect {
+		return nil
+	}
+	return protectProcess()
+}
+
+// passes reports whether commands inherit the variable name
+func (e *Environment) passes(name string) bool {
+	switch {
+	case matchAny(alwaysDenied, name):
+		return false
+	case matchAny(e.Allow, name):
+		return true
+	case e.Clean:
+		return slices.Contains(cleanVariables, name)
+	}
+	return !matchAny(defaultDenied, name) && !matchAny(e.Deny, name)
+}
+
+// String describes the environment for the user
+func (e *Environment) String() string {
+	var parts []string
+	if e.Clean {
+		parts = append(parts, "clean ("+strings.Join(cleanVariables, ", ")+")")
+	} else {
+		parts = append(parts, "inherited")
+	}
+	if len(e.Allow) > 0 {
+		parts = append(parts, "allowed: "+strings.Join(e.Allow, ", "))
+	}
+	if len(e.Deny) > 0 {
+		parts = append(parts, "denied: "+strings.Join(e.Deny, ", "))
+	}
+	var names []string
+	for _, variable := range e.Set {
+		name, _, _ := strings.Cut(variable, "=")
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		parts = append(parts, "set: "+strings.Join(names, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// matchAny reports whether name matches any of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
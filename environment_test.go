@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewEnvironment(t *testing.T) {
+	e, err := newEnvironment(false, "GH_TOKEN, NPM_*", "", []string{"CI=1", "GREETING=a=b"})
+	if err != nil {
+		t.Fatalf("newEnvironment() error = %v", err)
+	}
+	if !slices.Equal(e.Allow, []string{"GH_TOKEN", "NPM_*"}) ||
+		!slices.Equal(e.Set, []string{"CI=1", "GREETING=a=b"}) {
+		t.Errorf("newEnvironment() = %+v", e)
+	}
+
+	tests := []struct {
+		allow, deny string
+		set         []string
+	}{
+		{allow: "[A"},
+		{deny: "FOO,[B"},
+		{set: []string{"NOVALUE"}},
+		{set: []string{"=value"}},
+		{set: []string{"ANTHROPIC_API_KEY=sk-ant-123"}},
+	}
+	for _, tt := range tests {
+		if _, err := newEnvironment(false, tt.allow, tt.deny, tt.set); err == nil {
+			t.Errorf("newEnvironment(%q, %q, %q) succeeded", tt.allow, tt.deny, tt.set)
+		}
+	}
+}
+
+func TestEnvironmentPasses(t *testing.T) {
+	tests := []struct {
+		env  *Environment
+		name string
+		want bool
+	}{
+		{nil, "PATH", true},
+		{nil, "EDITOR", true},
+		{nil, "ANTHROPIC_API_KEY", false},
+		{nil, "ANTHROPIC_BASE_URL", false},
+		{nil, "GITHUB_TOKEN", false},
+		{nil, "OPENAI_API_KEY", false},
+		{nil, "AWS_SECRET_ACCESS_KEY", false},
+		{nil, "DB_PASSWORD", false},
+		{nil, "SSH_AUTH_SOCK", true},
+		{&Environment{Allow: []string{"GITHUB_TOKEN"}}, "GITHUB_TOKEN", true},
+		{&Environment{Allow: []string{"ANTHROPIC_*"}}, "ANTHROPIC_API_KEY", false},
+		{&Environment{Allow: []string{"*"}}, "ANTHROPIC_AUTH_TOKEN", false},
+		{&Environment{Deny: []string{"KUBECONFIG"}}, "KUBECONFIG", false},
+		{&Environment{Deny: []string{"AWS_*"}}, "AWS_REGION", false},
+		{&Environment{Deny: []string{"AWS_*"}, Allow: []string{"AWS_REGION"}}, "AWS_REGION", true},
+		{&Environment{Clean: true}, "PATH", true},
+		{&Environment{Clean: true}, "HOME", true},
+		{&Environment{Clean: true}, "LANG", true},
+		{&Environment{Clean: true}, "EDITOR", false},
+		{&Environment{Clean: true, Allow: []string{"GOPATH"}}, "GOPATH", true},
+	}
+	for _, tt := range tests {
+		e := tt.env
+		if e == nil {
+			e = &Environment{}
+		}
+		if got := e.passes(tt.name); got != tt.want {
+			t.Errorf("%+v passes(%q) = %v, want %v", tt.env, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnvironmentOfCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-test")
+	t.Setenv("GITHUB_TOKEN", "ghp_test")
+	t.Setenv("GOLLUM_TEST_EDITOR", "vi")
+
+	const command = "echo key=$ANTHROPIC_API_KEY token=$GITHUB_TOKEN " +
+		"editor=$GOLLUM_TEST_EDITOR ci=$CI path=${PATH:+set}"
+	tests := []struct {
+		name string
+		env  *Environment
+		want string
+	}{
+		{"Default", nil, "key= token= editor=vi ci= path=set\n"},
+		{"Allow", &Environment{Allow: []string{"GITHUB_TOKEN", "ANTHROPIC_API_KEY"}},
+			"key= token=ghp_test editor=vi ci= path=set\n"},
+		{"Clean", &Environment{Clean: true, Set: []string{"CI=1"}},
+			"key= token= editor= ci=1 path=set\n"},
+		// Bash sets a default PATH when there is none
+		{"Empty", &Environment{Deny: []string{"*"}},
+			"key= token= editor= ci= path=set\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tools := map[string]BashTool{
+				"Stateless": &StatelessBashTool{Env: tt.env},
+				"Stateful":  &StatefulBashTool{Env: tt.env},
+				"Pty":       &PtyBashTool{Env: tt.env},
+			}
+			for kind, tool := range tools {
+				stdout, _, err := tool.ExecuteCommand(context.Background(), command)
+				if err != nil || stdout != tt.want {
+					t.Errorf("%s: %q = %q, %v, want %q", kind, command, stdout, err, tt.want)
+				}
+				tool.Restart()
+			}
+
+			m := &JobManager{Env: tt.env}
+			defer m.KillAll()
+			job, err := m.Start(command, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			job.Wait(ctx, 10*time.Second)
+			if output, _ := job.ReadOutput(); output != tt.want {
+				t.Errorf("job output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentEmpty(t *testing.T) {
+	t.Setenv("GOLLUM_TEST_EDITOR", "vi")
+
+	// A nil environment would make commands inherit every variable
+	env := (&Environment{Deny: []string{"*"}}).Environ()
+	if env == nil || len(env) != 0 {
+		t.Errorf("Environ() = %#v, want an empty, non-nil slice", env)
+	}
+}
+
+func TestHideCredentials(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-test")
+	t.Setenv("GOLLUM_TEST_EDITOR", "vi")
+
+	if err := hideCredentials(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv("ANTHROPIC_API_KEY"); ok {
+		t.Error("ANTHROPIC_API_KEY is still set")
+	}
+	if os.Getenv("GOLLUM_TEST_EDITOR") != "vi" {
+		t.Error("hideCredentials() removed another variable")
+	}
+}
+
+func TestEnvironmentString(t *testing.T) {
+	e := &Environment{Clean: true, Allow: []string{"GOPATH"}, Set: []string{"CI=secret-value"}}
+	got := e.String()
+	if !strings.Contains(got, "clean (PATH, HOME, LANG)") ||
+		!strings.Contains(got, "set: CI") || strings.Contains(got, "secret-value") {
+		t.Errorf("String() = %q", got)
+	}
+}
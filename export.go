@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// collapseOutputLines is the number of lines above which tool output is
+// collapsed by default in HTML transcripts
+const collapseOutputLines = 20
+
+// transcriptItem is one rendered element of a conversation transcript
+type transcriptItem struct {
+	// Role is "user", "assistant" or "tool"
+	Role string
+
+	// Text is the message text for user and assistant items
+	Text string
+
+	// Title summarizes a tool use, e.g. "$ ls -la"
+	Title string
+
+	// Details holds the labelled arguments of a tool use, such as the
+	// strings of a text editor replacement
+	Details []transcriptDetail
+
+	// Output is the tool result text and IsError reports whether the
+	// tool failed
+	Output  string
+	IsError bool
+}
+
+// transcriptDetail is a labelled tool argument
+type transcriptDetail struct {
+	Label string
+	Body  string
+}
+
+// transcript converts a conversation into transcript items. Tool
+// results are attached to the tool use that produced them.
+func transcript(c *Conversation) []transcriptItem {
+	results := map[string]*anthropic.BetaToolResultBlockParam{}
+	for _, message := range c.messages {
+		for _, block := range message.Content {
+			if block.OfToolResult != nil {
+				results[block.OfToolResult.ToolUseID] = block.OfToolResult
+			}
+		}
+	}
+
+	var items []transcriptItem
+	for _, message := range c.messages {
+		for _, block := range message.Content {
+			switch {
+			case block.OfText != nil:
+				items = append(items, transcriptItem{
+					Role: string(message.Role),
+					Text: block.OfText.Text,
+				})
+			case block.OfToolUse != nil:
+				item := describeToolUse(block.OfToolUse)
+				if result, ok := results[block.OfToolUse.ID]; ok {
+					item.Output = toolResultText(result)
+					item.IsError = result.IsError.Value
+				}
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// toolResultText returns the concatenated text content of a tool result
+func toolResultText(result *anthropic.BetaToolResultBlockParam) string {
+	var parts []string
+	for _, content := range result.Content {
+		if content.OfText != nil {
+			parts = append(parts, content.OfText.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// describeToolUse renders a tool use the way ExecuteTools prints it
+func describeToolUse(toolUse *anthropic.BetaToolUseBlockParam) transcriptItem {
+	item := transcriptItem{Role: "tool"}
+
+	var input struct {
+		Command    string `json:"command"`
+		Restart    bool   `json:"restart"`
+		Path       string `json:"path"`
+		OldStr     string `json:"old_str"`
+		NewStr     string `json:"new_str"`
+		ViewRange  []int  `json:"view_range"`
+		FileText   string `json:"file_text"`
+		InsertLine *int   `json:"insert_line"`
+		NewText    string `json:"new_text"`
+		Action     string `json:"action"`
+		JobID      int    `json:"job_id"`
+	}
+	raw, err := json.Marshal(toolUse.Input)
+	if err == nil {
+		err = json.Unmarshal(raw, &input)
+	}
+	if err != nil {
+		item.Title = fmt.Sprintf("[%s] %s", toolUse.Name, raw)
+		return item
+	}
+
+	if toolUse.Name == "bash" {
+		if input.Restart {
+			item.Title = "[bash] Restarting bash session"
+		} else {
+			item.Title = "$ " + input.Command
+		}
+		return item
+	}
+
+	if toolUse.Name == jobsToolName {
+		switch input.Action {
+		case "start":
+			item.Title = "[jobs] Starting: " + input.Command
+		case "output":
+			item.Title = fmt.Sprintf("[jobs] Output of job %d", input.JobID)
+		case "kill":
+			item.Title = fmt.Sprintf("[jobs] Killing job %d", input.JobID)
+		default:
+			item.Title = "[jobs] Listing jobs"
+		}
+		return item
+	}
+
+	switch input.Command {
+	case "view":
+		item.Title = fmt.Sprintf("[%s] Viewing: %s", toolUse.Name, input.Path)
+		if len(input.ViewRange) == 2 {
+			item.Title += fmt.Sprintf(" (lines %d-%d)",
+				input.ViewRange[0], input.ViewRange[1])
+		}
+	case "str_replace":
+		item.Title = fmt.Sprintf("[%s] String replace in: %s",
+			toolUse.Name, input.Path)
+		item.Details = []transcriptDetail{
+			{Label: "Replacing", Body: input.OldStr},
+			{Label: "With", Body: input.NewStr},
+		}
+	case "create":
+		item.Title = fmt.Sprintf("[%s] Creating file: %s",
+			toolUse.Name, input.Path)
+		item.Details = []transcriptDetail{
+			{Label: "Contents", Body: input.FileText},
+		}
+	case "insert":
+		line := 0
+		if input.InsertLine != nil {
+			line = *input.InsertLine
+		}
+		item.Title = fmt.Sprintf("[%s] Inserting text in: %s (after line %d)",
+			toolUse.Name, input.Path, line)
+		// The built-in tool sends the text as new_str
+		text := input.NewText
+		if text == "" {
+			text = input.NewStr
+		}
+		item.Details = []transcriptDetail{
+			{Label: "Text", Body: text},
+		}
+	case "undo_edit":
+		item.Title = fmt.Sprintf("[%s] Undoing last edit in: %s",
+			toolUse.Name, input.Path)
+	default:
+		item.Title = fmt.Sprintf("[%s] %s", toolUse.Name, raw)
+	}
+	return item
+}
+
+// exportConversation writes the conversation to path in the given
+// format. An empty format is inferred from the file extension.
+func exportConversation(c *Conversation, format, path string) error {
+	if format == "" {
+		format = "md"
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" ||
+			ext == ".htm" {
+			format = "html"
+		}
+	}
+
+	var render func(io.Writer, *Conversation) error
+	switch format {
+	case "md", "markdown":
+		render = writeMarkdownTranscript
+	case "html":
+		render = writeHTMLTranscript
+	default:
+		return fmt.Errorf("unknown export format %q (want md or html)", format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if err := render(f, c); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// roleHeading returns the heading used for messages from role
+func roleHeading(role string) string {
+	if role == string(anthropic.BetaMessageParamRoleAssistant) {
+		return "Gollum"
+	}
+	return "User"
+}
+
+// markdownFence returns a code fence that is longer than any run of
+// backticks in text, so that the text cannot end the block early.
+func markdownFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// writeMarkdownCode writes text as a fenced Markdown code block
+func writeMarkdownCode(w io.Writer, text string) {
+	fence := markdownFence(text)
+	fmt.Fprintf(w, "%s\n%s\n%s\n\n", fence, strings.TrimSuffix(text, "\n"),
+		fence)
+}
+
+// writeMarkdownTranscript renders the conversation as Markdown
+func writeMarkdownTranscript(w io.Writer, c *Conversation) error {
+	bw := &errWriter{w: w}
+	fmt.Fprintf(bw, "# Gollum session %s\n\n", c.ID)
+	fmt.Fprintf(bw, "Started %s\n\n", c.Created.Local().Format(
+		"2006-01-02 15:04:05"))
+
+	lastRole := ""
+	for _, item := range transcript(c) {
+		if item.Role == "tool" {
+			writeMarkdownCode(bw, item.Title)
+			for _, detail := range item.Details {
+				fmt.Fprintf(bw, "%s:\n\n", detail.Label)
+				writeMarkdownCode(bw, detail.Body)
+			}
+			if item.IsError {
+				fmt.Fprint(bw, "Error:\n\n")
+			}
+			if item.Output != "" {
+				writeMarkdownCode(bw, item.Output)
+			}
+			continue
+		}
+
+		if item.Role != lastRole {
+			fmt.Fprintf(bw, "## %s\n\n", roleHeading(item.Role))
+			lastRole = item.Role
+		}
+		fmt.Fprintf(bw, "%s\n\n", strings.TrimSpace(item.Text))
+	}
+	return bw.err
+}
+
+// htmlTranscriptStyle is the stylesheet embedded in HTML transcripts
+const htmlTranscriptStyle = `
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto;
+       line-height: 1.4; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: .2em; }
+pre { background: #f6f6f6; padding: .6em; overflow-x: auto;
+      white-space: pre-wrap; }
+.tool { border-left: 3px solid #888; padding-left: .8em; margin: 1em 0; }
+.tool .title { font-family: monospace; font-weight: bold; }
+.error pre.output { background: #fbeaea; }
+.message { white-space: pre-wrap; }
+summary { cursor: pointer; color: #555; }
+`
+
+// writeHTMLTranscript renders the conversation as a self-contained
+// HTML document. Long tool outputs are collapsed.
+func writeHTMLTranscript(w io.Writer, c *Conversation) error {
+	bw := &errWriter{w: w}
+	title := html.EscapeString("Gollum session " + c.ID)
+	fmt.Fprintf(bw, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n",
+		title, htmlTranscriptStyle)
+	fmt.Fprintf(bw, "<h1>%s</h1>\n<p>Started %s</p>\n", title,
+		c.Created.Local().Format("2006-01-02 15:04:05"))
+
+	lastRole := ""
+	for _, item := range transcript(c) {
+		if item.Role != "tool" {
+			if item.Role != lastRole {
+				fmt.Fprintf(bw, "<h2>%s</h2>\n", roleHeading(item.Role))
+				lastRole = item.Role
+			}
+			fmt.Fprintf(bw, "<div class=\"message\">%s</div>\n",
+				html.EscapeString(strings.TrimSpace(item.Text)))
+			continue
+		}
+
+		class := "tool"
+		if item.IsError {
+			class += " error"
+		}
+		fmt.Fprintf(bw, "<div class=\"%s\">\n<div class=\"title\">%s</div>\n",
+			class, html.EscapeString(item.Title))
+		for _, detail := range item.Details {
+			fmt.Fprintf(bw, "<div>%s:</div>\n<pre>%s</pre>\n",
+				html.EscapeString(detail.Label),
+				html.EscapeString(detail.Body))
+		}
+		writeHTMLOutput(bw, item)
+		fmt.Fprint(bw, "</div>\n")
+	}
+
+	fmt.Fprint(bw, "</body>\n</html>\n")
+	return bw.err
+}
+
+// writeHTMLOutput writes a tool's output, collapsed if it is long
+func writeHTMLOutput(w io.Writer, item transcriptItem) {
+	if item.Output == "" {
+		return
+	}
+
+	label := "Output"
+	if item.IsError {
+		label = "Error"
+	}
+	output := fmt.Sprintf("<pre class=\"output\">%s</pre>\n",
+		html.EscapeString(item.Output))
+
+	lines := strings.Count(item.Output, "\n") + 1
+	if lines <= collapseOutputLines {
+		fmt.Fprintf(w, "<div>%s:</div>\n%s", label, output)
+		return
+	}
+	fmt.Fprintf(w, "<details>\n<summary>%s (%d lines)</summary>\n%s</details>\n",
+		label, lines, output)
+}
+
+// errWriter wraps a writer and remembers the first write error so that
+// a sequence of writes can be checked once at the end.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write writes p unless an earlier write failed
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	var n int
+	n, ew.err = ew.w.Write(p)
+	return n, ew.err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// newTestTranscriptConversation returns a conversation with a bash
+// command and a text editor edit
+func newTestTranscriptConversation() *Conversation {
+	c := NewConversation()
+	c.AddUserMessage("Fix the <greeting> & list files")
+	c.messages = append(c.messages, anthropic.BetaMessageParam{
+		Role: anthropic.BetaMessageParamRoleAssistant,
+		Content: []anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaTextBlock("Yesss, precious!"),
+			anthropic.NewBetaToolUseBlock("toolu_1",
+				map[string]any{"command": "ls -la"}, "bash"),
+			anthropic.NewBetaToolUseBlock("toolu_2", map[string]any{
+				"command": "str_replace",
+				"path":    "main.go",
+				"old_str": "hello",
+				"new_str": "goodbye",
+			}, "str_replace_based_edit_tool"),
+		},
+	})
+	c.AddToolResults([]anthropic.BetaContentBlockParamUnion{
+		anthropic.NewBetaToolResultBlock("toolu_1",
+			strings.Repeat("file\n", 30), false),
+		anthropic.NewBetaToolResultBlock("toolu_2",
+			"string not found", true),
+	})
+	return c
+}
+
+func TestTranscript(t *testing.T) {
+	items := transcript(newTestTranscriptConversation())
+
+	if len(items) != 4 {
+		t.Fatalf("transcript() returned %d items, want 4: %+v",
+			len(items), items)
+	}
+	if items[0].Role != "user" || !strings.Contains(items[0].Text, "Fix") {
+		t.Errorf("items[0] = %+v, want user prompt", items[0])
+	}
+	if items[1].Role != "assistant" || items[1].Text != "Yesss, precious!" {
+		t.Errorf("items[1] = %+v, want assistant text", items[1])
+	}
+	if items[2].Title != "$ ls -la" || !strings.HasPrefix(items[2].Output,
+		"file\n") || items[2].IsError {
+		t.Errorf("items[2] = %+v, want bash command with output", items[2])
+	}
+
+	edit := items[3]
+	wantTitle := "[str_replace_based_edit_tool] String replace in: main.go"
+	if edit.Title != wantTitle {
+		t.Errorf("edit title = %q, want %q", edit.Title, wantTitle)
+	}
+	if len(edit.Details) != 2 || edit.Details[0].Body != "hello" ||
+		edit.Details[1].Body != "goodbye" {
+		t.Errorf("edit details = %+v, want old and new strings",
+			edit.Details)
+	}
+	if !edit.IsError || edit.Output != "string not found" {
+		t.Errorf("edit result = %q (error %v), want error result",
+			edit.Output, edit.IsError)
+	}
+}
+
+func TestTranscriptInsert(t *testing.T) {
+	c := NewConversation()
+	c.messages = append(c.messages, anthropic.BetaMessageParam{
+		Role: anthropic.BetaMessageParamRoleAssistant,
+		Content: []anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaToolUseBlock("toolu_1", map[string]any{
+				"command":     "insert",
+				"path":        "notes.txt",
+				"insert_line": 1,
+				"new_str":     "two",
+			}, "str_replace_based_edit_tool"),
+			anthropic.NewBetaToolUseBlock("toolu_2", map[string]any{
+				"command":     "insert",
+				"path":        "notes.txt",
+				"insert_line": 2,
+				"new_text":    "three",
+			}, "str_replace_based_edit_tool"),
+		},
+	})
+
+	items := transcript(c)
+	if len(items) != 2 {
+		t.Fatalf("transcript() returned %d items, want 2: %+v", len(items), items)
+	}
+	for i, want := range []string{"two", "three"} {
+		if details := items[i].Details; len(details) != 1 || details[0].Body != want {
+			t.Errorf("items[%d] details = %+v, want the text %q", i, details, want)
+		}
+	}
+}
+
+func TestWriteMarkdownTranscript(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMarkdownTranscript(&buf,
+		newTestTranscriptConversation()); err != nil {
+		t.Fatalf("writeMarkdownTranscript() error = %v", err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{
+		"## User\n\nFix the <greeting> & list files",
+		"## Gollum\n\nYesss, precious!",
+		"```\n$ ls -la\n```",
+		"Replacing:\n\n```\nhello\n```",
+		"Error:\n\n```\nstring not found\n```",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Markdown output missing %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestWriteHTMLTranscript(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeHTMLTranscript(&buf,
+		newTestTranscriptConversation()); err != nil {
+		t.Fatalf("writeHTMLTranscript() error = %v", err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{
+		"<!DOCTYPE html>",
+		"Fix the &lt;greeting&gt; &amp; list files",
+		"$ ls -la",
+		"<details>\n<summary>Output (31 lines)</summary>",
+		`<div class="tool error">`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("HTML output missing %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "<greeting>") {
+		t.Error("HTML output contains unescaped user text")
+	}
+}
+
+func TestMarkdownFence(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "plain", want: "```"},
+		{text: "has ``` fence", want: "````"},
+		{text: "has ````` fence", want: "``````"},
+	}
+	for _, tt := range tests {
+		if got := markdownFence(tt.text); got != tt.want {
+			t.Errorf("markdownFence(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestExportConversation(t *testing.T) {
+	c := newTestTranscriptConversation()
+	dir := t.TempDir()
+
+	tests := []struct {
+		format  string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{format: "", file: "out.md", want: "# Gollum session"},
+		{format: "", file: "out.html", want: "<!DOCTYPE html>"},
+		{format: "html", file: "out.txt", want: "<!DOCTYPE html>"},
+		{format: "pdf", file: "out.pdf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			err := exportConversation(c, tt.format, path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("exportConversation(%q) should have failed",
+						tt.format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exportConversation() error = %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read export: %v", err)
+			}
+			if !strings.HasPrefix(string(data), tt.want) {
+				t.Errorf("export starts with %q, want %q",
+					string(data[:min(len(data), 40)]), tt.want)
+			}
+		})
+	}
+}
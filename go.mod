@@ -5,12 +5,17 @@ go 1.24.3
 require (
 	github.com/anthropics/anthropic-sdk-go v1.4.0
 	github.com/chzyer/readline v1.5.1
+	github.com/creack/pty v1.1.24
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.39.0
+	golang.org/x/sys v0.33.0
+	mvdan.cc/sh/v3 v3.11.0
 )
 
 require (
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 )
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// jobOutputLimit is how much of a background job's most recent output
+// is kept until it is read
+const jobOutputLimit = 1 << 20
+
+// maxJobWait bounds how long the jobs tool waits for a job to exit
+const maxJobWait = 5 * time.Minute
+
+// Job is a command running in the background. Its standard out and
+// standard error are collected together, as they would appear on a
+// terminal.
+type Job struct {
+	ID      int
+	Command string
+	Dir     string
+	Started time.Time
+
+	cmd *exec.Cmd
+
+	// done is closed once the job has exited, after which err and
+	// ended are set
+	done  chan struct{}
+	err   error
+	ended time.Time
+
+	mutex   sync.Mutex
+	killed  bool
+	output  []byte // the most recent output that has not been read
+	dropped int64  // unread output that was dropped to save memory
+}
+
+// Write collects output of the job, keeping only the most recent
+// jobOutputLimit bytes that have not been read yet
+func (j *Job) Write(p []byte) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.output = append(j.output, p...)
+	if excess := len(j.output) - jobOutputLimit; excess > 0 {
+		j.output = append(j.output[:0], j.output[excess:]...)
+		j.dropped += int64(excess)
+	}
+	return len(p), nil
+}
+
+// ReadOutput returns the output of the job since the last call, and how
+// many bytes of it were dropped because it was not read in time
+func (j *Job) ReadOutput() (output string, dropped int64) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	output, dropped = string(j.output), j.dropped
+	j.output, j.dropped = nil, 0
+	return output, dropped
+}
+
+// Running reports whether the job is still running
+func (j *Job) Running() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait waits up to d for the job to exit. It returns early if ctx is
+// cancelled.
+func (j *Job) Wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-j.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Status describes whether the job is running or how it ended
+func (j *Job) Status() string {
+	if j.Running() {
+		return fmt.Sprintf("running for %v", roundDuration(time.Since(j.Started)))
+	}
+
+	j.mutex.Lock()
+	killed := j.killed
+	j.mutex.Unlock()
+
+	ran := roundDuration(j.ended.Sub(j.Started))
+	var exitErr *ExitError
+	switch {
+	case killed:
+		return fmt.Sprintf("killed after %v", ran)
+	case j.err == nil:
+		return fmt.Sprintf("exit status 0 after %v", ran)
+	case errors.As(j.err, &exitErr):
+		return fmt.Sprintf("%v after %v", exitErr, ran)
+	}
+	return fmt.Sprintf("failed after %v: %v", ran, j.err)
+}
+
+// roundDuration rounds d for display
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// JobManager runs commands in the background and keeps track of them
+// until Gollum exits. The zero value is ready to use.
+type JobManager struct {
+	mutex  sync.Mutex
+	jobs   map[int]*Job
+	nextID int
+
+	// Limits caps the resources of every process of the jobs
+	Limits ResourceLimits
+
+	// Sandbox, if not nil, confines the jobs
+	Sandbox *Sandbox
+
+	// Env controls the environment of the jobs
+	Env *Environment
+}
+
+// NewJobManager creates a JobManager with no jobs
+func NewJobManager() *JobManager {
+	return &JobManager{}
+}
+
+// Start runs command in the background in dir, or in the current
+// directory if dir is empty. The job runs in its own process group so
+// that killing it also kills everything it started.
+func (m *JobManager) Start(command, dir string) (*Job, error) {
+	if _, stderr, err := checkBashCommand(command); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.jobs == nil {
+		m.jobs = make(map[int]*Job)
+	}
+	job := &Job{
+		ID:      m.nextID + 1,
+		Command: command,
+		Dir:     dir,
+		Started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	args := m.Limits.wrap("bash", "-c", command)
+	job.cmd = exec.Command(args[0], args[1:]...)
+	job.cmd.Dir = dir
+	job.cmd.Stdout = job
+	job.cmd.Stderr = job
+	job.cmd.Env = m.Env.Environ()
+	setProcessGroup(job.cmd)
+	setParentDeathSignal(job.cmd)
+	if err := m.Sandbox.apply(job.cmd); err != nil {
+		return nil, err
+	}
+	if err := job.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := exitError(job.cmd.Wait())
+		job.err, job.ended = err, time.Now()
+		close(job.done)
+	}()
+
+	m.jobs[job.ID] = job
+	m.nextID = job.ID
+	return job, nil
+}
+
+// Get returns the job with the given ID
+func (m *JobManager) Get(id int) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no job with ID %d", id)
+	}
+	return job, nil
+}
+
+// Kill kills the job with the given ID and everything it started. It is
+// not an error to kill a job that has already exited.
+func (m *JobManager) Kill(id int) (*Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Running() {
+		job.mutex.Lock()
+		job.killed = true
+		job.mutex.Unlock()
+
+		killProcessGroup(job.cmd)
+		job.cmd.Process.Kill()
+		job.Wait(context.Background(), killWaitDelay)
+	}
+	return job, nil
+}
+
+// List returns all jobs in the order they were started
+func (m *JobManager) List() []*Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs
+}
+
+// KillAll kills the jobs that are still running
+func (m *JobManager) KillAll() {
+	for _, job := range m.List() {
+		if job.Running() {
+			m.Kill(job.ID)
+		}
+	}
+}
+
+// KillAllOnSignal kills the jobs and exits when Gollum is hung up on or
+// terminated. Deferred calls do not run then, and the jobs are in their
+// own process groups, so the terminal's hangup does not reach them.
+func (m *JobManager) KillAllOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	go m.killAllOn(signals, os.Exit)
+}
+
+// killAllOn kills the jobs when a signal arrives on signals and then
+// calls exit with the shell's status for that signal
+func (m *JobManager) killAllOn(signals <-chan os.Signal, exit func(int)) {
+	sig := <-signals
+	m.KillAll()
+	status := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		status = 128 + int(s)
+	}
+	exit(status)
+}
+
+// PrintJobs writes a table of the jobs to w
+func (m *JobManager) PrintJobs(w io.Writer) {
+	jobs := m.List()
+	if len(jobs) == 0 {
+		fmt.Fprintln(w, "No background jobs")
+		return
+	}
+	for _, job := range jobs {
+		fmt.Fprintf(w, "  %-4d %-32s %s\n", job.ID, job.Status(),
+			firstLine(job.Command))
+	}
+}
+
+// firstLine returns the first line of s, marking that more follows
+func firstLine(s string) string {
+	if line, _, more := strings.Cut(s, "\n"); more {
+		return line + " ..."
+	}
+	return s
+}
+
+// jobsToolName is the name of the tool for background jobs
+const jobsToolName = "jobs"
+
+// jobsToolParam returns the definition of the tool for background jobs
+func jobsToolParam() anthropic.BetaToolUnionParam {
+	return anthropic.BetaToolUnionParam{
+		OfTool: &anthropic.BetaToolParam{
+			Name: jobsToolName,
+			Description: anthropic.String("Run long-running commands, " +
+				"such as dev servers and file watchers, in the background " +
+				"while you keep using the bash tool. `start` runs a bash " +
+				"command detached, in the bash tool's working directory, " +
+				"and returns its job ID. `output` returns what the job " +
+				"printed since the last call and its status, after " +
+				"waiting up to `wait` seconds for it to exit. `kill` stops " +
+				"a job and everything it started. `list` shows all jobs. " +
+				"Jobs are killed when the session ends."),
+			InputSchema: anthropic.BetaToolInputSchemaParam{
+				Properties: map[string]any{
+					"action": map[string]any{
+						"type": "string",
+						"enum": []string{"start", "output", "kill", "list"},
+					},
+					"command": map[string]any{
+						"type":        "string",
+						"description": "The command to start",
+					},
+					"job_id": map[string]any{
+						"type":        "integer",
+						"description": "The job for output and kill",
+					},
+					"wait": map[string]any{
+						"type": "number",
+						"description": "Seconds to wait for the job to " +
+							"exit before returning its output",
+					},
+				},
+				Required: []string{"action"},
+			},
+		},
+	}
+}
+
+// onJobsToolUse handles the tool for background jobs
+func (ac *AnthropicClient) onJobsToolUse(ctx context.Context, toolUse toolUseInfo, entry *AuditEntry) anthropic.BetaContentBlockParamUnion {
+	var input struct {
+		Action  string  `json:"action"`
+		Command string  `json:"command"`
+		JobID   int     `json:"job_id"`
+		Wait    float64 `json:"wait"`
+	}
+	if err := json.Unmarshal(toolUse.Input, &input); err != nil {
+		fmt.Printf("\nError parsing jobs command: %v\n", err)
+		return anthropic.NewBetaToolResultBlock(
+			toolUse.ID,
+			fmt.Sprintf("Error parsing command: %v", err),
+			true, // isError
+		)
+	}
+
+	jobs := ac.tools.Jobs
+	var content string
+	var err error
+	switch input.Action {
+	case "start":
+		fmt.Printf("\n[jobs] Starting: %s\n", input.Command)
+		approval, approveErr := ac.Approver.ApproveCommand(input.Command)
+		entry.approved(approval, approveErr)
+		if approveErr != nil {
+			err = approveErr
+			break
+		}
+		var dir string
+		if reporter, ok := ac.tools.Bash.(CwdReporter); ok {
+			dir = reporter.Cwd()
+		}
+		var job *Job
+		job, err = jobs.Start(approval.Command, dir)
+		if err == nil {
+			content = approval.Note + fmt.Sprintf("Started job %d", job.ID)
+		}
+	case "output":
+		fmt.Printf("\n[jobs] Output of job %d\n", input.JobID)
+		var job *Job
+		job, err = jobs.Get(input.JobID)
+		if err == nil {
+			wait := time.Duration(input.Wait * float64(time.Second))
+			if wait > 0 {
+				job.Wait(ctx, min(wait, maxJobWait))
+			}
+			content = ac.jobOutput(job)
+		}
+	case "kill":
+		fmt.Printf("\n[jobs] Killing job %d\n", input.JobID)
+		var job *Job
+		job, err = jobs.Kill(input.JobID)
+		if err == nil {
+			content = ac.jobOutput(job)
+		}
+	case "list":
+		fmt.Println("\n[jobs] Listing jobs")
+		var b strings.Builder
+		jobs.PrintJobs(&b)
+		content = b.String()
+	default:
+		err = fmt.Errorf("unknown action %q", input.Action)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		content = fmt.Sprintf("Error: %v", err)
+	}
+	return anthropic.NewBetaToolResultBlock(
+		toolUse.ID,
+		content,
+		err != nil, // isError
+	)
+}
+
+// jobOutput formats the status and new output of job for the model
+func (ac *AnthropicClient) jobOutput(job *Job) string {
+	// Read the status first, so that no output of an exited job can
+	// come after it
+	status := job.Status()
+	output, dropped := job.ReadOutput()
+
+	content := fmt.Sprintf("[job %d: %s]\n", job.ID, status)
+	if dropped > 0 {
+		content += fmt.Sprintf("[%d bytes of older output were dropped]\n",
+			dropped)
+	}
+	output = ac.OutputLimiter.Limit(bashOutput, withNewline(output))
+	return content + "<output>\n" + output + "</output>"
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJobManager(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	m := NewJobManager()
+	defer m.KillAll()
+
+	t.Run("IncrementalOutput", func(t *testing.T) {
+		job, err := m.Start("echo one; echo two >&2; sleep 30; echo three", "")
+		if err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+
+		waitForOutput(t, job, "one\ntwo\n")
+		if !job.Running() {
+			t.Errorf("job stopped early: %s", job.Status())
+		}
+		if !strings.HasPrefix(job.Status(), "running for ") {
+			t.Errorf("Status() = %q, want running", job.Status())
+		}
+
+		// Output that was read is not returned again
+		if output, _ := job.ReadOutput(); output != "" {
+			t.Errorf("second ReadOutput() = %q, want nothing new", output)
+		}
+	})
+
+	t.Run("Exit", func(t *testing.T) {
+		dir := t.TempDir()
+		job, err := m.Start("pwd; exit 3", dir)
+		if err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+		job.Wait(context.Background(), 10*time.Second)
+		if job.Running() {
+			t.Fatal("job did not exit")
+		}
+		if !strings.HasPrefix(job.Status(), "exit status 3 after ") {
+			t.Errorf("Status() = %q, want exit status 3", job.Status())
+		}
+		if output, _ := job.ReadOutput(); output != dir+"\n" {
+			t.Errorf("ReadOutput() = %q, want %q", output, dir+"\n")
+		}
+	})
+
+	t.Run("Kill", func(t *testing.T) {
+		// The child sleep must die with the job
+		job, err := m.Start("sleep 30 & echo $!; wait", "")
+		if err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+		waitForOutput(t, job, "")
+
+		if _, err := m.Kill(job.ID); err != nil {
+			t.Fatalf("Kill() failed: %v", err)
+		}
+		if job.Running() || !strings.HasPrefix(job.Status(), "killed after ") {
+			t.Errorf("Status() after Kill() = %q, want killed", job.Status())
+		}
+
+		// Killing it again is harmless
+		if _, err := m.Kill(job.ID); err != nil {
+			t.Errorf("second Kill() failed: %v", err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := m.Start("if [ 1 == ", ""); err == nil {
+			t.Error("Start() with a syntax error succeeded")
+		}
+		if _, err := m.Get(999); err == nil {
+			t.Error("Get() of an unknown job succeeded")
+		}
+		if _, err := m.Kill(999); err == nil {
+			t.Error("Kill() of an unknown job succeeded")
+		}
+	})
+
+	t.Run("ListAndKillAll", func(t *testing.T) {
+		jobs := m.List()
+		for i, job := range jobs {
+			if job.ID != i+1 {
+				t.Errorf("List()[%d] has ID %d, want %d", i, job.ID, i+1)
+			}
+		}
+
+		var table strings.Builder
+		m.PrintJobs(&table)
+		if !strings.Contains(table.String(), "exit status 3") {
+			t.Errorf("PrintJobs() = %q, want the exited job", table.String())
+		}
+
+		m.KillAll()
+		for _, job := range m.List() {
+			if job.Running() {
+				t.Errorf("job %d still running after KillAll()", job.ID)
+			}
+		}
+	})
+}
+
+// waitForOutput reads a job's output until it has at least want, or
+// some output if want is empty
+func waitForOutput(t *testing.T, job *Job, want string) {
+	t.Helper()
+	var output string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		more, _ := job.ReadOutput()
+		output += more
+		if output != "" && len(output) >= len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.HasPrefix(output, want) || output == "" {
+		t.Fatalf("job output = %q, want %q", output, want)
+	}
+}
+
+func TestJobsKilledOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	m := NewJobManager()
+	defer m.KillAll()
+	job, err := m.Start("sleep 30", "")
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	status := make(chan int)
+	go m.killAllOn(signals, func(s int) { status <- s })
+	signals <- syscall.SIGTERM
+	if got := <-status; got != 143 {
+		t.Errorf("exit status = %d, want 143", got)
+	}
+	if job.Running() {
+		t.Error("job survived the signal")
+	}
+}
+
+func TestJobOutputLimit(t *testing.T) {
+	job := &Job{}
+	job.Write([]byte(strings.Repeat("a", jobOutputLimit)))
+	job.Write([]byte("bcd"))
+
+	output, dropped := job.ReadOutput()
+	if dropped != 3 || len(output) != jobOutputLimit ||
+		!strings.HasSuffix(output, "abcd") {
+		t.Errorf("ReadOutput() = %d bytes ending %q, dropped %d; want "+
+			"%d bytes ending \"abcd\", dropped 3", len(output),
+			output[len(output)-4:], dropped, jobOutputLimit)
+	}
+}
+
+func TestJobsTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	ac := newTestClient("http://localhost")
+	ac.tools.Jobs = NewJobManager()
+	defer ac.tools.Jobs.KillAll()
+
+	run := func(input string) (string, bool) {
+		t.Helper()
+		result := ac.onJobsToolUse(context.Background(), toolUseInfo{
+			ID:    "toolu_1",
+			Name:  jobsToolName,
+			Input: json.RawMessage(input),
+		}, &AuditEntry{})
+		block := result.OfToolResult
+		return block.Content[0].OfText.Text, block.IsError.Value
+	}
+
+	if got, isError := run(`{"action":"start","command":"echo hi"}`); isError ||
+		got != "Started job 1" {
+		t.Errorf("start = %q (error %v), want %q", got, isError, "Started job 1")
+	}
+
+	got, isError := run(`{"action":"output","job_id":1,"wait":10}`)
+	if isError || !strings.HasPrefix(got, "[job 1: exit status 0 after ") ||
+		!strings.HasSuffix(got, "<output>\nhi\n</output>") {
+		t.Errorf("output = %q (error %v), want the exited job's output",
+			got, isError)
+	}
+
+	if got, isError := run(`{"action":"kill","job_id":7}`); !isError ||
+		!strings.Contains(got, "no job with ID 7") {
+		t.Errorf("kill of unknown job = %q (error %v), want an error",
+			got, isError)
+	}
+
+	if _, isError := run(`{"action":"restart"}`); !isError {
+		t.Error("unknown action succeeded")
+	}
+
+	// The tool is only offered with a job manager
+	var names []string
+	for _, tool := range ac.toolParams() {
+		names = append(names, *tool.GetName())
+	}
+	if !strings.Contains(strings.Join(names, " "), jobsToolName) {
+		t.Errorf("toolParams() = %v, want the jobs tool", names)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResourceLimits caps the resources of every process that a bash tool
+// runs. They are set as rlimits with bash's ulimit, so they apply to
+// each process separately, except Processes, which counts all processes
+// of the user. Zero fields are not limited.
+type ResourceLimits struct {
+	// CPUTime is the CPU time a process may use before it is killed
+	CPUTime time.Duration
+
+	// Memory is the virtual memory in bytes a process may allocate.
+	// This is address space rather than memory in use, so runtimes
+	// that reserve large ranges up front, such as Go and the JVM, may
+	// need far more than they use.
+	Memory int64
+
+	// FileSize is the size in bytes up to which a process may write
+	// files
+	FileSize int64
+
+	// Processes is how many processes the user may have
+	Processes int
+
+	// OpenFiles is how many files a process may have open
+	OpenFiles int
+}
+
+// parseResourceLimits parses limits such as
+// "cpu=30s,mem=2G,fsize=1G,nproc=512,nofile=1024". CPU time is a
+// duration or a number of seconds; sizes take a K, M, G or T suffix.
+func parseResourceLimits(s string) (ResourceLimits, error) {
+	var l ResourceLimits
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return l, fmt.Errorf("malformed limit %q (want name=value)", field)
+		}
+
+		var err error
+		switch name {
+		case "cpu":
+			l.CPUTime, err = parseCPUTime(value)
+		case "mem":
+			l.Memory, err = parseSize(value)
+		case "fsize":
+			l.FileSize, err = parseSize(value)
+		case "nproc":
+			l.Processes, err = parsePositive(value)
+		case "nofile":
+			l.OpenFiles, err = parsePositive(value)
+		default:
+			return l, fmt.Errorf("unknown limit %q (want cpu, mem, "+
+				"fsize, nproc or nofile)", name)
+		}
+		if err != nil {
+			return l, fmt.Errorf("invalid %s limit %q: %w", name, value, err)
+		}
+	}
+	return l, nil
+}
+
+// parseCPUTime parses a duration, or a plain number of seconds
+func parseCPUTime(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < time.Second {
+		err = errors.New("must be at least 1s")
+	}
+	return d, err
+}
+
+// parseSize parses a size in bytes with an optional binary K, M, G or T
+// suffix
+func parseSize(s string) (int64, error) {
+	shift := 0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", strings.ToUpper(s)[len(s)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("want a positive size such as 512M")
+	}
+	return n << shift, nil
+}
+
+// parsePositive parses a positive count
+func parsePositive(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New("want a positive number")
+	}
+	return n, nil
+}
+
+// String formats the limits the way parseResourceLimits reads them
+func (l ResourceLimits) String() string {
+	var fields []string
+	if l.CPUTime > 0 {
+		fields = append(fields, "cpu="+l.CPUTime.String())
+	}
+	if l.Memory > 0 {
+		fields = append(fields, "mem="+formatSize(l.Memory))
+	}
+	if l.FileSize > 0 {
+		fields = append(fields, "fsize="+formatSize(l.FileSize))
+	}
+	if l.Processes > 0 {
+		fields = append(fields, fmt.Sprintf("nproc=%d", l.Processes))
+	}
+	if l.OpenFiles > 0 {
+		fields = append(fields, fmt.Sprintf("nofile=%d", l.OpenFiles))
+	}
+	return strings.Join(fields, ",")
+}
+
+// formatSize formats n with the largest suffix that divides it
+func formatSize(n int64) string {
+	for i := 3; i >= 0; i-- {
+		if shift := 10 * (i + 1); n%(1<<shift) == 0 {
+			return fmt.Sprintf("%d%c", n>>shift, "KMGT"[i])
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// ulimit returns the bash command that sets the limits, or the empty
+// string if there are none
+func (l ResourceLimits) ulimit() string {
+	var args []string
+	if l.CPUTime > 0 {
+		// The hard limit is a second later, so that a process gets
+		// SIGXCPU, which names the limit, rather than SIGKILL
+		seconds := (l.CPUTime + time.Second - 1) / time.Second
+		args = append(args, fmt.Sprintf("-H -t %d", seconds+1),
+			fmt.Sprintf("-S -t %d", seconds))
+	}
+	if l.Memory > 0 {
+		args = append(args, fmt.Sprintf("-v %d", (l.Memory+1023)/1024))
+	}
+	if l.FileSize > 0 {
+		args = append(args, fmt.Sprintf("-f %d", (l.FileSize+1023)/1024))
+	}
+	if l.Processes > 0 {
+		args = append(args, fmt.Sprintf("-u %d", l.Processes))
+	}
+	if l.OpenFiles > 0 {
+		args = append(args, fmt.Sprintf("-n %d", l.OpenFiles))
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return "ulimit " + strings.Join(args, " && ulimit ")
+}
+
+// wrap returns the arguments that run args under the limits. Bash sets
+// the limits and then replaces itself with the command, which inherits
+// them.
+func (l ResourceLimits) wrap(args ...string) []string {
+	ulimit := l.ulimit()
+	if ulimit == "" {
+		return args
+	}
+	return append([]string{"bash", "-c",
+		ulimit + ` || exit 126; exec "$@"`, "bash"}, args...)
+}
+
+// Check reports whether the limits can be set, which fails if one is
+// above the hard limit that Gollum itself runs with
+func (l ResourceLimits) Check() error {
+	ulimit := l.ulimit()
+	if ulimit == "" {
+		return nil
+	}
+	output, err := exec.Command("bash", "-c", ulimit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot set limits %s: %s", l,
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// LimitError reports that a command failed because it hit one of the
+// resource limits
+type LimitError struct {
+	// Limit describes the limit that was hit, such as "cpu=30s"
+	Limit string
+
+	// Err is the error of the command
+	Err error
+
+	// FromOutput is set if the limit was inferred from the command's
+	// last words rather than from the signal that the kernel sends
+	FromOutput bool
+}
+
+func (e *LimitError) Error() string {
+	if e.FromOutput {
+		return fmt.Sprintf("%v; the output suggests the resource limit "+
+			"%s was exceeded", e.Err, e.Limit)
+	}
+	return fmt.Sprintf("resource limit %s exceeded (%v)", e.Limit, e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Messages that programs print when an allocation, fork or open fails
+// because of a limit
+var (
+	memoryExhausted = regexp.MustCompile(`(?i)cannot allocate memory|` +
+		`x(re)?alloc: cannot allocate|` +
+		`out of memory|memoryerror|bad_alloc|failed to reserve`)
+	processExhausted = regexp.MustCompile(`(?i)fork: (retry: )?` +
+		`resource temporarily unavailable|cannot fork|` +
+		`pthread_create failed|unable to create native thread`)
+	filesExhausted = regexp.MustCompile(`(?i)too many open files`)
+)
+
+// lastWordsSize is how much of the end of a failed command's output is
+// searched for the messages of a limit, since a program that hits one
+// fails right after it says so
+const lastWordsSize = 1024
+
+// check turns err, the error of a command with the given output, into
+// a *LimitError if the command failed because it hit a configured
+// limit. The CPU time and file size limits are known by the signals
+// they send. The others only make calls fail, so they are inferred from
+// the end of the output, and only for a command that was killed by no
+// other signal.
+func (l ResourceLimits) check(output string, err error) error {
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	switch {
+	case l.CPUTime > 0 && exitErr.Signal == sigCPULimit:
+		return &LimitError{Limit: "cpu=" + l.CPUTime.String(), Err: err}
+	case l.FileSize > 0 && exitErr.Signal == sigFileSizeLimit:
+		return &LimitError{Limit: "fsize=" + formatSize(l.FileSize), Err: err}
+	case exitErr.Signal != 0:
+		return err
+	}
+
+	lastWords := output[max(0, len(output)-lastWordsSize):]
+	var limit string
+	switch {
+	case l.Memory > 0 && memoryExhausted.MatchString(lastWords):
+		limit = "mem=" + formatSize(l.Memory)
+	case l.Processes > 0 && processExhausted.MatchString(lastWords):
+		limit = fmt.Sprintf("nproc=%d", l.Processes)
+	case l.OpenFiles > 0 && filesExhausted.MatchString(lastWords):
+		limit = fmt.Sprintf("nofile=%d", l.OpenFiles)
+	default:
+		return err
+	}
+	return &LimitError{Limit: limit, Err: err, FromOutput: true}
+}
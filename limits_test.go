@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseResourceLimits(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ResourceLimits
+		wantErr bool
+	}{
+		{in: "", want: ResourceLimits{}},
+		{
+			in: "cpu=30s,mem=2G,fsize=512M,nproc=256,nofile=1024",
+			want: ResourceLimits{
+				CPUTime:   30 * time.Second,
+				Memory:    2 << 30,
+				FileSize:  512 << 20,
+				Processes: 256,
+				OpenFiles: 1024,
+			},
+		},
+		{in: "cpu=90, fsize=100k", want: ResourceLimits{
+			CPUTime: 90 * time.Second, FileSize: 100 << 10}},
+		{in: "mem=1000", want: ResourceLimits{Memory: 1000}},
+		{in: "cpu=10ms", wantErr: true},
+		{in: "mem=lots", wantErr: true},
+		{in: "nproc=-1", wantErr: true},
+		{in: "disk=1G", wantErr: true},
+		{in: "cpu", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseResourceLimits(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseResourceLimits(%q) succeeded", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseResourceLimits(%q) = %+v, %v, want %+v", tt.in,
+				got, err, tt.want)
+		}
+
+		// String formats limits the way they are parsed
+		if again, err := parseResourceLimits(got.String()); err != nil || again != got {
+			t.Errorf("parseResourceLimits(%q) = %+v, %v, want %+v",
+				got.String(), again, err, got)
+		}
+	}
+}
+
+func TestResourceLimitsUlimit(t *testing.T) {
+	l := ResourceLimits{CPUTime: 1500 * time.Millisecond, Memory: 1000,
+		FileSize: 2048, Processes: 10, OpenFiles: 64}
+	want := "ulimit -H -t 3 && ulimit -S -t 2 && ulimit -v 1 && " +
+		"ulimit -f 2 && ulimit -u 10 && ulimit -n 64"
+	if got := l.ulimit(); got != want {
+		t.Errorf("ulimit() = %q, want %q", got, want)
+	}
+
+	if got := (ResourceLimits{}).wrap("bash"); len(got) != 1 {
+		t.Errorf("wrap() without limits = %q, want the command alone", got)
+	}
+}
+
+func TestResourceLimitsCheck(t *testing.T) {
+	failed := &ExitError{Status: 1}
+	tests := []struct {
+		name       string
+		limits     ResourceLimits
+		output     string
+		err        error
+		limit      string
+		fromOutput bool
+	}{
+		{"CPUSignal", ResourceLimits{CPUTime: time.Second}, "",
+			&ExitError{Status: 152, Signal: sigCPULimit}, "cpu=1s", false},
+		{"FileSizeSignal", ResourceLimits{FileSize: 1 << 20}, "",
+			&ExitError{Status: 153, Signal: sigFileSizeLimit}, "fsize=1M", false},
+		{"CPUSignalWithoutLimit", ResourceLimits{Memory: 1 << 30}, "",
+			&ExitError{Status: 152, Signal: sigCPULimit}, "", false},
+		{"MemoryMessage", ResourceLimits{Memory: 1 << 30},
+			"building...\nfatal error: runtime: out of memory\n", failed, "mem=1G", true},
+		{"MemoryMessageWithoutLimit", ResourceLimits{OpenFiles: 64},
+			"fatal error: runtime: out of memory\n", failed, "", false},
+		{"OpenFilesMessage", ResourceLimits{OpenFiles: 64},
+			"open data.db: too many open files\n", failed, "nofile=64", true},
+		{"EarlierMessage", ResourceLimits{Memory: 1 << 30},
+			"--- PASS: TestOutOfMemory\n" + strings.Repeat("ok\n", 1000) + "FAIL\n",
+			failed, "", false},
+		{"OtherSignal", ResourceLimits{Memory: 1 << 30},
+			"out of memory\n", &ExitError{Status: 137, Signal: syscall.SIGKILL}, "", false},
+		{"Success", ResourceLimits{Memory: 1 << 30}, "out of memory\n", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.check(tt.output, tt.err)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				if tt.limit != "" {
+					t.Errorf("check() = %v, want the %s limit", err, tt.limit)
+				}
+				return
+			}
+			if limitErr.Limit != tt.limit || limitErr.FromOutput != tt.fromOutput {
+				t.Errorf("check() = %+v, want the %s limit (from output %v)",
+					limitErr, tt.limit, tt.fromOutput)
+			}
+		})
+	}
+}
+
+func TestResourceLimitsEnforced(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	tests := []struct {
+		name    string
+		limits  ResourceLimits
+		command string
+		limit   string
+	}{
+		{
+			name:    "FileSize",
+			limits:  ResourceLimits{FileSize: 4 << 10},
+			command: "head -c 100000 /dev/zero > $TMPDIR/big",
+			limit:   "fsize=4K",
+		},
+		{
+			name:    "CPUTime",
+			limits:  ResourceLimits{CPUTime: time.Second},
+			command: "bash -c 'while :; do :; done'",
+			limit:   "cpu=1s",
+		},
+		{
+			name:    "OpenFiles",
+			limits:  ResourceLimits{OpenFiles: 16},
+			command: "bash -c 'for i in $(seq 30); do exec {fd}</dev/null; done'",
+			limit:   "nofile=16",
+		},
+		{
+			name:    "Memory",
+			limits:  ResourceLimits{Memory: 64 << 20},
+			command: `bash -c 'x=$(head -c 100000000 /dev/zero | tr "\0" a)'`,
+			limit:   "mem=64M",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.Check(); err != nil {
+				t.Skipf("cannot set limits: %v", err)
+			}
+			command := "TMPDIR=" + t.TempDir() + "; " + tt.command
+
+			tools := map[string]BashTool{
+				"stateless": &StatelessBashTool{Limits: tt.limits},
+				"stateful":  &StatefulBashTool{Limits: tt.limits},
+			}
+			for name, tool := range tools {
+				_, _, err := tool.ExecuteCommand(context.Background(), command)
+				var limitErr *LimitError
+				if !errors.As(err, &limitErr) || limitErr.Limit != tt.limit {
+					t.Errorf("%s: error = %v, want the %s limit", name, err,
+						tt.limit)
+				} else if !strings.Contains(err.Error(), tt.limit) {
+					t.Errorf("%s: error %q does not name the limit", name, err)
+				}
+				if stateful, ok := tool.(*StatefulBashTool); ok {
+					stateful.stopSession()
+				}
+			}
+		})
+	}
+
+	// Commands within the limits are unaffected
+	tool := &StatelessBashTool{Limits: ResourceLimits{FileSize: 1 << 20}}
+	stdout, _, err := tool.ExecuteCommand(context.Background(), "echo fine")
+	if err != nil || stdout != "fine\n" {
+		t.Errorf("command within limits = %q, %v", stdout, err)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -53,25 +56,82 @@ func addLineNumbers(text string, startLine *int) string {
 type toolProviders struct {
 	Bash       BashTool
 	TextEditor TextEditorTool
+
+	// Jobs runs commands in the background, or is nil to not offer
+	// background jobs
+	Jobs *JobManager
 }
 
 func main() {
+	// Gollum runs itself as the init program of sandboxed commands
+	runSandboxInit()
+
+	os.Exit(run())
+}
+
+// run runs Gollum and returns its exit status. It returns rather than
+// exiting so that its deferred cleanup, such as killing background
+// jobs, always runs.
+func run() int {
+	// gollum audit prints the audit log instead of starting a session
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		err := runAudit(os.Args[2:], os.Stdout)
+		if err != nil && err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Define command-line flags
 	var (
 		modelName  = flag.String("model", "claude-4-sonnet", "Model to use (e.g., claude-sonnet-4-0, claude-3-5-sonnet-latest)")
 		listModels = flag.Bool("list-models", false, "List available model names and exit")
 		debug      = flag.Bool("debug", false, "Enable debug tracing of raw events")
 		help       = flag.Bool("help", false, "Show help message")
+		sessionDir = flag.String("session-dir", ".gollum_sessions", "Directory where conversations are saved")
+		resume     = flag.String("resume", "", "Resume the saved session with the given ID (or unique ID prefix)")
+		continueFl = flag.Bool("continue", false, "Resume the most recently updated session")
+		bashLimit  = flag.Int("bash-output-limit", defaultBashOutputLimit, "Maximum bytes of bash output sent to the model; longer output is elided and saved to a file (0 disables)")
+		editLimit  = flag.Int("editor-output-limit", defaultEditorOutputLimit, "Maximum bytes of text editor output sent to the model (0 disables)")
+		maxTokens  = flag.Int64("max-tokens", 0, "Maximum tokens per response (0 uses the model's maximum); longer responses are continued automatically")
+		bashMode   = flag.String("bash-mode", bashModeStateful, "Bash tool: stateful keeps one shell so cd and export persist, stateless runs each command in a fresh shell, pty keeps one shell on a terminal so commands can prompt for input")
+		cmdTimeout = flag.Duration("command-timeout", defaultCommandTimeout, "How long a bash command may run before it is killed (0 disables)")
+		maxRetries = flag.Int("max-retries", defaultMaxRetries, "How often to retry requests that fail with overloaded, rate limit or connection errors")
+		compactAt  = flag.Int("compact-threshold", defaultCompactThreshold, "Estimated conversation size in tokens at which older turns are summarized (0 disables)")
+		limitsFl   = flag.String("limits", "", "Resource limits for commands, e.g. cpu=60s,mem=4G,fsize=1G,nproc=2048,nofile=1024")
+		sandboxFl  = flag.Bool("sandbox", false, "Run commands in a Linux namespace sandbox where only the current directory is writable, /tmp is private and there is no network")
+		sandboxNet = flag.Bool("sandbox-network", false, "Give sandboxed commands network access")
+		sandboxRW  = flag.String("sandbox-writable", "", "Comma-separated directories that sandboxed commands may write to besides the current directory")
+		approveFl  = flag.String("approve", approveEditsOnly, "What runs without asking: always runs commands and edits, edits-only asks before commands, never asks before commands and edits")
+		policyFl   = flag.String("policy", "", "Policy file of allow, ask and deny rules for bash commands, e.g. \"deny curl * | sh\"")
+		workspace  = flag.String("workspace", ".", "Directory the text editor is confined to")
+		allowDirs  = flag.String("allow-dirs", "", "Comma-separated directories the text editor may also use")
+		protectFl  = flag.String("protect", strings.Join(defaultProtected, ","), "Comma-separated glob patterns for workspace paths the text editor may not use")
+		redactFl   = flag.Bool("redact", true, "Replace secrets such as API keys, tokens and private keys in tool output with placeholders before it is sent")
+		redactFile = flag.String("redact-patterns", "", "File of extra regular expressions, one per line, for secrets to redact from tool output")
+		envClean   = flag.Bool("env-clean", false, "Give commands only PATH, HOME and LANG from Gollum's environment, plus the -env-allow variables")
+		envAllow   = flag.String("env-allow", "", "Comma-separated names or glob patterns of variables commands inherit even if denied")
+		envDeny    = flag.String("env-deny", "", "Comma-separated names or glob patterns of variables commands do not inherit")
+		auditLog   = flag.String("audit-log", defaultAuditLogPath(), "JSONL file that records every tool call; read it with gollum audit (empty disables)")
+		remoteFl   = flag.String("remote", "", "Run commands and edit files on a remote host over SSH, given as [user@]host[:port][:/path]")
 	)
 
+	var envSet []string
+	flag.Func("env", "Set a variable for commands, as NAME=value (repeatable)", func(s string) error {
+		envSet = append(envSet, s)
+		return nil
+	})
+
 	// Custom usage function
 	flag.Usage = func() {
 		usageMsg := fmt.Sprintf(`Usage: %s [OPTIONS]
+       %s audit [-session ID] [-tool NAME] [-path PATH] [-json]
 
 Anthropic Claude Agent with Local Bash and Built-in Text Editor
 
 Options:
-`, os.Args[0])
+`, os.Args[0], os.Args[0])
 		fmt.Fprint(os.Stderr, usageMsg)
 		flag.PrintDefaults()
 
@@ -84,8 +144,11 @@ Examples:
   %s -model claude-sonnet-4-0          # Use Claude 4 Sonnet
   %s -model claude-4-opus              # Use Claude 4 Opus
   %s -debug                            # Enable debug tracing
+  %s -continue                         # Resume the most recent session
+  %s -resume 20250610-142233-1f2e      # Resume a saved session
   %s -list-models                      # Show available models
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+  %s audit -session 20250610-142233    # Show the tool calls of a session
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		fmt.Fprint(os.Stderr, examplesMsg)
 	}
 
@@ -94,50 +157,302 @@ Examples:
 	// Handle help flag
 	if *help {
 		flag.Usage()
-		os.Exit(0)
+		return 0
 	}
 
 	// Handle list-models flag
 	if *listModels {
 		printAvailableModels()
-		os.Exit(0)
+		return 0
 	}
 
 	// Get API key from environment
 	apiKey := os.Getenv("ANTHROPIC_API_KEY")
 	if apiKey == "" {
 		fmt.Println("Please set ANTHROPIC_API_KEY environment variable")
-		os.Exit(1)
+		return 1
+	}
+
+	approver, err := newApprover(*approveFl)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if *policyFl != "" {
+		approver.Policy, err = LoadPolicy(*policyFl)
+		if err != nil {
+			fmt.Printf("Error: policy: %v\n", err)
+			return 1
+		}
 	}
 
 	// Instantiate tool providers
+	limits, err := parseResourceLimits(*limitsFl)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	var sandbox *Sandbox
+	if *sandboxFl {
+		if sandbox, err = newSandbox(".", *sandboxRW, *sandboxNet); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Sandbox: %v\n", sandbox)
+	}
+	env, err := newEnvironment(*envClean, *envAllow, *envDeny, envSet)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if *envClean || *envAllow != "" || *envDeny != "" || len(envSet) > 0 {
+		fmt.Printf("Command environment: %v\n", env)
+	}
+	var remote *Remote
+	if *remoteFl != "" {
+		if remote, err = dialRemoteFlag(*remoteFl); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		defer remote.Close()
+		fmt.Printf("Remote: %v\n", remote.Target)
+	}
+	bash, err := newBashTool(*bashMode, bashToolOptions{
+		Timeout: *cmdTimeout,
+		Echo:    os.Stdout,
+		Limits:  limits,
+		Sandbox: sandbox,
+		Env:     env,
+		Remote:  remote,
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	editor, newWorkspace := NewSimpleTextEditorTool(), NewWorkspace
+	if remote != nil {
+		// The workspace is on the remote host, relative to its
+		// directory
+		editor, newWorkspace = remote.NewTextEditorTool(), remote.NewWorkspace
+	}
+	editor.Workspace, err = newWorkspace(*workspace, *allowDirs, splitList(*protectFl))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
 	tools := &toolProviders{
-		Bash:       NewStatelessBashTool(),
-		TextEditor: NewSimpleTextEditorTool(),
+		Bash:       bash,
+		TextEditor: editor,
+		Jobs:       &JobManager{Limits: limits, Sandbox: sandbox, Env: env},
+	}
+	if remote != nil {
+		// Background jobs only run locally
+		tools.Jobs = nil
+	}
+
+	// Background jobs must not outlive Gollum, however it exits
+	if tools.Jobs != nil {
+		defer tools.Jobs.KillAll()
+		tools.Jobs.KillAllOnSignal()
 	}
 
 	// Create Anthropic client
 	client := NewAnthropicClient(apiKey, *modelName, systemPrompt, tools, *debug)
+	client.CompactThreshold = *compactAt
+
+	// Sandboxed commands have their own /proc, in which Gollum does
+	// not appear, and an undumpable Gollum could not map their users
+	if err := hideCredentials(sandbox == nil); err != nil {
+		fmt.Printf("Warning: cannot hide Gollum's environment from commands: %v\n", err)
+	}
+	client.MaxRetries = *maxRetries
+	if *maxTokens > 0 {
+		client.MaxTokens = *maxTokens
+	}
+	client.OutputLimiter = NewOutputLimiter(*bashLimit, *editLimit)
+	switch {
+	case remote != nil:
+		// The remote tools cannot read the files that Gollum saves
+		client.OutputLimiter.NoSave = true
+	case sandbox != nil:
+		// Sandboxed commands have their own /tmp but can read the
+		// rest of the filesystem
+		if dir, err := os.UserCacheDir(); err == nil {
+			client.OutputLimiter.TempDir = filepath.Join(dir, "gollum")
+		}
+	}
+	defer client.OutputLimiter.Close()
+	editor.Workspace.OutputDir = client.OutputLimiter.Dir
+	if *redactFl {
+		client.Redactor = NewRedactor()
+		if *redactFile != "" {
+			if err := client.Redactor.LoadPatterns(*redactFile); err != nil {
+				fmt.Printf("Error: redact patterns: %v\n", err)
+				return 1
+			}
+		}
+	}
+	if *auditLog != "" {
+		client.AuditLog, err = OpenAuditLog(*auditLog)
+		if err != nil {
+			fmt.Printf("Error opening audit log: %v\n", err)
+			return 1
+		}
+		defer client.AuditLog.Close()
+	}
+
+	// Open the session store and initialize the conversation, either
+	// fresh or resumed from a saved session
+	store, err := NewSessionStore(*sessionDir)
+	if err != nil {
+		fmt.Printf("Error opening session store: %v\n", err)
+		return 1
+	}
 
-	// Initialize conversation
 	conversation := NewConversation()
+	switch {
+	case *resume != "":
+		conversation, err = store.Load(*resume)
+	case *continueFl:
+		conversation, err = store.Latest()
+	default:
+		err = conversation.Persist(store)
+	}
+	if err != nil {
+		fmt.Printf("Error resuming session: %v\n", err)
+		return 1
+	}
 
 	// Create user input handler
 	inputHandler, err := NewReader()
 	if err != nil {
 		fmt.Printf("Error creating input handler: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	defer inputHandler.Close()
 
+	// Let the user answer the prompts of interactive commands
+	client.Prompter = inputHandler.Prompt
+	approver.Prompter = inputHandler.Prompt
+	approver.Editor = inputHandler.Edit
+	client.Approver = approver
+
 	// Register the 'new' command with access to conversation context
 	// This demonstrates how to register commands that need access to main application state
 	inputHandler.RegisterCommand("new", "Start a new conversation", func(w io.Writer) error {
 		conversation = NewConversation()
+		if err := conversation.Persist(store); err != nil {
+			fmt.Fprintf(w, "Error saving session: %v\n", err)
+		}
 		fmt.Fprintln(w, "New conversation started!")
 		return nil
 	})
 
+	inputHandler.RegisterCommand("sessions", "List saved sessions", func(w io.Writer) error {
+		sessions, err := store.List()
+		if err != nil {
+			fmt.Fprintf(w, "Error listing sessions: %v\n", err)
+			return nil
+		}
+		printSessions(w, sessions, conversation.ID)
+		return nil
+	})
+
+	if tools.Jobs != nil {
+		inputHandler.RegisterCommand("jobs", "List background jobs", func(w io.Writer) error {
+			tools.Jobs.PrintJobs(w)
+			return nil
+		})
+	}
+
+	inputHandler.RegisterCommand("redactions", "Show the secrets redacted from tool output", func(w io.Writer) error {
+		client.Redactor.PrintRedactions(w)
+		return nil
+	})
+
+	inputHandler.RegisterCommandWithArgs("export", "[md|html] <file>", "Export the conversation as Markdown or HTML", func(w io.Writer, args []string) error {
+		var format, path string
+		switch len(args) {
+		case 1:
+			path = args[0]
+		case 2:
+			format, path = strings.ToLower(args[0]), args[1]
+		default:
+			fmt.Fprintln(w, "Usage: /export [md|html] <file>")
+			return nil
+		}
+		if err := exportConversation(conversation, format, path); err != nil {
+			fmt.Fprintf(w, "Error exporting conversation: %v\n", err)
+			return nil
+		}
+		fmt.Fprintf(w, "Conversation exported to %s\n", path)
+		return nil
+	})
+
+	inputHandler.RegisterCommandWithArgs("rewind", "[n]", "List prompts, or drop prompt n and everything after it to edit and resend it", func(w io.Writer, args []string) error {
+		if len(args) == 0 {
+			printUserPrompts(w, conversation.UserPrompts())
+			return nil
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(w, "Usage: /rewind [n]")
+			return nil
+		}
+		text, err := conversation.Rewind(n)
+		if err != nil {
+			fmt.Fprintf(w, "Error rewinding conversation: %v\n", err)
+			return nil
+		}
+		inputHandler.Prefill(text)
+		fmt.Fprintf(w, "Rewound to before prompt %d. Edit it and press Enter to resend.\n", n)
+		return nil
+	})
+
+	inputHandler.RegisterCommandWithArgs("fork", "[n]", "Continue in a copy of this session, optionally rewound to prompt n", func(w io.Writer, args []string) error {
+		n := 0
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				fmt.Fprintln(w, "Usage: /fork [n]")
+				return nil
+			}
+		}
+		fork, err := conversation.Fork()
+		if err != nil {
+			fmt.Fprintf(w, "Error forking session: %v\n", err)
+			return nil
+		}
+		if n > 0 {
+			text, err := fork.Rewind(n)
+			if err != nil {
+				fmt.Fprintf(w, "Error rewinding fork: %v\n", err)
+				return nil
+			}
+			inputHandler.Prefill(text)
+		}
+		fmt.Fprintf(w, "Forked session %s into %s\n", conversation.ID, fork.ID)
+		conversation = fork
+		return nil
+	})
+
+	inputHandler.RegisterCommandWithArgs("compact", "[instructions]", "Summarize older turns to free up context", func(w io.Writer, args []string) error {
+		// Keep only the most recent assistant turn verbatim
+		before, after, err := client.CompactConversation(context.Background(),
+			conversation, 0, strings.Join(args, " "))
+		if err != nil {
+			fmt.Fprintf(w, "Error compacting conversation: %v\n", err)
+			return nil
+		}
+		fmt.Fprintf(w, "Conversation compacted from ~%d to ~%d tokens\n", before, after)
+		return nil
+	})
+
+	inputHandler.RegisterCommand("context", "Show how the context window is used", func(w io.Writer) error {
+		client.ReportContext(context.Background(), w, conversation)
+		return nil
+	})
+
 	// Example: Register a custom command
 	inputHandler.RegisterCommand("version", "Show version information", func(w io.Writer) error {
 		fmt.Fprintln(w, "Gollum v1.0 - Anthropic Claude Agent")
@@ -154,12 +469,24 @@ Examples:
 		return nil
 	})
 
+	where := "locally on your machine"
+	if remote != nil {
+		where = fmt.Sprintf("on %s over SSH", remote.Target)
+	}
 	startupMsg := fmt.Sprintf(`Anthropic Claude Agent with Local Bash and Built-in Text Editor
 Using model: %s
-Commands are executed locally on your machine
-Text editor tool: %s
+Commands are executed %s
+Text editor tool: %s (confined to %s)
 History is saved to .gollum_history
-Use Ctrl+R for reverse history search, Ctrl+C to interrupt`, *modelName, client.TextEditorToolName)
+Session: %s (saved to %s)
+Use Ctrl+R for reverse history search, Ctrl+C to interrupt`, *modelName, where,
+		client.TextEditorToolName, strings.Join(editor.Workspace.Roots, ", "),
+		conversation.ID, *sessionDir)
+
+	if n := len(conversation.messages); n > 0 {
+		startupMsg += fmt.Sprintf("\nResumed session with %d messages: %s", n,
+			summarizePrompt(conversation.FirstPrompt(), 50))
+	}
 
 	if *debug {
 		startupMsg += "\nDEBUG MODE ENABLED - Raw event tracing is active"
@@ -190,12 +517,23 @@ Type '/exit' to quit, '/help' for special commands
 		// Add user message (userInput is guaranteed to be non-empty)
 		conversation.AddUserMessage(userInput)
 
+		// Ctrl+C cancels the turn: the response stream and any
+		// running command are stopped and Gollum returns to the prompt
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+
 		// Loop to handle potential tool use
 		for {
-			ctx := context.Background()
+			// Summarize older turns if the conversation is getting
+			// close to the context window
+			client.AutoCompact(ctx, conversation)
+			client.CheckContext(ctx, conversation)
 
 			// Send message to Anthropic and get response
 			toolUseBlocks, err := client.SendMessage(ctx, conversation)
+			if ctx.Err() != nil {
+				fmt.Println("\n[Interrupted]")
+				break
+			}
 			if err != nil {
 				fmt.Printf("\nError: %v\n", err)
 				break
@@ -203,7 +541,11 @@ Type '/exit' to quit, '/help' for special commands
 
 			// If there were tool uses, execute them and continue
 			if len(toolUseBlocks) > 0 {
-				client.ExecuteTools(toolUseBlocks, conversation)
+				client.ExecuteTools(ctx, toolUseBlocks, conversation)
+				if ctx.Err() != nil {
+					fmt.Println("\n[Interrupted]")
+					break
+				}
 
 				// Continue the conversation with tool results
 				continue
@@ -212,7 +554,10 @@ Type '/exit' to quit, '/help' for special commands
 			// No tool use, break the loop
 			break
 		}
+		stop()
 
 		fmt.Println()
 	}
+
+	return 0
 }
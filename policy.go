@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Policy actions, from the weakest to the strongest
+const (
+	policyAllow = "allow" // run without asking
+	policyAsk   = "ask"   // ask the user, whatever the approval mode
+	policyDeny  = "deny"  // never run
+)
+
+// PolicyRule is one line of a policy file, such as "deny curl * | sh"
+type PolicyRule struct {
+	Action  string
+	Pattern string
+
+	// Source is the file and line the rule comes from
+	Source string
+
+	// stages are the words of each command in the pattern, which is
+	// a pipeline if there are several
+	stages [][]*regexp.Regexp
+}
+
+// String formats the rule for the user and the model
+func (r *PolicyRule) String() string {
+	return fmt.Sprintf("`%s %s` (%s)", r.Action, r.Pattern, r.Source)
+}
+
+// Policy decides which bash commands may run. It parses each command
+// with a shell parser and checks every simple command in it, including
+// those in pipelines, lists, subshells and command substitutions, so
+// that an allowed command cannot carry a denied one.
+type Policy struct {
+	Rules []*PolicyRule
+}
+
+// PolicyDecision is what a policy says about a command
+type PolicyDecision struct {
+	// Action is policyAllow, policyAsk or policyDeny, or empty if no
+	// rule decides the command
+	Action string
+
+	// Rules are the rules behind the decision: the rule that denies
+	// or asks, or the rules that allow every part of the command
+	Rules []*PolicyRule
+
+	// Match is the part of the command that a deny or ask rule
+	// matched
+	Match string
+}
+
+// PolicyError reports that a policy rule denied a command
+type PolicyError struct {
+	Rule  *PolicyRule
+	Match string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("policy rule %v denies %q", e.Rule, e.Match)
+}
+
+// LoadPolicy reads a policy file. Each line holds an action, allow, ask
+// or deny, followed by a command pattern; blank lines and lines
+// starting with # are ignored.
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := &Policy{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, pattern, _ := strings.Cut(line, " ")
+		source := fmt.Sprintf("%s:%d", filename, n)
+		rule, err := newPolicyRule(action, strings.TrimSpace(pattern), source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, scanner.Err()
+}
+
+// newPolicyRule parses the pattern of a rule. A pattern is a command or
+// a pipeline of commands whose words may contain * wildcards; a final
+// * word stands for any remaining arguments.
+func newPolicyRule(action, pattern, source string) (*PolicyRule, error) {
+	switch action {
+	case policyAllow, policyAsk, policyDeny:
+	default:
+		return nil, fmt.Errorf("unknown action %q (want allow, ask or deny)", action)
+	}
+	file, err := parseShell(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if len(file.Stmts) != 1 {
+		return nil, fmt.Errorf("pattern %q must be a single command or pipeline", pattern)
+	}
+
+	rule := &PolicyRule{Action: action, Pattern: pattern, Source: source}
+	for _, stage := range pipelineStages(file.Stmts[0]) {
+		call, ok := stage.Cmd.(*syntax.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return nil, fmt.Errorf("pattern %q must be a single command or pipeline", pattern)
+		}
+		var words []*regexp.Regexp
+		for _, word := range call.Args {
+			literal, ok := literalWord(word)
+			if !ok {
+				return nil, fmt.Errorf("pattern %q may only hold plain words", pattern)
+			}
+			words = append(words, globRegexp(literal))
+		}
+		rule.stages = append(rule.stages, words)
+	}
+	return rule, nil
+}
+
+// globRegexp compiles a word with * wildcards, which match any text
+func globRegexp(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// parseShell parses a bash script
+func parseShell(script string) (*syntax.File, error) {
+	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
+	return parser.Parse(strings.NewReader(script), "")
+}
+
+// pipelineStages returns the commands of a pipeline, or stmt itself if
+// it is not a pipeline
+func pipelineStages(stmt *syntax.Stmt) []*syntax.Stmt {
+	if pipe, ok := stmt.Cmd.(*syntax.BinaryCmd); ok && !stmt.Negated &&
+		(pipe.Op == syntax.Pipe || pipe.Op == syntax.PipeAll) {
+		return append(pipelineStages(pipe.X), pipelineStages(pipe.Y)...)
+	}
+	return []*syntax.Stmt{stmt}
+}
+
+// literalWord returns the value of a word without expansions, with its
+// quotes removed
+func literalWord(word *syntax.Word) (string, bool) {
+	var b strings.Builder
+	for _, part := range word.Parts {
+		switch part := part.(type) {
+		case *syntax.Lit:
+			b.WriteString(unescapeLiteral(part.Value))
+		case *syntax.SglQuoted:
+			if part.Dollar {
+				b.WriteString(unescapeANSIC(part.Value))
+			} else {
+				b.WriteString(part.Value)
+			}
+		case *syntax.DblQuoted:
+			if part.Dollar {
+				// $"..." is translated by the locale when it runs
+				return "", false
+			}
+			for _, inner := range part.Parts {
+				lit, ok := inner.(*syntax.Lit)
+				if !ok {
+					return "", false
+				}
+				b.WriteString(lit.Value)
+			}
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+// ansiCEscapes are the single-character escapes of $'...' strings
+var ansiCEscapes = map[byte]byte{
+	'a': '\a', 'b': '\b', 'e': 0x1b, 'E': 0x1b, 'f': '\f', 'n': '\n',
+	'r': '\r', 't': '\t', 'v': '\v', '\\': '\\', '\'': '\'', '"': '"', '?': '?',
+}
+
+// unescapeANSIC decodes the escapes of a $'...' string as bash does,
+// so that $'\x72m' is checked as rm. Like bash, it ends the string at
+// a NUL.
+func unescapeANSIC(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		c := s[i]
+		if e, ok := ansiCEscapes[c]; ok {
+			b.WriteByte(e)
+			continue
+		}
+
+		var n uint64
+		switch c {
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			digits := prefixDigits(s[i:], 3, 8)
+			n, _ = strconv.ParseUint(digits, 8, 32)
+			i += len(digits) - 1
+			n &= 0xff
+		case 'x', 'u', 'U':
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+			digits := prefixDigits(s[i+1:], size, 16)
+			if digits == "" {
+				b.WriteString(s[i-1 : i+1])
+				continue
+			}
+			n, _ = strconv.ParseUint(digits, 16, 32)
+			i += len(digits)
+			if c != 'x' && n != 0 {
+				b.WriteRune(rune(n))
+				continue
+			}
+		case 'c':
+			if i+1 == len(s) {
+				b.WriteString(s[i-1:])
+				continue
+			}
+			i++
+			n = uint64(s[i] & 0x1f)
+		default:
+			b.WriteString(s[i-1 : i+1])
+			continue
+		}
+		if n == 0 {
+			break
+		}
+		b.WriteByte(byte(n))
+	}
+	return b.String()
+}
+
+// prefixDigits returns the up to max digits in base that s starts with
+func prefixDigits(s string, max, base int) string {
+	n := 0
+	for n < len(s) && n < max {
+		if _, err := strconv.ParseUint(s[n:n+1], base, 8); err != nil {
+			break
+		}
+		n++
+	}
+	return s[:n]
+}
+
+// unescapeLiteral removes the backslashes from an unquoted word
+func unescapeLiteral(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// wordText returns the value of a literal word, or the source of a word
+// with expansions
+func wordText(word *syntax.Word) string {
+	if literal, ok := literalWord(word); ok {
+		return literal
+	}
+	return nodeSource(word)
+}
+
+// nodeSource prints a node of the syntax tree as shell source
+func nodeSource(node syntax.Node) string {
+	var b strings.Builder
+	syntax.NewPrinter(syntax.SingleLine(true)).Print(&b, node)
+	return strings.TrimSpace(b.String())
+}
+
+// wrapperCommands run the command in their arguments, so a rule for
+// rm must also apply to sudo rm. The value lists the options that take
+// a separate argument.
+var wrapperCommands = map[string][]string{
+	"builtin": nil,
+	"command": nil,
+	"doas":    {"-C", "-u"},
+	"env":     {"-C", "-S", "-u"},
+	"exec":    {"-a"},
+	"nice":    {"-n"},
+	"nohup":   nil,
+	"stdbuf":  {"-e", "-i", "-o"},
+	"sudo":    {"-C", "-D", "-R", "-T", "-U", "-g", "-h", "-p", "-r", "-t", "-u"},
+	"time":    {"-f", "-o"},
+	"timeout": {"-k", "-s"},
+	"xargs":   {"-E", "-I", "-L", "-P", "-a", "-d", "-n", "-s"},
+}
+
+// wrapperArgument matches the arguments of wrappers that come before
+// the command: options, variable assignments, numbers and durations
+var wrapperArgument = regexp.MustCompile(`^(-.*|[A-Za-z_][A-Za-z0-9_]*=.*|[0-9.]+[smhd]?)$`)
+
+// shellCommands run the script given with -c
+var shellCommands = map[string]bool{
+	"bash": true, "dash": true, "ksh": true, "sh": true, "zsh": true,
+}
+
+// Check decides whether command may run. Deny rules win over ask rules,
+// which win over allow rules, and a command is only allowed if every
+// simple command in it is. Commands that cannot be parsed, and commands
+// whose name is only known when they run, such as $cmd, need the
+// user's approval unless a deny rule matches.
+func (p *Policy) Check(command string) PolicyDecision {
+	if p == nil || len(p.Rules) == 0 {
+		return PolicyDecision{}
+	}
+	c := &policyCheck{policy: p, allowed: true}
+	if err := c.script(command, 0); err != nil {
+		return PolicyDecision{Action: policyAsk, Match: command}
+	}
+
+	switch {
+	case c.deny != nil:
+		return PolicyDecision{Action: policyDeny, Rules: []*PolicyRule{c.deny},
+			Match: c.denyMatch}
+	case c.ask != nil:
+		return PolicyDecision{Action: policyAsk, Rules: []*PolicyRule{c.ask},
+			Match: c.askMatch}
+	case c.opaque != "":
+		return PolicyDecision{Action: policyAsk, Match: c.opaque}
+	case c.allowed && len(c.allow) > 0:
+		return PolicyDecision{Action: policyAllow, Rules: c.allow}
+	}
+	return PolicyDecision{}
+}
+
+// maxShellNesting bounds how deep bash -c and eval scripts are checked
+const maxShellNesting = 4
+
+// policyCheck collects the rules that match the parts of a command
+type policyCheck struct {
+	policy *Policy
+
+	deny, ask           *PolicyRule
+	denyMatch, askMatch string
+	allow               []*PolicyRule
+	allowed             bool // every simple command so far is allowed
+
+	// opaque is the first simple command whose name is not a literal
+	// word, which no rule can be checked against
+	opaque string
+}
+
+// script checks every command in a script
+func (c *policyCheck) script(script string, depth int) error {
+	if depth > maxShellNesting {
+		return errors.New("scripts nested too deeply")
+	}
+	file, err := parseShell(script)
+	if err != nil {
+		return err
+	}
+
+	var nested []string
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.Stmt:
+			if stages := pipelineStages(node); len(stages) > 1 {
+				c.pipeline(stages)
+			}
+		case *syntax.CallExpr:
+			if len(node.Args) == 0 {
+				return true
+			}
+			words := make([]string, len(node.Args))
+			literal := make([]bool, len(node.Args))
+			for i, word := range node.Args {
+				words[i] = wordText(word)
+				_, literal[i] = literalWord(word)
+			}
+			c.command(words, literal, nodeSource(node))
+			nested = append(nested, nestedScripts(node.Args)...)
+		}
+		return true
+	})
+
+	for _, script := range nested {
+		if err := c.script(script, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nestedScripts returns the scripts that a command runs through a shell
+// or eval, if they are literal
+func nestedScripts(args []*syntax.Word) []string {
+	name, ok := literalWord(args[0])
+	if !ok {
+		return nil
+	}
+	name = path.Base(name)
+	if name == "eval" {
+		var words []string
+		for _, arg := range args[1:] {
+			if literal, ok := literalWord(arg); ok {
+				words = append(words, literal)
+			}
+		}
+		return []string{strings.Join(words, " ")}
+	}
+	if shellCommands[name] && len(args) > 2 {
+		for i, arg := range args[1 : len(args)-1] {
+			if literal, _ := literalWord(arg); literal == "-c" {
+				if script, ok := literalWord(args[i+2]); ok {
+					return []string{script}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// command checks a simple command, given as its words and whether each
+// of them is literal
+func (c *policyCheck) command(words []string, literal []bool, source string) {
+	allowed := false
+	for _, candidate := range unwrapCommand(words) {
+		// The candidates are tails of words
+		if !literal[len(words)-len(candidate)] && c.opaque == "" {
+			c.opaque = source
+		}
+		for _, rule := range c.policy.Rules {
+			if len(rule.stages) != 1 || !matchWords(rule.stages[0], candidate) {
+				continue
+			}
+			switch rule.Action {
+			case policyDeny:
+				if c.deny == nil {
+					c.deny, c.denyMatch = rule, source
+				}
+			case policyAsk:
+				if c.ask == nil {
+					c.ask, c.askMatch = rule, source
+				}
+			case policyAllow:
+				allowed = true
+				if !slices.Contains(c.allow, rule) {
+					c.allow = append(c.allow, rule)
+				}
+			}
+		}
+	}
+	c.allowed = c.allowed && allowed
+}
+
+// pipeline checks the pipeline rules against a pipeline
+func (c *policyCheck) pipeline(stages []*syntax.Stmt) {
+	commands := make([][]string, len(stages))
+	for i, stage := range stages {
+		if call, ok := stage.Cmd.(*syntax.CallExpr); ok {
+			for _, word := range call.Args {
+				commands[i] = append(commands[i], wordText(word))
+			}
+		}
+	}
+
+	for _, rule := range c.policy.Rules {
+		if len(rule.stages) < 2 || rule.Action == policyAllow {
+			continue
+		}
+		for start := 0; start+len(rule.stages) <= len(commands); start++ {
+			if !matchPipeline(rule.stages, commands[start:]) {
+				continue
+			}
+			source := nodeSource(stages[start])
+			for _, stage := range stages[start+1 : start+len(rule.stages)] {
+				source += " | " + nodeSource(stage)
+			}
+			if rule.Action == policyDeny && c.deny == nil {
+				c.deny, c.denyMatch = rule, source
+			} else if rule.Action == policyAsk && c.ask == nil {
+				c.ask, c.askMatch = rule, source
+			}
+		}
+	}
+}
+
+// matchPipeline reports whether the commands start with the stages of
+// a pipeline pattern
+func matchPipeline(stages [][]*regexp.Regexp, commands [][]string) bool {
+	for i, stage := range stages {
+		matched := false
+		for _, candidate := range unwrapCommand(commands[i]) {
+			matched = matched || matchWords(stage, candidate)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapCommand returns the command and, if it runs another command
+// through a wrapper such as sudo or env, that command too
+func unwrapCommand(words []string) [][]string {
+	candidates := [][]string{words}
+	for len(words) > 0 {
+		withArgument, ok := wrapperCommands[path.Base(words[0])]
+		if !ok {
+			break
+		}
+		words = words[1:]
+		for len(words) > 0 && wrapperArgument.MatchString(words[0]) {
+			if slices.Contains(withArgument, words[0]) {
+				words = words[1:]
+			}
+			words = words[min(1, len(words)):]
+		}
+		if len(words) > 0 {
+			candidates = append(candidates, words)
+		}
+	}
+	return candidates
+}
+
+// matchWords reports whether the words of a command match a pattern.
+// The command name also matches by its base name, so that a rule for rm
+// covers /bin/rm.
+func matchWords(pattern []*regexp.Regexp, words []string) bool {
+	n := len(pattern)
+	rest := n > 0 && pattern[n-1].String() == "^.*$"
+	if rest {
+		n--
+		if len(words) < n {
+			return false
+		}
+	} else if len(words) != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if !pattern[i].MatchString(words[i]) &&
+			(i > 0 || !pattern[i].MatchString(path.Base(words[i]))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Platforms without rlimits have no signals for exceeding them
+const (
+	sigCPULimit      = syscall.Signal(-1)
+	sigFileSizeLimit = syscall.Signal(-1)
+)
+
+// setProcessGroup is a no-op on platforms without process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process started by cmd. Processes that it
+// started are not killed on platforms without process groups.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Signals that kill a process that exceeds its CPU time or file size
+// limit
+const (
+	sigCPULimit      = syscall.SIGXCPU
+	sigFileSizeLimit = syscall.SIGXFSZ
+)
+
+// setProcessGroup makes cmd the leader of a new process group, so that
+// the command and everything it starts can be killed together
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group led by cmd
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
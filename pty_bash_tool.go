@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Size of the session's terminal. It is wide so that programs do not
+// wrap lines that the model then has to piece together.
+const (
+	ptyRows = 50
+	ptyCols = 200
+)
+
+// inputIdleDelay is how long a command must go quiet after printing a
+// partial line before it is considered to be waiting for input
+const inputIdleDelay = 1500 * time.Millisecond
+
+// InputWaitError is returned by PtyBashTool when a command is still
+// running and appears to wait for input after printing Prompt. The next
+// call to ExecuteCommand types its command into the waiting program.
+type InputWaitError struct {
+	Prompt string
+}
+
+func (e *InputWaitError) Error() string {
+	return fmt.Sprintf("command is waiting for input after %q", e.Prompt)
+}
+
+// PtyBashTool maintains a persistent bash session under a pseudo-
+// terminal, so that programs behave as they would for a user: they see
+// a terminal, can prompt for input and can read passwords. Standard
+// out and standard error are merged, as they are on a terminal, and
+// returned as stdout with escape sequences removed.
+type PtyBashTool struct {
+	cmd   *exec.Cmd
+	pty   *os.File
+	mutex sync.Mutex
+
+	// output receives what is written to the terminal. It is closed
+	// when the terminal is closed.
+	output chan []byte
+
+	// exited is closed once the bash process has exited
+	exited chan struct{}
+
+	// waiting holds the output of a command that waits for input, or
+	// is nil if no command is running. reported is how much of that
+	// output has already been returned.
+	waiting  *markerScanner
+	reported int
+
+	// cwd is the working directory after the last command
+	cwd string
+
+	// Timeout is how long a command may run before it is interrupted.
+	// Zero disables the timeout.
+	Timeout time.Duration
+
+	// Echo, if not nil, receives what the command writes to the
+	// terminal as it arrives
+	Echo io.Writer
+
+	// Limits caps the resources of every process in the session
+	Limits ResourceLimits
+
+	// Sandbox, if not nil, confines the session
+	Sandbox *Sandbox
+
+	// Env controls the environment of the session
+	Env *Environment
+}
+
+// NewPtyBashTool creates a new PtyBashTool instance and starts a bash
+// session.
+func NewPtyBashTool() *PtyBashTool {
+	tool := &PtyBashTool{Timeout: defaultCommandTimeout}
+	tool.startSession()
+	return tool
+}
+
+// startSession starts a new bash process on a new terminal and waits
+// for it to be ready for commands.
+func (s *PtyBashTool) startSession() error {
+	s.stopSession()
+
+	// An interactive shell runs commands as it reads them from the
+	// terminal. Without prompts and line editing, the terminal only
+	// carries what the commands write.
+	args := s.Limits.wrap("bash", "--noediting", "--noprofile", "--norc", "-i")
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(s.Env.Environ(), "PS1=", "PS2=", "PAGER=cat",
+		"GIT_PAGER=cat")
+	if !slices.ContainsFunc(cmd.Env, func(v string) bool {
+		return strings.HasPrefix(v, "TERM=")
+	}) {
+		cmd.Env = append(cmd.Env, "TERM=xterm")
+	}
+	if err := s.Sandbox.apply(cmd); err != nil {
+		return err
+	}
+
+	// The terminal makes bash a session leader, so interrupting a
+	// command with ^C reaches the command and its children
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: ptyRows, Cols: ptyCols})
+	if err != nil {
+		return err
+	}
+	s.cmd, s.pty = cmd, ptmx
+	s.waiting, s.reported, s.cwd = nil, 0, ""
+
+	output := make(chan []byte, 64)
+	s.output = output
+	go func() {
+		defer close(output)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := ptmx.Read(buf)
+			if n > 0 {
+				output <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	exited := make(chan struct{})
+	s.exited = exited
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	// Turn off the terminal's echo of the input, history expansion
+	// and job control messages, and skip bash's startup output
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, _, err = s.run(ctx, "stty -echo; set +H +m", io.Discard)
+	if err != nil {
+		s.stopSession()
+		return fmt.Errorf("failed to set up terminal: %w", err)
+	}
+	return nil
+}
+
+// running reports whether the bash process is still alive
+func (s *PtyBashTool) running() bool {
+	if s.cmd == nil {
+		return false
+	}
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stopSession terminates the bash process and closes the terminal.
+func (s *PtyBashTool) stopSession() {
+	if s.cmd == nil {
+		return
+	}
+	killProcessGroup(s.cmd)
+	s.cmd.Process.Kill()
+	<-s.exited
+	s.pty.Close()
+	for range s.output {
+	}
+	s.cmd, s.waiting = nil, nil
+}
+
+// Cwd returns the working directory of the session after the last
+// command, or the empty string if no command has completed yet
+func (s *PtyBashTool) Cwd() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cwd
+}
+
+// ExecuteCommand runs the given command in the terminal session and
+// returns what it wrote to the terminal as stdout. If the command waits
+// for input, it is left running and err is an *InputWaitError; the next
+// call then types its command, followed by Enter, into the command
+// rather than running it. "^C" and "^D" are typed as control
+// characters, which interrupt the command or end its input. If ctx is
+// cancelled or the command times out, the command is interrupted with
+// ^C, and the session is restarted if that does not stop it.
+func (s *PtyBashTool) ExecuteCommand(ctx context.Context, command string) (stdout string, stderr string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ctx, cancel := commandContext(ctx, s.Timeout)
+	defer cancel()
+
+	if s.waiting != nil && s.running() {
+		if _, err := io.WriteString(s.pty, keystrokes(command)); err != nil {
+			return "", "", fmt.Errorf("failed to send input: %w", err)
+		}
+		return s.wait(ctx)
+	}
+
+	stdout, stderr, err = checkBashCommand(command)
+	if err != nil {
+		return stdout, stderr, err
+	}
+
+	if !s.running() {
+		if err := s.startSession(); err != nil {
+			return "", "", fmt.Errorf("failed to start bash session: %w", err)
+		}
+	}
+	return s.run(ctx, command, s.echo())
+}
+
+// keystrokes returns what to type for input to a waiting command
+func keystrokes(input string) string {
+	switch input {
+	case "^C":
+		return "\x03"
+	case "^D":
+		return "\x04"
+	}
+	return input + "\r"
+}
+
+// ptyInput returns the line that runs command in the terminal session
+// and prints the end marker for nonce. Unlike in sessionInput, the
+// command keeps the terminal as its standard input.
+func ptyInput(command, nonce string) string {
+	return fmt.Sprintf("eval %s; printf '%s%%s %%d %%s\\n' %s \"$?\" \"$PWD\"\n",
+		ansiCQuote(command), markerPrefix, nonce)
+}
+
+// run sends command to the session and waits for it
+func (s *PtyBashTool) run(ctx context.Context, command string, echo io.Writer) (stdout string, stderr string, err error) {
+	// Drop output that background processes wrote between commands
+	for drained := false; !drained; {
+		select {
+		case <-s.output:
+		default:
+			drained = true
+		}
+	}
+
+	nonce := newNonce()
+	s.waiting = newMarkerScanner(markerPrefix+nonce, echo)
+	s.reported = 0
+	if _, err := io.WriteString(s.pty, ptyInput(command, nonce)); err != nil {
+		s.stopSession()
+		return "", "", fmt.Errorf("failed to write command: %w", err)
+	}
+	return s.wait(ctx)
+}
+
+// echo returns the writer to echo terminal output to
+func (s *PtyBashTool) echo() io.Writer {
+	if s.Echo == nil {
+		return io.Discard
+	}
+	return s.Echo
+}
+
+// wait reads the running command's output until it finishes, waits
+// for input or is interrupted
+func (s *PtyBashTool) wait(ctx context.Context) (stdout string, stderr string, err error) {
+	idle := time.NewTimer(inputIdleDelay)
+	defer idle.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				return s.finish()
+			}
+			if s.waiting.feed(chunk) {
+				return s.finish()
+			}
+			idle.Reset(inputIdleDelay)
+		case <-idle.C:
+			pending := s.waiting.pending()
+			if strings.HasSuffix(pending, "\n") {
+				// Still working, just quiet
+				continue
+			}
+			if prompt := lastLine(pending); prompt != "" {
+				output := s.unreported(pending)
+				return output, "", &InputWaitError{Prompt: prompt}
+			}
+		case <-ctx.Done():
+			return s.interrupt(ctx)
+		case <-s.exited:
+			// The command exited the shell. Its output ends when the
+			// terminal closes, unless a background process holds it.
+			timeout := time.After(killWaitDelay)
+			for open := true; open; {
+				select {
+				case chunk, ok := <-s.output:
+					open = ok
+					s.waiting.feed(chunk)
+				case <-timeout:
+					open = false
+				}
+			}
+			return s.finish()
+		}
+	}
+}
+
+// unreported returns the part of output that has not been returned yet
+// and marks it as returned
+func (s *PtyBashTool) unreported(output string) string {
+	output = output[min(s.reported, len(output)):]
+	s.reported += len(output)
+	return cleanTerminalOutput(output)
+}
+
+// finish returns the result of the command once its marker was read or
+// the session ended
+func (s *PtyBashTool) finish() (stdout string, stderr string, err error) {
+	result := s.waiting.result()
+	s.waiting = nil
+	stdout = s.unreported(result.output)
+	if len(result.output) > 0 && !strings.HasSuffix(result.output, "\n") {
+		// Keep the user's terminal tidy after a final partial line
+		io.WriteString(s.echo(), "\n")
+	}
+
+	if !result.found {
+		// The command ran exit or exec, or bash was killed
+		s.stopSession()
+		return stdout, "", fmt.Errorf("bash session ended; a new " +
+			"session will be started for the next command")
+	}
+
+	status, cwd, err := parseStatusTrailer(result.trailer)
+	if err != nil {
+		return stdout, "", err
+	}
+	s.cwd = cwd
+	return stdout, "", s.Limits.check(stdout, shellExitError(status))
+}
+
+// interrupt stops the running command with ^C, as a user would. If the
+// session does not respond, it is restarted.
+func (s *PtyBashTool) interrupt(ctx context.Context) (stdout string, stderr string, err error) {
+	cause := interruptedError(ctx)
+
+	// The interrupt also discards the rest of the command line, so the
+	// session is asked for a new marker
+	previous := s.waiting.result().output
+	nonce := newNonce()
+	scanner := newMarkerScanner(markerPrefix+nonce, s.echo())
+	s.waiting = nil
+	_, err = io.WriteString(s.pty, "\x03")
+	if err == nil {
+		// Give the shell a moment to handle the interrupt before it
+		// reads the marker line
+		time.Sleep(100 * time.Millisecond)
+		_, err = io.WriteString(s.pty, ptyInput("", nonce))
+	}
+
+	timeout := time.NewTimer(2 * killWaitDelay)
+	defer timeout.Stop()
+	for err == nil {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				err = io.EOF
+			} else if scanner.feed(chunk) {
+				result := scanner.result()
+				if _, cwd, err := parseStatusTrailer(result.trailer); err == nil {
+					s.cwd = cwd
+				}
+				// Bash starts a new line after the interrupt
+				after := strings.TrimPrefix(result.output, "\r\n")
+				after = strings.TrimPrefix(after, "\n")
+				return s.unreported(previous + after), "", cause
+			}
+		case <-timeout.C:
+			err = errors.New("no response to interrupt")
+		}
+	}
+
+	s.stopSession()
+	return s.unreported(previous), "", fmt.Errorf(
+		"%w; the bash session was restarted", cause)
+}
+
+// Restart terminates the current bash session and starts a new one.
+// This clears all session state (environment variables, current directory, etc.).
+func (s *PtyBashTool) Restart() (message string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.startSession(); err != nil {
+		return "", fmt.Errorf("failed to restart bash session: %w", err)
+	}
+	return "Terminal bash session restarted", nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPtyBashTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	tool := NewPtyBashTool()
+	if !tool.running() {
+		t.Fatal("NewPtyBashTool() did not start a session")
+	}
+	defer tool.stopSession()
+
+	// Verify it implements the BashTool interface
+	var _ BashTool = tool
+
+	tests := []struct {
+		name           string
+		command        string
+		expectedStdout string
+		shouldError    bool
+	}{
+		{
+			name:           "BasicEcho",
+			command:        "echo 'hello world'",
+			expectedStdout: "hello world\n",
+		},
+		{
+			name:        "CommandWithError",
+			command:     "false",
+			shouldError: true,
+		},
+		{
+			name:        "SyntaxError",
+			command:     "if [ 1 == ",
+			shouldError: true,
+		},
+		{
+			// Standard error goes to the terminal too
+			name:           "StdoutAndStderr",
+			command:        "echo 'stdout'; echo 'stderr' >&2",
+			expectedStdout: "stdout\nstderr\n",
+		},
+		{
+			name:           "Terminal",
+			command:        "[ -t 0 ] && [ -t 1 ] && echo tty",
+			expectedStdout: "tty\n",
+		},
+		{
+			name:           "Colors",
+			command:        `printf '\033[1;31mred\033[0m\n'`,
+			expectedStdout: "red\n",
+		},
+		{
+			name:           "ProgressBar",
+			command:        `printf '10%%\r50%%\r100%%\n'`,
+			expectedStdout: "100%\n",
+		},
+		{
+			name:           "MultiLine",
+			command:        "for i in 1 2; do\n  echo \"line $i\"\ndone",
+			expectedStdout: "line 1\nline 2\n",
+		},
+		{
+			name:           "HistoryExpansion",
+			command:        "echo 'hi!'",
+			expectedStdout: "hi!\n",
+		},
+		{
+			name:           "NoTrailingNewline",
+			command:        "printf partial",
+			expectedStdout: "partial",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := tool.ExecuteCommand(context.Background(), tt.command)
+
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("command %q should have failed", tt.command)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("command %q failed: %v", tt.command, err)
+			}
+			if stdout != tt.expectedStdout {
+				t.Errorf("stdout mismatch for %q: expected %q, got %q", tt.command, tt.expectedStdout, stdout)
+			}
+		})
+	}
+
+	t.Run("StatePersistence", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, _, err := tool.ExecuteCommand(context.Background(),
+			"export PTY_TEST=kept; cd "+dir); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo $PTY_TEST")
+		if err != nil || stdout != "kept\n" {
+			t.Errorf("echo $PTY_TEST = %q, %v, want %q", stdout, err, "kept\n")
+		}
+		if got := tool.Cwd(); got != dir {
+			t.Errorf("expected cwd %q, got %q", dir, got)
+		}
+	})
+
+	t.Run("InputWait", func(t *testing.T) {
+		stdout, _, err := tool.ExecuteCommand(context.Background(),
+			`echo start; read -p "Name? " name; echo "hello $name"`)
+		var waitErr *InputWaitError
+		if !errors.As(err, &waitErr) {
+			t.Fatalf("expected *InputWaitError, got %v", err)
+		}
+		if waitErr.Prompt != "Name?" {
+			t.Errorf("expected prompt %q, got %q", "Name?", waitErr.Prompt)
+		}
+		if stdout != "start\nName? " {
+			t.Errorf("expected output %q, got %q", "start\nName? ", stdout)
+		}
+
+		// The next command is the answer
+		stdout, _, err = tool.ExecuteCommand(context.Background(), "gollum")
+		if err != nil || stdout != "hello gollum\n" {
+			t.Errorf("reply = %q, %v, want %q", stdout, err, "hello gollum\n")
+		}
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		_, _, err := tool.ExecuteCommand(context.Background(),
+			`read -s -p "Password: " pw; echo; echo "${#pw} chars"`)
+		var waitErr *InputWaitError
+		if !errors.As(err, &waitErr) {
+			t.Fatalf("expected *InputWaitError, got %v", err)
+		}
+
+		// The secret is not echoed back
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "hunter2")
+		if err != nil || stdout != "\n7 chars\n" {
+			t.Errorf("reply = %q, %v, want %q", stdout, err, "\n7 chars\n")
+		}
+	})
+
+	t.Run("ControlKeys", func(t *testing.T) {
+		_, _, err := tool.ExecuteCommand(context.Background(),
+			`printf 'Text: '; cat; echo "status $?"`)
+		var waitErr *InputWaitError
+		if !errors.As(err, &waitErr) {
+			t.Fatalf("expected *InputWaitError, got %v", err)
+		}
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "^D")
+		if err != nil || stdout != "status 0\n" {
+			t.Errorf("reply ^D = %q, %v, want %q", stdout, err, "status 0\n")
+		}
+	})
+
+	t.Run("Interrupt", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		stdout, _, err := tool.ExecuteCommand(ctx,
+			"export PTY_TEST=survived; echo started; sleep 30; echo finished")
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("interrupted command took %v to return", elapsed)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled error, got %v", err)
+		}
+		if stdout != "started\n" {
+			t.Errorf("expected partial output %q, got %q", "started\n", stdout)
+		}
+
+		// ^C stops the command but keeps the session
+		stdout, _, err = tool.ExecuteCommand(context.Background(), "echo $PTY_TEST")
+		if err != nil || stdout != "survived\n" {
+			t.Errorf("command after interrupt = %q, %v", stdout, err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ctx := WithCommandTimeout(context.Background(), 300*time.Millisecond)
+		_, _, err := tool.ExecuteCommand(ctx, "sleep 30")
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("expected *TimeoutError, got %v", err)
+		}
+	})
+
+	t.Run("Exit", func(t *testing.T) {
+		_, _, err := tool.ExecuteCommand(context.Background(), "exit 3")
+		if err == nil || !strings.Contains(err.Error(), "bash session ended") {
+			t.Errorf("expected session ended error, got %v", err)
+		}
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo 'new session'")
+		if err != nil || stdout != "new session\n" {
+			t.Errorf("command after exit = %q, %v", stdout, err)
+		}
+	})
+
+	t.Run("RestartFunctionality", func(t *testing.T) {
+		if msg, err := tool.Restart(); err != nil || msg != "Terminal bash session restarted" {
+			t.Errorf("Restart() = %q, %v", msg, err)
+		}
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo ${PTY_TEST:-unset}")
+		if err != nil || stdout != "unset\n" {
+			t.Errorf("command after restart = %q, %v", stdout, err)
+		}
+	})
+}
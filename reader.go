@@ -12,19 +12,30 @@ import (
 // CommandHandler is a function type for handling special commands
 type CommandHandler func(w io.Writer) error
 
+// ArgsCommandHandler is a function type for handling special commands
+// that take arguments. args holds the whitespace-separated words that
+// followed the command name.
+type ArgsCommandHandler func(w io.Writer, args []string) error
+
 // command represents a command with its metadata and handler
 type command struct {
 	Name        string
+	Usage       string
 	Description string
 	Handler     CommandHandler
+	ArgsHandler ArgsCommandHandler
 }
 
 // Reader encapsulates readline functionality for user input handling
 type Reader struct {
-	rl       *readline.Instance
-	cmds map[string]command // Map of command name to command struct
+	rl      *readline.Instance
+	cmds    map[string]command // Map of command name to command struct
+	prefill string             // Text to pre-fill the next prompt with
 }
 
+// inputPrompt is the prompt for the user's messages
+const inputPrompt = "~~> "
+
 // completer starts empty and is populated dynamically based on registered command handlers
 var completer = readline.NewPrefixCompleter()
 
@@ -78,7 +89,7 @@ func filterInput(r rune) (rune, bool) {
 func NewReader() (*Reader, error) {
 	// Create readline instance with history and editing support
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:          "~~> ",
+		Prompt:          inputPrompt,
 		HistoryFile:     ".gollum_history",
 		AutoComplete:    completer,
 		InterruptPrompt: "^C",
@@ -92,7 +103,7 @@ func NewReader() (*Reader, error) {
 	}
 
 	handler := &Reader{
-		rl:       rl,
+		rl:   rl,
 		cmds: make(map[string]command),
 	}
 
@@ -123,7 +134,26 @@ func (r *Reader) RegisterCommand(commandName string, description string, handler
 		Description: description,
 		Handler:     handler,
 	}
-	
+
+	r.updateAutoComplete()
+}
+
+// RegisterCommandWithArgs registers a handler for a special command
+// that takes arguments. usage describes the arguments for the help
+// text, e.g. "[md|html] <file>".
+func (r *Reader) RegisterCommandWithArgs(commandName, usage,
+	description string, handler ArgsCommandHandler) {
+	lowercaseName := strings.ToLower(commandName)
+	r.cmds[lowercaseName] = command{
+		Name:        lowercaseName,
+		Usage:       usage,
+		Description: description,
+		Handler: func(w io.Writer) error {
+			return handler(w, nil)
+		},
+		ArgsHandler: handler,
+	}
+
 	r.updateAutoComplete()
 }
 
@@ -184,6 +214,9 @@ func (r *Reader) generateHelp(w io.Writer) error {
 	// Display registered commands with their descriptions
 	for _, cmdName := range commands {
 		if cmd, exists := r.cmds[cmdName]; exists {
+			if cmd.Usage != "" {
+				cmdName += " " + cmd.Usage
+			}
 			fmt.Fprintf(w, "  /%-12s\t- %s\n", cmdName, cmd.Description)
 		} else {
 			// Fallback for commands without descriptions (shouldn't happen)
@@ -200,6 +233,12 @@ func (r *Reader) generateHelp(w io.Writer) error {
 	return nil
 }
 
+// Prefill sets text that the next prompt starts out with, so that the
+// user can edit it before sending it
+func (r *Reader) Prefill(text string) {
+	r.prefill = text
+}
+
 // UserInput reads input from the user and processes any special commands
 // Returns:
 // - userInput: the input to process (never empty unless error)
@@ -207,7 +246,8 @@ func (r *Reader) generateHelp(w io.Writer) error {
 func (r *Reader) UserInput() (userInput string, err error) {
 	for {
 		// Read input from user
-		input, err := r.rl.Readline()
+		input, err := r.rl.ReadlineWithDefault(r.prefill)
+		r.prefill = ""
 		if err == readline.ErrInterrupt {
 			continue
 		} else if err != nil {
@@ -216,7 +256,7 @@ func (r *Reader) UserInput() (userInput string, err error) {
 
 		// Trim whitespace from input
 		input = strings.TrimSpace(input)
-		
+
 		// Check if it's a special command
 		if isSpecialCommand(input) {
 			// Process the input (handle special commands)
@@ -238,11 +278,19 @@ func isSpecialCommand(input string) bool {
 // handleSpecialCommand processes input and handles special commands
 // Returns an error if command processing fails including io.EOF for exit
 func (r *Reader) handleSpecialCommand(input string) error {
-	// Remove the '/' prefix and convert to lowercase
-	commandName := strings.ToLower(strings.TrimPrefix(input, "/"))
+	// Split off any arguments, remove the '/' prefix and convert to
+	// lowercase
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	commandName := ""
+	if len(fields) > 0 {
+		commandName = strings.ToLower(fields[0])
+	}
 
 	// Look up the handler for this command
 	if cmd, exists := r.cmds[commandName]; exists {
+		if cmd.ArgsHandler != nil {
+			return cmd.ArgsHandler(os.Stdout, fields[1:])
+		}
 		return cmd.Handler(os.Stdout)
 	}
 
@@ -250,3 +298,30 @@ func (r *Reader) handleSpecialCommand(input string) error {
 	fmt.Printf("Unknown command: %s\nType '/help' to see available commands.\n", input)
 	return nil
 }
+
+// Prompt asks the user a one-off question outside the conversation,
+// such as the answer to a prompt of a running command. If secret is
+// set, the answer is not shown as it is typed. The answer is not added
+// to the history.
+func (r *Reader) Prompt(prompt string, secret bool) (string, error) {
+	if secret {
+		answer, err := r.rl.ReadPassword(prompt)
+		return string(answer), err
+	}
+
+	r.rl.HistoryDisable()
+	defer r.rl.HistoryEnable()
+	r.rl.SetPrompt(prompt)
+	defer r.rl.SetPrompt(inputPrompt)
+	return r.rl.Readline()
+}
+
+// Edit lets the user edit text, such as a command before it runs. The
+// result is not added to the history.
+func (r *Reader) Edit(prompt, text string) (string, error) {
+	r.rl.HistoryDisable()
+	defer r.rl.HistoryEnable()
+	r.rl.SetPrompt(prompt)
+	defer r.rl.SetPrompt(inputPrompt)
+	return r.rl.ReadlineWithDefault(text)
+}
@@ -226,3 +226,42 @@ func TestBuiltinCommandsArrayUsage(t *testing.T) {
 	}
 }
 
+func TestCommandWithArgs(t *testing.T) {
+	reader, err := NewReader()
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	var gotArgs []string
+	reader.RegisterCommandWithArgs("echo", "<words>", "Echo the arguments", func(w io.Writer, args []string) error {
+		gotArgs = args
+		return nil
+	})
+
+	err = reader.handleSpecialCommand("/Echo  one two")
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if strings.Join(gotArgs, ",") != "one,two" {
+		t.Errorf("Expected args [one two], got %q", gotArgs)
+	}
+
+	// Calling the plain handler passes no arguments
+	gotArgs = []string{"stale"}
+	if err := reader.cmds["echo"].Handler(io.Discard); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if len(gotArgs) != 0 {
+		t.Errorf("Expected no args from plain handler, got %q", gotArgs)
+	}
+
+	// Help shows the usage next to the command name
+	var buf bytes.Buffer
+	if err := reader.generateHelp(&buf); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "/echo <words>") {
+		t.Errorf("Expected help to contain usage, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// secretPattern finds one kind of secret in text. If the expression has
+// a group, only the first group is the secret and the rest is context.
+type secretPattern struct {
+	kind string
+	re   *regexp.Regexp
+
+	// check, if not nil, must accept the secret
+	check func(secret string) bool
+}
+
+// knownSecrets are the secret formats that are always redacted
+var knownSecrets = []secretPattern{
+	{kind: "private-key", re: regexp.MustCompile(
+		`-----BEGIN[A-Z ]*PRIVATE KEY(?: BLOCK)?-----(?s:.*?)(?:-----END[A-Z ]*PRIVATE KEY(?: BLOCK)?-----|\z)`)},
+	// The end of a key whose start was cut off
+	{kind: "private-key", re: regexp.MustCompile(
+		`(?m)(?:^[A-Za-z0-9+/=]{40,}\r?\n)+-----END[A-Z ]*PRIVATE KEY(?: BLOCK)?-----`)},
+	{kind: "aws-access-key", re: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[A-Z0-9]{16}\b`)},
+	{kind: "github-token", re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,255}\b`)},
+	{kind: "github-token", re: regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,255}\b`)},
+	{kind: "gitlab-token", re: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{kind: "slack-token", re: regexp.MustCompile(`\bxox[abeoprs]-[A-Za-z0-9-]{10,}`)},
+	{kind: "anthropic-key", re: regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_-]{20,}`)},
+	{kind: "openai-key", re: regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9_-]{32,}`)},
+	{kind: "stripe-key", re: regexp.MustCompile(`\b[rs]k_(?:live|test)_[A-Za-z0-9]{16,}`)},
+	{kind: "google-api-key", re: regexp.MustCompile(`\bAIza[A-Za-z0-9_-]{35}\b`)},
+	{kind: "jwt", re: regexp.MustCompile(
+		`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{kind: "auth-header", re: regexp.MustCompile(
+		`(?i)\bauthorization:\s*(?:basic|bearer|token)\s+([A-Za-z0-9+/=._~-]{8,})`)},
+	{kind: "url-password", re: regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`)},
+	// Values assigned to names like API_KEY or client_secret, as in
+	// environment variables, config files and git config -l
+	{kind: "secret", re: regexp.MustCompile(
+		`(?i)(?:secret|token|passw(?:or)?d|pwd|api[_-]?key|access[_-]?key|private[_-]?key|credential|auth)` +
+			`[A-Za-z0-9_.-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_.~!@#%^&*-]{12,})`),
+		check: highEntropy},
+}
+
+// placeholderPattern matches the placeholders that secrets are replaced
+// by, which later patterns must leave alone
+var placeholderPattern = regexp.MustCompile(`\[REDACTED:[a-z-]+-[0-9]+\]`)
+
+// minSecretEntropy is the Shannon entropy, in bits per character, that
+// a value next to a word like secret needs to be taken for one
+const minSecretEntropy = 3.0
+
+// highEntropy reports whether s looks random enough to be a secret
+// rather than an identifier or a placeholder: it mixes letters and
+// digits and has high entropy
+func highEntropy(s string) bool {
+	hasLetter := strings.IndexFunc(s, unicode.IsLetter) >= 0
+	hasDigit := strings.IndexFunc(s, unicode.IsDigit) >= 0
+	return hasLetter && hasDigit && entropy(s) >= minSecretEntropy
+}
+
+// entropy returns the Shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	var bits float64
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// Redaction is a secret that was scrubbed from tool output
+type Redaction struct {
+	Placeholder string
+	Kind        string
+
+	// Hint shows the start of the secret, so the user can tell which
+	// one it was
+	Hint string
+
+	// Count is how often the secret was scrubbed
+	Count int
+}
+
+// Redactor replaces secrets in tool output with placeholders before the
+// output is sent to the API. A secret gets the same placeholder every
+// time it is seen, so the model can still tell secrets apart.
+// Placeholders are never turned back into secrets in tool input, since
+// that would let the model send them anywhere.
+type Redactor struct {
+	patterns []secretPattern
+
+	mutex        sync.Mutex
+	placeholders map[string]*Redaction // by secret
+	redactions   []*Redaction          // in the order they were found
+	counts       map[string]int        // secrets by kind
+}
+
+// NewRedactor returns a redactor for the known secret formats
+func NewRedactor() *Redactor {
+	return &Redactor{
+		patterns:     knownSecrets,
+		placeholders: make(map[string]*Redaction),
+		counts:       make(map[string]int),
+	}
+}
+
+// LoadPatterns adds the regular expressions in a file, one per line, to
+// the secrets that are redacted. Blank lines and lines starting with #
+// are ignored. If an expression has a group, only the group is
+// redacted.
+func (r *Redactor) LoadPatterns(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var patterns []secretPattern
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, n, err)
+		}
+		patterns = append(patterns, secretPattern{kind: "custom", re: re})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.patterns = append(patterns, r.patterns...)
+	return nil
+}
+
+// Redact returns text with every secret replaced by its placeholder
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, pattern := range r.patterns {
+		text = r.replace(text, pattern)
+	}
+	return text
+}
+
+// replace replaces the secrets that pattern finds in text
+func (r *Redactor) replace(text string, pattern secretPattern) string {
+	matches := pattern.re.FindAllStringSubmatchIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	placeholders := placeholderPattern.FindAllStringIndex(text, -1)
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) > 2 && match[2] < match[3] {
+			start, end = match[2], match[3]
+		}
+		secret := text[start:end]
+		if pattern.check != nil && !pattern.check(secret) ||
+			overlaps(placeholders, start, end) {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(r.placeholder(pattern.kind, secret))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// overlaps reports whether any of spans overlaps the text from start to
+// end
+func overlaps(spans [][]int, start, end int) bool {
+	for _, span := range spans {
+		if span[0] < end && start < span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholder returns the placeholder for a secret, the same one each
+// time
+func (r *Redactor) placeholder(kind, secret string) string {
+	redaction, ok := r.placeholders[secret]
+	if !ok {
+		r.counts[kind]++
+		redaction = &Redaction{
+			Placeholder: fmt.Sprintf("[REDACTED:%s-%d]", kind, r.counts[kind]),
+			Kind:        kind,
+			Hint:        secretHint(secret),
+		}
+		r.placeholders[secret] = redaction
+		r.redactions = append(r.redactions, redaction)
+	}
+	redaction.Count++
+	return redaction.Placeholder
+}
+
+// secretHint shows a few characters of a secret, enough to recognize it
+func secretHint(secret string) string {
+	first, _, _ := strings.Cut(secret, "\n")
+	runes := []rune(first)
+	if len(runes) > 12 && strings.HasPrefix(first, "-----") {
+		return first
+	}
+	n := min(4, len(runes)/4)
+	return fmt.Sprintf("%s… (%d characters)", string(runes[:n]), len([]rune(secret)))
+}
+
+// RedactResults redacts the text of tool results in place
+func (r *Redactor) RedactResults(results []anthropic.BetaContentBlockParamUnion) {
+	if r == nil {
+		return
+	}
+	for _, result := range results {
+		if result.OfToolResult == nil {
+			continue
+		}
+		for _, content := range result.OfToolResult.Content {
+			if content.OfText != nil {
+				content.OfText.Text = r.Redact(content.OfText.Text)
+			}
+		}
+	}
+}
+
+// Redactions returns the secrets scrubbed so far
+func (r *Redactor) Redactions() []Redaction {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	redactions := make([]Redaction, len(r.redactions))
+	for i, redaction := range r.redactions {
+		redactions[i] = *redaction
+	}
+	return redactions
+}
+
+// PrintRedactions reports the secrets scrubbed in this session
+func (r *Redactor) PrintRedactions(w io.Writer) {
+	if r == nil {
+		fmt.Fprintln(w, "Redaction is off")
+		return
+	}
+	redactions := r.Redactions()
+	if len(redactions) == 0 {
+		fmt.Fprintln(w, "No secrets have been redacted")
+		return
+	}
+	fmt.Fprintf(w, "Secrets redacted from tool output:\n")
+	for _, redaction := range redactions {
+		times := "once"
+		if redaction.Count > 1 {
+			times = fmt.Sprintf("%d times", redaction.Count)
+		}
+		fmt.Fprintf(w, "  %-28s %s, %s\n", redaction.Placeholder,
+			redaction.Hint, times)
+	}
+}
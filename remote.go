@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// RemoteTarget is a directory on a host that Gollum works in over SSH
+type RemoteTarget struct {
+	User string
+	Host string
+	Port string
+
+	// Dir is the working directory, or empty for the user's home
+	// directory
+	Dir string
+}
+
+// parseRemoteTarget parses a target of the form
+// [user@]host[:port][:/dir]
+func parseRemoteTarget(s string) (RemoteTarget, error) {
+	var target RemoteTarget
+	if i := strings.Index(s, ":/"); i >= 0 {
+		s, target.Dir = s[:i], path.Clean(s[i+1:])
+	}
+	if user, host, ok := strings.Cut(s, "@"); ok {
+		target.User, s = user, host
+	}
+	if host, port, ok := strings.Cut(s, ":"); ok {
+		if port == "" || strings.Trim(port, "0123456789") != "" {
+			return RemoteTarget{}, fmt.Errorf("invalid port %q", port)
+		}
+		s, target.Port = host, port
+	}
+	target.Host = s
+	if target.Host == "" {
+		return RemoteTarget{}, errors.New("remote target needs a host, as in user@host:/path")
+	}
+	return target, nil
+}
+
+// String formats the target as it is parsed
+func (t RemoteTarget) String() string {
+	s := t.Host
+	if t.User != "" {
+		s = t.User + "@" + s
+	}
+	if t.Port != "" {
+		s += ":" + t.Port
+	}
+	if t.Dir != "" {
+		s += ":" + t.Dir
+	}
+	return s
+}
+
+// address returns the host and port to dial
+func (t RemoteTarget) address() string {
+	port := t.Port
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(t.Host, port)
+}
+
+// Remote is an SSH connection to a RemoteTarget, which the remote bash
+// and text editor tools share
+type Remote struct {
+	Target RemoteTarget
+
+	client *ssh.Client
+	sftp   *sftp.Client
+}
+
+// DialRemote connects to target. If the target has no directory, the
+// remote user's home directory is used.
+func DialRemote(target RemoteTarget, config *ssh.ClientConfig) (*Remote, error) {
+	client, err := ssh.Dial("tcp", target.address(), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", target.Host, err)
+	}
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", target.Host, err)
+	}
+	r := &Remote{Target: target, client: client, sftp: sftpClient}
+
+	if r.Target.Dir == "" {
+		r.Target.Dir, err = sftpClient.Getwd()
+	} else if info, statErr := sftpClient.Stat(r.Target.Dir); statErr != nil {
+		err = statErr
+	} else if !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", r.Target.Dir)
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("remote directory: %w", err)
+	}
+	return r, nil
+}
+
+// Close closes the connection
+func (r *Remote) Close() error {
+	r.sftp.Close()
+	return r.client.Close()
+}
+
+// NewTextEditorTool returns a text editor tool for the files on the
+// remote host. Relative paths are relative to the target directory.
+func (r *Remote) NewTextEditorTool() *SimpleTextEditorTool {
+	return newTextEditorTool(&sftpFileSystem{client: r.sftp, dir: r.Target.Dir})
+}
+
+// NewWorkspace returns a workspace of directories on the remote host,
+// which confines its text editor as NewWorkspace does locally.
+// Relative paths are relative to the target directory.
+func (r *Remote) NewWorkspace(root, extra string, protected []string) (*Workspace, error) {
+	return newWorkspace(&sftpFileSystem{client: r.sftp, dir: r.Target.Dir},
+		root, extra, protected)
+}
+
+// dialRemoteFlag connects to the target given with -remote
+func dialRemoteFlag(s string) (*Remote, error) {
+	target, err := parseRemoteTarget(s)
+	if err != nil {
+		return nil, err
+	}
+	config, err := sshClientConfig(target.User)
+	if err != nil {
+		return nil, err
+	}
+	return DialRemote(target, config)
+}
+
+// sshClientConfig returns the client configuration for connecting as
+// user, or as the local user if user is empty. It authenticates with
+// the SSH agent and the unencrypted default keys, and checks host keys
+// against ~/.ssh/known_hosts.
+func sshClientConfig(username string) (*ssh.ClientConfig, error) {
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts (connect with ssh "+
+			"once to add the host key): %w", err)
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys with a passphrase are left to the agent
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no SSH keys found in the agent or ~/.ssh")
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// sftpFileSystem is the filesystem of a remote host, accessed over SFTP
+type sftpFileSystem struct {
+	client *sftp.Client
+
+	// dir is the directory that relative paths are relative to
+	dir string
+}
+
+// abs resolves p against the working directory
+func (f *sftpFileSystem) abs(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(f.dir, p)
+}
+
+func (f *sftpFileSystem) Stat(p string) (fs.FileInfo, error) {
+	return f.client.Stat(f.abs(p))
+}
+
+func (f *sftpFileSystem) ReadDir(p string) ([]fs.DirEntry, error) {
+	infos, err := f.client.ReadDir(f.abs(p))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+func (f *sftpFileSystem) ReadFile(p string) ([]byte, error) {
+	file, err := f.client.Open(f.abs(p))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (f *sftpFileSystem) WriteFile(p string, data []byte, perm fs.FileMode) error {
+	file, err := f.client.OpenFile(f.abs(p), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *sftpFileSystem) MkdirAll(p string, perm fs.FileMode) error {
+	return f.client.MkdirAll(f.abs(p))
+}
+
+func (f *sftpFileSystem) Getwd() (string, error) {
+	return f.dir, nil
+}
+
+func (f *sftpFileSystem) Lstat(p string) (fs.FileInfo, error) {
+	return f.client.Lstat(f.abs(p))
+}
+
+func (f *sftpFileSystem) Readlink(p string) (string, error) {
+	return f.client.ReadLink(f.abs(p))
+}
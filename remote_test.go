@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSSHServer starts an SSH server on the loopback interface
+// that runs exec requests with sh, like sshd, and serves SFTP. It
+// returns a remote connected to dir on the server.
+func startTestSSHServer(t *testing.T, dir string) *Remote {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	remote, err := DialRemote(RemoteTarget{Host: host, Port: port, Dir: dir},
+		&ssh.ClientConfig{
+			User:            "gollum",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+			HostKeyCallback: ssh.FixedHostKey(hostSigner.PublicKey()),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	return remote
+}
+
+// serveTestSSHConn serves the session channels of one connection
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSSHSession(channel, requests)
+	}
+}
+
+// serveTestSSHSession runs the command or subsystem of one session
+func serveTestSSHSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(true, nil)
+			status := runTestSSHCommand(channel, payload.Command)
+			var msg [4]byte
+			binary.BigEndian.PutUint32(msg[:], uint32(status))
+			channel.SendRequest("exit-status", false, msg[:])
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			if server, err := sftp.NewServer(channel); err == nil {
+				server.Serve()
+			}
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runTestSSHCommand runs command as the leader of a new process group,
+// as sshd does, and returns its exit status
+func runTestSSHCommand(channel ssh.Channel, command string) int {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killWaitDelay
+
+	// Input is copied by hand, since Wait would otherwise wait for
+	// the client to close its end
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return 127
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+func TestParseRemoteTarget(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    RemoteTarget
+		wantErr bool
+	}{
+		{"host", RemoteTarget{Host: "host"}, false},
+		{"me@host", RemoteTarget{User: "me", Host: "host"}, false},
+		{"me@host:/srv/app", RemoteTarget{User: "me", Host: "host", Dir: "/srv/app"}, false},
+		{"host:2222:/srv/app/", RemoteTarget{Host: "host", Port: "2222", Dir: "/srv/app"}, false},
+		{"me@host:2222", RemoteTarget{User: "me", Host: "host", Port: "2222"}, false},
+		{"host:ssh", RemoteTarget{}, true},
+		{"me@:/srv", RemoteTarget{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseRemoteTarget(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRemoteTarget(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRemoteTarget(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+			if again, _ := parseRemoteTarget(got.String()); again != got {
+				t.Errorf("String() = %q does not parse back", got.String())
+			}
+		})
+	}
+}
+
+func TestSSHBashTool(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := startTestSSHServer(t, dir)
+
+	tool := NewSSHBashTool(remote)
+	if !tool.running() {
+		t.Fatal("NewSSHBashTool() did not start a session")
+	}
+	defer tool.stopSession()
+
+	// Verify it implements the BashTool interface
+	var _ BashTool = tool
+	var _ CwdReporter = tool
+
+	// The session starts in the target directory and keeps state
+	stdout, _, err := tool.ExecuteCommand(context.Background(), "pwd; export FOO=bar")
+	if err != nil || stdout != dir+"\n" {
+		t.Errorf("pwd = %q, %v, want %q", stdout, err, dir+"\n")
+	}
+	stdout, _, err = tool.ExecuteCommand(context.Background(), "cd /; echo $FOO")
+	if err != nil || stdout != "bar\n" {
+		t.Errorf("echo $FOO = %q, %v, want %q", stdout, err, "bar\n")
+	}
+	if cwd := tool.Cwd(); cwd != "/" {
+		t.Errorf("Cwd() = %q, want /", cwd)
+	}
+
+	// Exiting the shell ends the session, and the next command starts
+	// a new one
+	_, _, err = tool.ExecuteCommand(context.Background(), "exit 3")
+	if err == nil || err.Error() != "bash session ended with exit status 3; "+
+		"a new session will be started for the next command" {
+		t.Errorf("exit 3 error = %v", err)
+	}
+
+	testBashTool(t, tool)
+}
+
+func TestRemoteTextEditorTool(t *testing.T) {
+	dir := t.TempDir()
+	remote := startTestSSHServer(t, dir)
+	tool := remote.NewTextEditorTool()
+
+	// Verify it implements the TextEditorTool interface
+	var _ TextEditorTool = tool
+
+	RunTextEditorToolTests(t, tool)
+
+	// Relative paths are relative to the target directory
+	if err := tool.Create("sub/relative.txt", "hello\n"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "sub", "relative.txt"))
+	if err != nil || string(content) != "hello\n" {
+		t.Errorf("relative file = %q, %v, want %q", content, err, "hello\n")
+	}
+}
+
+func TestRemoteWorkspace(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "ws")
+	outside := filepath.Join(root, "outside")
+	for _, d := range []string{filepath.Join(dir, ".git"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := startTestSSHServer(t, dir)
+	tool := remote.NewTextEditorTool()
+	if tool.Workspace, err = remote.NewWorkspace(".", "", defaultProtected); err != nil {
+		t.Fatalf("NewWorkspace() error = %v", err)
+	}
+	if got := tool.Workspace.Roots; len(got) != 1 || got[0] != dir {
+		t.Errorf("Roots = %v, want [%s]", got, dir)
+	}
+
+	// Paths are resolved on the remote host, through its links
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"main.go", true},
+		{filepath.Join(dir, "sub", "new.go"), true},
+		{"escape/authorized_keys", false},
+		{filepath.Join(outside, "new.go"), false},
+		{"../outside/new.go", false},
+		{".git/config", false},
+	}
+	for _, tt := range tests {
+		err := tool.Create(tt.path, "text\n")
+		var wsErr *WorkspaceError
+		if tt.allowed && err != nil {
+			t.Errorf("Create(%q) error = %v, want allowed", tt.path, err)
+		} else if !tt.allowed && !errors.As(err, &wsErr) {
+			t.Errorf("Create(%q) error = %v, want a WorkspaceError", tt.path, err)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Errorf("the editor wrote %d files outside the workspace", len(entries))
+	}
+
+	if _, err := remote.NewWorkspace("missing", "", nil); err == nil {
+		t.Error("NewWorkspace() accepted a missing directory")
+	}
+}
+
+func TestSSHBashToolEnvironment(t *testing.T) {
+	remote := startTestSSHServer(t, t.TempDir())
+	tool := &SSHBashTool{remote: remote, Timeout: defaultCommandTimeout,
+		Env: &Environment{Set: []string{"CI=1", "GREETING=hello world"}}}
+	defer tool.stopSession()
+
+	stdout, _, err := tool.ExecuteCommand(context.Background(), `echo "$CI $GREETING"`)
+	if err != nil || stdout != "1 hello world\n" {
+		t.Errorf("variables = %q, %v, want %q", stdout, err, "1 hello world\n")
+	}
+}
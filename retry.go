@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// defaultMaxRetries is how often a failed request is retried
+const defaultMaxRetries = 4
+
+// Bounds of the exponential backoff between retries. A server-provided
+// retry-after delay is honored up to maxRetryAfter.
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+	maxRetryAfter  = 5 * time.Minute
+)
+
+// errIncompleteStream is returned when a response stream ends without
+// an error but before the response was complete
+var errIncompleteStream = errors.New("stream ended before the response was complete")
+
+// streamErrorTypes are the error types sent in the event stream that
+// are worth retrying
+var streamErrorTypes = []string{
+	"overloaded_error",
+	"rate_limit_error",
+	"api_error",
+}
+
+// isRetryable reports whether err is a transient failure, such as an
+// overloaded or rate limited API or a dropped connection
+func isRetryable(err error) bool {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusConflict,
+			http.StatusTooManyRequests:
+			return true
+		}
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	// Errors sent in the event stream only carry their JSON body
+	if msg := err.Error(); strings.Contains(msg, "error while streaming") {
+		for _, errType := range streamErrorTypes {
+			if strings.Contains(msg, errType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, errIncompleteStream) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &netErr)
+}
+
+// retryAfter returns the delay requested by the API's retry-after
+// headers, if any
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *anthropic.Error
+	if !errors.As(err, &apiErr) || apiErr.Response == nil {
+		return 0, false
+	}
+	header := apiErr.Response.Header
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// retryDelay returns how long to wait before retry number attempt,
+// counting from 1. It honors the API's retry-after headers, and
+// otherwise backs off exponentially with jitter so that many clients
+// do not retry in lockstep.
+func retryDelay(err error, attempt int) time.Duration {
+	if delay, ok := retryAfter(err); ok {
+		return min(max(delay, 0), maxRetryAfter)
+	}
+	delay := min(retryBaseDelay<<min(attempt-1, 10), retryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryReason describes err briefly for the retry notice
+func retryReason(err error) string {
+	var apiErr *anthropic.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == 529:
+		return "API overloaded (529)"
+	case errors.As(err, &apiErr):
+		return fmt.Sprintf("API error %d %s", apiErr.StatusCode,
+			http.StatusText(apiErr.StatusCode))
+	case strings.Contains(err.Error(), "overloaded_error"):
+		return "API overloaded"
+	case strings.Contains(err.Error(), "rate_limit_error"):
+		return "rate limited"
+	}
+	return err.Error()
+}
+
+// sleepContext waits for d or until ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
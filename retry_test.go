@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// apiError returns an API error with the given status and headers
+func apiError(status int, header http.Header) error {
+	return &anthropic.Error{
+		StatusCode: status,
+		Response:   &http.Response{StatusCode: status, Header: header},
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"overloaded", apiError(529, nil), true},
+		{"rate limited", apiError(429, nil), true},
+		{"server error", apiError(500, nil), true},
+		{"bad request", apiError(400, nil), false},
+		{"unauthorized", apiError(401, nil), false},
+		{"wrapped", fmt.Errorf("stream error: %w", apiError(503, nil)), true},
+		{
+			"overloaded event",
+			errors.New(`received error while streaming: {"type":"error",` +
+				`"error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			true,
+		},
+		{
+			"invalid request event",
+			errors.New(`received error while streaming: {"type":"error",` +
+				`"error":{"type":"invalid_request_error"}}`),
+			false,
+		},
+		{"incomplete stream", errIncompleteStream, true},
+		{"unexpected EOF", fmt.Errorf("stream error: %w", io.ErrUnexpectedEOF), true},
+		{"other", errors.New("something else"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	// Exponential backoff with jitter between half and all of the delay
+	for attempt, want := range []time.Duration{
+		retryBaseDelay, 2 * retryBaseDelay, 4 * retryBaseDelay,
+	} {
+		for range 20 {
+			got := retryDelay(errIncompleteStream, attempt+1)
+			if got < want/2 || got > want {
+				t.Errorf("retryDelay(attempt %d) = %v, want between %v "+
+					"and %v", attempt+1, got, want/2, want)
+			}
+		}
+	}
+	if got := retryDelay(errIncompleteStream, 100); got > retryMaxDelay {
+		t.Errorf("retryDelay(attempt 100) = %v, want at most %v", got,
+			retryMaxDelay)
+	}
+
+	// The API's retry-after headers take precedence
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{http.Header{"Retry-After-Ms": {"1500"}}, 1500 * time.Millisecond},
+		{http.Header{"Retry-After": {"86400"}}, maxRetryAfter},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(apiError(429, tt.header), 1); got != tt.want {
+			t.Errorf("retryDelay(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepContext() on cancelled context = %v, want "+
+			"context.Canceled", err)
+	}
+	if err := sleepContext(context.Background(), 0); err != nil {
+		t.Errorf("sleepContext(0) = %v, want nil", err)
+	}
+}
+
+// writeSSE writes server-sent events for a text response. The response
+// is left incomplete unless stopReason is set.
+func writeSSE(w io.Writer, text, stopReason string) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message",` +
+			`"role":"assistant","content":[],"model":"test",` +
+			`"usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,` +
+			`"content_block":{"type":"text","text":""}}`,
+		fmt.Sprintf(`{"type":"content_block_delta","index":0,`+
+			`"delta":{"type":"text_delta","text":%q}}`, text),
+	}
+	if stopReason != "" {
+		events = append(events,
+			`{"type":"content_block_stop","index":0}`,
+			fmt.Sprintf(`{"type":"message_delta","delta":`+
+				`{"stop_reason":%q},"usage":{"output_tokens":5}}`, stopReason),
+			`{"type":"message_stop"}`)
+	}
+	for _, event := range events {
+		var typed struct{ Type string }
+		json.Unmarshal([]byte(event), &typed)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, event)
+	}
+}
+
+// newTestClient returns a client that talks to a test server at url
+func newTestClient(url string) *AnthropicClient {
+	ac := NewAnthropicClient("test", "claude-sonnet-4-0", "",
+		&toolProviders{
+			Bash:       NewStatelessBashTool(),
+			TextEditor: NewSimpleTextEditorTool(),
+		}, false)
+	client := anthropic.NewClient(option.WithAPIKey("test"),
+		option.WithBaseURL(url))
+	ac.client = &client
+	return ac
+}
+
+func TestSendMessageRetries(t *testing.T) {
+	var requests []anthropic.BetaMessageNewParams
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var params anthropic.BetaMessageNewParams
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &params)
+			requests = append(requests, params)
+
+			switch len(requests) {
+			case 1:
+				// The connection drops after some text
+				w.Header().Set("Content-Type", "text/event-stream")
+				writeSSE(w, "Hello", "")
+			case 2:
+				w.Header().Set("Retry-After-Ms", "0")
+				w.WriteHeader(529)
+				fmt.Fprint(w, `{"type":"error","error":`+
+					`{"type":"overloaded_error","message":"Overloaded"}}`)
+			default:
+				w.Header().Set("Content-Type", "text/event-stream")
+				writeSSE(w, " world", "end_turn")
+			}
+		}))
+	defer server.Close()
+
+	ac := newTestClient(server.URL)
+
+	c := NewConversation()
+	c.AddUserMessage("Say hello")
+	toolUses, err := ac.SendMessage(context.Background(), c)
+	if err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if len(toolUses) != 0 {
+		t.Errorf("SendMessage() tool uses = %v, want none", toolUses)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("server got %d requests, want 3", len(requests))
+	}
+
+	// The retries after text was shown prefill it
+	for _, params := range requests[1:] {
+		last := params.Messages[len(params.Messages)-1]
+		if last.Role != anthropic.BetaMessageParamRoleAssistant ||
+			last.Content[0].OfText == nil ||
+			last.Content[0].OfText.Text != "Hello" {
+			t.Errorf("retry request ends with %+v, want the partial "+
+				"response", last)
+		}
+	}
+
+	if len(c.messages) != 2 {
+		t.Fatalf("conversation has %d messages, want 2", len(c.messages))
+	}
+	reply := c.messages[1].Content
+	if len(reply) != 1 || reply[0].OfText == nil ||
+		reply[0].OfText.Text != "Hello world" {
+		t.Errorf("reply = %+v, want %q", reply, "Hello world")
+	}
+}
+
+func TestSendMessageGivesUp(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Content-Type", "text/event-stream")
+			writeSSE(w, "Partial", "")
+		}))
+	defer server.Close()
+
+	ac := newTestClient(server.URL)
+	ac.MaxRetries = 0
+
+	c := NewConversation()
+	c.AddUserMessage("Say hello")
+	if _, err := ac.SendMessage(context.Background(), c); !errors.Is(err, errIncompleteStream) {
+		t.Errorf("SendMessage() error = %v, want errIncompleteStream", err)
+	}
+	if requests != 1 {
+		t.Errorf("server got %d requests, want 1", requests)
+	}
+
+	// The text that was shown is kept, marked as incomplete
+	if len(c.messages) != 2 {
+		t.Fatalf("conversation has %d messages, want 2", len(c.messages))
+	}
+	var text []string
+	for _, block := range c.messages[1].Content {
+		text = append(text, block.OfText.Text)
+	}
+	if got := strings.Join(text, " "); got != "Partial "+failedNote {
+		t.Errorf("recorded reply = %q, want %q", got, "Partial "+failedNote)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Sandbox confines bash commands with Linux namespaces. The filesystem
+// is read-only except for the Writable directories, /tmp is private to
+// the sandbox, commands only see their own processes and, unless
+// Network is set, they have no network but loopback.
+//
+// The sandbox is set up by running Gollum itself in new namespaces as
+// a small init program, which prepares the mounts and then executes
+// the command. runSandboxInit must therefore be called first thing in
+// main.
+type Sandbox struct {
+	// Writable are the directories that commands may write to, such
+	// as the project directory
+	Writable []string `json:"writable"`
+
+	// Network gives commands the host's network
+	Network bool `json:"network"`
+}
+
+// sandboxEnv is the environment variable that passes the sandbox
+// settings to the init program
+const sandboxEnv = "GOLLUM_SANDBOX_INIT"
+
+// newSandbox returns a sandbox in which the project directory and the
+// comma-separated directories in writable can be written to
+func newSandbox(project, writable string, network bool) (*Sandbox, error) {
+	sb := &Sandbox{Network: network}
+	dirs := []string{project}
+	for _, dir := range strings.Split(writable, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err == nil {
+			abs, err = filepath.EvalSymlinks(abs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid writable directory: %w", err)
+		}
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("writable path %s is not a directory", dir)
+		}
+		sb.Writable = append(sb.Writable, abs)
+	}
+	return sb, nil
+}
+
+// Check reports whether commands can run in the sandbox on this system
+func (sb *Sandbox) Check() error {
+	cmd := exec.Command("true")
+	if err := sb.apply(cmd); err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot set up the sandbox: %v %s", err,
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// String describes the sandbox for the user
+func (sb *Sandbox) String() string {
+	network := "no network"
+	if sb.Network {
+		network = "network"
+	}
+	return fmt.Sprintf("writable: %s; private /tmp; %s",
+		strings.Join(sb.Writable, ", "), network)
+}
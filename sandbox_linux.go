@@ -0,0 +1,247 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// apply makes cmd run in the sandbox. A nil sandbox leaves cmd as is.
+func (sb *Sandbox) apply(cmd *exec.Cmd) error {
+	if sb == nil {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find the sandbox init program: %w", err)
+	}
+	config, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+
+	// The init program gets the original command as its arguments
+	cmd.Args = append([]string{"gollum-sandbox"}, cmd.Args...)
+	cmd.Path = self
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, sandboxEnv+"="+string(config))
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+		syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC
+	if !sb.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	// Commands keep the user's IDs, so that the files they write
+	// belong to the user
+	attr.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1},
+	}
+	attr.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1},
+	}
+	attr.GidMappingsEnableSetgroups = false
+	return nil
+}
+
+// runSandboxInit runs the sandbox init program if Gollum was started as
+// one. It sets up the sandbox and executes the command given as
+// arguments, so it only returns if Gollum was started normally.
+func runSandboxInit() {
+	config, ok := os.LookupEnv(sandboxEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(sandboxEnv)
+
+	var sb Sandbox
+	err := json.Unmarshal([]byte(config), &sb)
+	if err == nil {
+		err = sb.setUp()
+	}
+	if err == nil && len(os.Args) < 2 {
+		err = fmt.Errorf("no command")
+	}
+	var path string
+	if err == nil {
+		path, err = exec.LookPath(os.Args[1])
+	}
+	if err == nil {
+		err = syscall.Exec(path, os.Args[1:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "gollum sandbox: %v\n", err)
+	os.Exit(126)
+}
+
+// setUp prepares the mounts and network of the sandbox. It runs in the
+// new namespaces.
+func (sb *Sandbox) setUp() error {
+	// Keep the mounts below from propagating to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	// The writable directories are opened before /tmp is replaced,
+	// since they may be in it
+	var dirs []*os.File
+	for _, dir := range sb.Writable {
+		f, err := os.OpenFile(dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dirs = append(dirs, f)
+	}
+
+	if err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV,
+		"mode=1777"); err != nil {
+		return fmt.Errorf("mounting private /tmp: %w", err)
+	}
+	for i, dir := range sb.Writable {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		source := fmt.Sprintf("/proc/self/fd/%d", dirs[i].Fd())
+		if err := unix.Mount(source, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("mounting %s writable: %w", dir, err)
+		}
+	}
+
+	if err := sb.remountReadOnly(); err != nil {
+		return err
+	}
+
+	// A proc for the new PID namespace shows only the sandbox's
+	// processes. Where the host's proc is partly hidden, as in some
+	// containers, the kernel refuses, and the host's proc is kept.
+	unix.Mount("proc", "/proc", "proc",
+		unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+
+	if !sb.Network {
+		return loopbackUp()
+	}
+	return nil
+}
+
+// writable reports whether path is in a directory that stays writable
+func (sb *Sandbox) writable(path string) bool {
+	for _, dir := range append([]string{"/tmp"}, sb.Writable...) {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// remountReadOnly makes every mount read-only except for the writable
+// directories and /tmp
+func (sb *Sandbox) remountReadOnly() error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point and options are the fifth and sixth fields
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		if sb.writable(mountPoint) {
+			continue
+		}
+
+		// Flags that the mount already has must be kept, or the
+		// kernel refuses to remount it
+		flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+		for _, option := range strings.Split(fields[5], ",") {
+			flags |= mountOptionFlags[option]
+		}
+		err := unix.Mount("", mountPoint, "", flags, "")
+		if err != nil && !pseudoFilesystem(mountPoint) {
+			return fmt.Errorf("making %s read-only: %w", mountPoint, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// mountOptionFlags maps per-mount options to their mount flags
+var mountOptionFlags = map[string]uintptr{
+	"nosuid":      unix.MS_NOSUID,
+	"nodev":       unix.MS_NODEV,
+	"noexec":      unix.MS_NOEXEC,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+}
+
+// pseudoFilesystem reports whether path is under a kernel filesystem
+// that may refuse to be remounted and holds no user files
+func pseudoFilesystem(path string) bool {
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountPath decodes the octal escapes for spaces and other
+// special characters in mountinfo paths
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			var c byte
+			if _, err := fmt.Sscanf(path[i+1:i+4], "%o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return filepath.Clean(b.String())
+}
+
+// loopbackUp brings up the loopback interface of a new network
+// namespace, so that commands can still talk to local servers
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("bringing up loopback: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("bringing up loopback: %w", err)
+	}
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("bringing up loopback: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSandbox returns a sandbox with a temporary writable project
+// directory, or skips the test if the system does not allow namespaces
+func testSandbox(t *testing.T) *Sandbox {
+	t.Helper()
+	sb, err := newSandbox(t.TempDir(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Check(); err != nil {
+		t.Skipf("sandbox not available: %v", err)
+	}
+	return sb
+}
+
+func TestSandbox(t *testing.T) {
+	sb := testSandbox(t)
+	project := sb.Writable[0]
+
+	t.Run("Stateless", func(t *testing.T) {
+		testBashTool(t, &StatelessBashTool{Sandbox: sb})
+	})
+	t.Run("Stateful", func(t *testing.T) {
+		tool := &StatefulBashTool{Sandbox: sb}
+		if err := tool.startSession(); err != nil {
+			t.Fatal(err)
+		}
+		defer tool.stopSession()
+		testBashTool(t, tool)
+	})
+	t.Run("Pty", func(t *testing.T) {
+		tool := &PtyBashTool{Sandbox: sb}
+		if err := tool.startSession(); err != nil {
+			t.Fatal(err)
+		}
+		defer tool.stopSession()
+		stdout, _, err := tool.ExecuteCommand(context.Background(), "echo $$")
+		if err != nil || stdout != "1\n" {
+			t.Errorf("ExecuteCommand() = %q, %v, want PID 1", stdout, err)
+		}
+	})
+
+	outside := filepath.Join(filepath.Dir(project), "outside")
+	if err := os.Mkdir(outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	hostTmp, err := os.CreateTemp("", "gollum-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostTmp.Close()
+	defer os.Remove(hostTmp.Name())
+
+	tests := []struct {
+		name    string
+		command string
+		stdout  string
+		wantErr bool
+	}{
+		{
+			name:    "ProjectWritable",
+			command: "cd " + project + " && echo hi > file && cat file",
+			stdout:  "hi\n",
+		},
+		{
+			name:    "OutsideReadOnly",
+			command: "touch " + outside + "/file",
+			wantErr: true,
+		},
+		{
+			name:    "PrivateTmp",
+			command: "test -e " + hostTmp.Name(),
+			wantErr: true,
+		},
+		{
+			name:    "NoNetwork",
+			command: "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '",
+			stdout:  "lo\n",
+		},
+		{
+			name:    "OwnProcesses",
+			command: "echo $$",
+			stdout:  "1\n",
+		},
+	}
+	tool := &StatelessBashTool{Sandbox: sb}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, err := tool.ExecuteCommand(context.Background(), tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v (stderr %q)", err, tt.wantErr, stderr)
+			}
+			if !tt.wantErr && stdout != tt.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.stdout)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(project, "file")); err != nil {
+		t.Errorf("file written in the sandbox is missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); err == nil {
+		t.Error("sandbox wrote outside the writable directories")
+	}
+}
+
+func TestSandboxNetwork(t *testing.T) {
+	sb := testSandbox(t)
+	sb.Network = true
+	tool := &StatelessBashTool{Sandbox: sb}
+	stdout, _, err := tool.ExecuteCommand(context.Background(),
+		"tail -n +3 /proc/net/dev | wc -l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Count(string(host), "\n") - 2
+	if got := strings.TrimSpace(stdout); got != fmt.Sprint(want) {
+		t.Errorf("sandbox sees %s interfaces, host has %d", got, want)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// apply fails on platforms without Linux namespaces, unless the sandbox
+// is nil
+func (sb *Sandbox) apply(cmd *exec.Cmd) error {
+	if sb == nil {
+		return nil
+	}
+	return errors.New("the sandbox requires Linux")
+}
+
+// runSandboxInit does nothing on platforms without a sandbox
+func runSandboxInit() {}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain lets the test binary act as the init program of sandboxed
+// commands, as Gollum does
+func TestMain(m *testing.M) {
+	runSandboxInit()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// sessionFileExt is the file extension of saved sessions
+const sessionFileExt = ".json"
+
+// SessionStore saves conversations as JSON files in a directory so
+// that they can be listed and resumed later.
+type SessionStore struct {
+	dir string
+}
+
+// sessionFile is the on-disk representation of a conversation
+type sessionFile struct {
+	ID       string                       `json:"id"`
+	Created  time.Time                    `json:"created"`
+	Updated  time.Time                    `json:"updated"`
+	Messages []anthropic.BetaMessageParam `json:"messages"`
+}
+
+// SessionInfo summarizes a saved session for listing
+type SessionInfo struct {
+	ID          string
+	Created     time.Time
+	Updated     time.Time
+	FirstPrompt string
+	Messages    int
+}
+
+// NewSessionStore creates a session store that keeps its sessions in
+// dir. The directory is created if it does not exist.
+func NewSessionStore(dir string) (*SessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create session directory %s: %w",
+			dir, err)
+	}
+	return &SessionStore{dir: dir}, nil
+}
+
+// path returns the file that holds the session with the given ID
+func (s *SessionStore) path(id string) string {
+	return filepath.Join(s.dir, id+sessionFileExt)
+}
+
+// Save writes the conversation to its session file. The file is
+// replaced atomically so that a crash never leaves a corrupt session.
+func (s *SessionStore) Save(c *Conversation) error {
+	data, err := json.Marshal(sessionFile{
+		ID:       c.ID,
+		Created:  c.Created,
+		Updated:  time.Now(),
+		Messages: c.messages,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode session %s: %w", c.ID, err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, c.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save session %s: %w", c.ID, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save session %s: %w", c.ID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save session %s: %w", c.ID, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(c.ID)); err != nil {
+		return fmt.Errorf("failed to save session %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// read decodes the session file with the given ID
+func (s *SessionStore) read(id string) (*sessionFile, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session %s: %w", id, err)
+	}
+	var file sessionFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode session %s: %w", id, err)
+	}
+	return &file, nil
+}
+
+// Load reads a saved session and returns it as a conversation that is
+// persisted back to this store. id may be any unique prefix of a
+// session ID.
+func (s *SessionStore) Load(id string) (*Conversation, error) {
+	id, err := s.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conversation{
+		ID:       file.ID,
+		Created:  file.Created,
+		messages: file.Messages,
+		store:    s,
+		saved:    true,
+	}
+	c.closeDanglingToolUses()
+	return c, nil
+}
+
+// Latest returns the most recently updated session
+func (s *SessionStore) Latest() (*Conversation, error) {
+	sessions, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("no saved sessions in %s", s.dir)
+	}
+	return s.Load(sessions[0].ID)
+}
+
+// resolve expands a session ID prefix to a full session ID
+func (s *SessionStore) resolve(prefix string) (string, error) {
+	if _, err := os.Stat(s.path(prefix)); err == nil {
+		return prefix, nil
+	}
+
+	ids, err := s.ids()
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, prefix) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no session matches %q", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("session %q is ambiguous: matches %s",
+			prefix, strings.Join(matches, ", "))
+	}
+}
+
+// ids returns the IDs of all sessions in the store
+func (s *SessionStore) ids() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session directory %s: %w",
+			s.dir, err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasSuffix(name, sessionFileExt) {
+			ids = append(ids, strings.TrimSuffix(name, sessionFileExt))
+		}
+	}
+	return ids, nil
+}
+
+// List returns all saved sessions, most recently updated first.
+// Sessions that cannot be read are skipped.
+func (s *SessionStore) List() ([]SessionInfo, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionInfo
+	for _, id := range ids {
+		file, err := s.read(id)
+		if err != nil {
+			continue
+		}
+		c := &Conversation{messages: file.Messages}
+		sessions = append(sessions, SessionInfo{
+			ID:          file.ID,
+			Created:     file.Created,
+			Updated:     file.Updated,
+			FirstPrompt: c.FirstPrompt(),
+			Messages:    len(file.Messages),
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions, nil
+}
+
+// printSessions writes a table of saved sessions to w, marking the
+// session with the current ID.
+func printSessions(w io.Writer, sessions []SessionInfo, current string) {
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "No saved sessions")
+		return
+	}
+	for _, session := range sessions {
+		marker := " "
+		if session.ID == current {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s %s  %s  %3d msgs  %s\n",
+			marker,
+			session.ID,
+			session.Updated.Local().Format("2006-01-02 15:04"),
+			session.Messages,
+			summarizePrompt(session.FirstPrompt, 50))
+	}
+}
+
+// summarizePrompt shortens a prompt to a single line of at most n runes
+func summarizePrompt(prompt string, n int) string {
+	prompt = strings.Join(strings.Fields(prompt), " ")
+	runes := []rune(prompt)
+	if len(runes) <= n {
+		return prompt
+	}
+	return string(runes[:n-3]) + "..."
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestSessionStoreSaveAndLoad(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+
+	conversation := NewConversation()
+	if err := conversation.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	conversation.AddUserMessage("list the files")
+	conversation.AddToolResults([]anthropic.BetaContentBlockParamUnion{
+		anthropic.NewBetaToolResultBlock("toolu_1", "main.go", false),
+	})
+
+	loaded, err := store.Load(conversation.ID)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.ID != conversation.ID {
+		t.Errorf("Load() ID = %q, want %q", loaded.ID, conversation.ID)
+	}
+	if !loaded.Created.Equal(conversation.Created) {
+		t.Errorf("Load() Created = %v, want %v",
+			loaded.Created, conversation.Created)
+	}
+	if len(loaded.messages) != 2 {
+		t.Fatalf("Load() has %d messages, want 2", len(loaded.messages))
+	}
+	if got := loaded.FirstPrompt(); got != "list the files" {
+		t.Errorf("FirstPrompt() = %q, want %q", got, "list the files")
+	}
+	result := loaded.messages[1].Content[0].OfToolResult
+	if result == nil || result.ToolUseID != "toolu_1" {
+		t.Errorf("tool result was not restored: %+v", loaded.messages[1])
+	}
+
+	// Changes to the loaded conversation are saved back to the store
+	loaded.AddUserMessage("thanks")
+	reloaded, err := store.Load(conversation.ID)
+	if err != nil {
+		t.Fatalf("Load() after change error = %v", err)
+	}
+	if len(reloaded.messages) != 3 {
+		t.Errorf("reloaded session has %d messages, want 3",
+			len(reloaded.messages))
+	}
+}
+
+func TestSessionStoreEmptyConversationNotSaved(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+
+	if err := NewConversation().Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("List() = %v, want no sessions", sessions)
+	}
+	if _, err := store.Latest(); err == nil {
+		t.Error("Latest() should fail when there are no sessions")
+	}
+}
+
+func TestSessionStoreListAndLatest(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+
+	prompts := []string{"first session", "second session"}
+	var ids []string
+	for _, prompt := range prompts {
+		c := NewConversation()
+		if err := c.Persist(store); err != nil {
+			t.Fatalf("Persist() error = %v", err)
+		}
+		c.AddUserMessage(prompt)
+		ids = append(ids, c.ID)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("List() returned %d sessions, want 2", len(sessions))
+	}
+	if sessions[0].ID != ids[1] || sessions[0].FirstPrompt != prompts[1] {
+		t.Errorf("List()[0] = %+v, want most recent session %s",
+			sessions[0], ids[1])
+	}
+
+	latest, err := store.Latest()
+	if err != nil {
+		t.Fatalf("Latest() error = %v", err)
+	}
+	if latest.ID != ids[1] {
+		t.Errorf("Latest() ID = %q, want %q", latest.ID, ids[1])
+	}
+
+	var buf bytes.Buffer
+	printSessions(&buf, sessions, ids[0])
+	output := buf.String()
+	if !strings.Contains(output, "* "+ids[0]) {
+		t.Errorf("printSessions() should mark current session, got:\n%s",
+			output)
+	}
+	if !strings.Contains(output, prompts[1]) {
+		t.Errorf("printSessions() should show first prompt, got:\n%s",
+			output)
+	}
+}
+
+func TestSessionStoreResolvePrefix(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+
+	for _, id := range []string{"20250101-000000-aaaa",
+		"20250101-000000-aabb", "20250202-000000-cccc"} {
+		c := NewConversation()
+		c.ID = id
+		if err := c.Persist(store); err != nil {
+			t.Fatalf("Persist() error = %v", err)
+		}
+		c.AddUserMessage("hello")
+	}
+
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{prefix: "20250202", want: "20250202-000000-cccc"},
+		{prefix: "20250101-000000-aabb", want: "20250101-000000-aabb"},
+		{prefix: "20250101", wantErr: true},
+		{prefix: "2024", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			c, err := store.Load(tt.prefix)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Load(%q) should have failed", tt.prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load(%q) error = %v", tt.prefix, err)
+			}
+			if c.ID != tt.want {
+				t.Errorf("Load(%q) ID = %q, want %q", tt.prefix, c.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadClosesDanglingToolUses(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+
+	c := NewConversation()
+	if err := c.Persist(store); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	c.AddUserMessage("run ls")
+	c.messages = append(c.messages, anthropic.BetaMessageParam{
+		Role: anthropic.BetaMessageParamRoleAssistant,
+		Content: []anthropic.BetaContentBlockParamUnion{
+			anthropic.NewBetaToolUseBlock("toolu_1",
+				map[string]any{"command": "ls"}, "bash"),
+		},
+	})
+	c.changed()
+
+	loaded, err := store.Load(c.ID)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(loaded.messages) != 3 {
+		t.Fatalf("Load() has %d messages, want 3", len(loaded.messages))
+	}
+	result := loaded.messages[2].Content[0].OfToolResult
+	if result == nil || result.ToolUseID != "toolu_1" {
+		t.Fatalf("expected error result for dangling tool use, got %+v",
+			loaded.messages[2])
+	}
+	if !result.IsError.Value {
+		t.Error("result for dangling tool use should be an error")
+	}
+}
+
+func TestSummarizePrompt(t *testing.T) {
+	tests := []struct {
+		prompt string
+		n      int
+		want   string
+	}{
+		{prompt: "short", n: 10, want: "short"},
+		{prompt: "multi\nline\tprompt", n: 20, want: "multi line prompt"},
+		{prompt: "a very long prompt indeed", n: 10, want: "a very ..."},
+	}
+
+	for _, tt := range tests {
+		if got := summarizePrompt(tt.prompt, tt.n); got != tt.want {
+			t.Errorf("summarizePrompt(%q, %d) = %q, want %q",
+				tt.prompt, tt.n, got, tt.want)
+		}
+	}
+}
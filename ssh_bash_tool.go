@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHBashTool is an implementation of the BashTool interface that runs
+// commands in a persistent bash session on a remote host. It uses the
+// same protocol as StatefulBashTool over the SSH session's streams.
+type SSHBashTool struct {
+	remote *Remote
+
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	stderr  io.Reader
+	mutex   sync.Mutex
+
+	// pid is the remote bash process, which leads its own process
+	// group because sshd starts every session in a new session
+	pid int
+
+	// exited is closed when the session has ended, after which
+	// exitErr holds how it ended
+	exited  chan struct{}
+	exitErr error
+
+	// cwd is the working directory after the last command
+	cwd string
+
+	// Timeout is how long a command may run before it is killed,
+	// which restarts the session. Zero disables the timeout.
+	Timeout time.Duration
+
+	// Echo, if not nil, receives the command's output line by line
+	// as it arrives, with standard error lines set apart
+	Echo io.Writer
+
+	// Limits caps the resources of every process in the session
+	Limits ResourceLimits
+
+	// Env adds its Set variables to the session. The session does
+	// not inherit Gollum's environment, so nothing else applies.
+	Env *Environment
+}
+
+// NewSSHBashTool creates a new SSHBashTool instance on remote and
+// starts a bash session in the target directory.
+func NewSSHBashTool(remote *Remote) *SSHBashTool {
+	tool := &SSHBashTool{remote: remote, Timeout: defaultCommandTimeout}
+	tool.startSession()
+	return tool
+}
+
+// shellQuote quotes s for any POSIX shell, which the remote login shell
+// may be instead of bash
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// startSession starts a new bash process on the remote host.
+func (s *SSHBashTool) startSession() error {
+	s.stopSession()
+
+	session, err := s.remote.client.NewSession()
+	if err != nil {
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		return err
+	}
+
+	// The login shell reports its PID and then becomes bash, so that
+	// an interrupt can kill the process group
+	bash := []string{"bash", "--noprofile", "--norc"}
+	if s.Env != nil && len(s.Env.Set) > 0 {
+		bash = append(append([]string{"env"}, s.Env.Set...), bash...)
+	}
+	var args []string
+	for _, arg := range s.Limits.wrap(bash...) {
+		args = append(args, shellQuote(arg))
+	}
+	command := fmt.Sprintf("cd %s && echo $$ && exec %s",
+		shellQuote(s.remote.Target.Dir), strings.Join(args, " "))
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return err
+	}
+
+	// The PID line is read byte by byte so that nothing after it is
+	// buffered away from the session protocol
+	var line []byte
+	var b [1]byte
+	for {
+		if _, err := stdout.Read(b[:]); err != nil {
+			message, _ := io.ReadAll(stderr)
+			session.Close()
+			return fmt.Errorf("remote shell failed to start: %s",
+				strings.TrimSpace(string(message)))
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(line)))
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("remote shell sent malformed PID %q", line)
+	}
+
+	s.session, s.stdin, s.stdout, s.stderr = session, stdin, stdout, stderr
+	s.pid, s.cwd = pid, ""
+	exited := make(chan struct{})
+	s.exited = exited
+	go func() {
+		s.exitErr = session.Wait()
+		close(exited)
+	}()
+	return nil
+}
+
+// running reports whether the remote bash process is still alive
+func (s *SSHBashTool) running() bool {
+	if s.session == nil {
+		return false
+	}
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stopSession kills the remote bash process and everything it started,
+// and closes the session.
+func (s *SSHBashTool) stopSession() {
+	if s.session == nil {
+		return
+	}
+	if s.running() {
+		// Killing the process group needs a second session, since
+		// the first one is busy with the command
+		if kill, err := s.remote.client.NewSession(); err == nil {
+			kill.Run(fmt.Sprintf("kill -KILL -- -%d", s.pid))
+			kill.Close()
+		}
+	}
+	s.session.Close()
+	select {
+	case <-s.exited:
+	case <-time.After(killWaitDelay):
+	}
+	s.session = nil
+}
+
+// exitState returns the error for how the remote bash process ended
+func (s *SSHBashTool) exitState() error {
+	var exitErr *ssh.ExitError
+	switch {
+	case s.exitErr == nil:
+		return errors.New("exit status 0")
+	case errors.As(s.exitErr, &exitErr) && exitErr.Signal() != "":
+		return fmt.Errorf("signal %s", exitErr.Signal())
+	case errors.As(s.exitErr, &exitErr):
+		return shellExitError(exitErr.ExitStatus())
+	}
+	return s.exitErr
+}
+
+// Cwd returns the working directory of the session after the last
+// command, or the empty string if no command has completed yet
+func (s *SSHBashTool) Cwd() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cwd
+}
+
+// ExecuteCommand runs the given command in the remote bash session.
+// It returns the command's stdout, stderr, and any execution error. If
+// ctx is cancelled or the command times out, the session is killed and
+// restarted, which loses its state.
+func (s *SSHBashTool) ExecuteCommand(ctx context.Context, command string) (stdout string, stderr string, err error) {
+	stdout, stderr, err = checkBashCommand(command)
+	if err == nil {
+		ctx, cancel := commandContext(ctx, s.Timeout)
+		defer cancel()
+		return s.executeCommandInternal(ctx, command)
+	}
+
+	return
+}
+
+// executeCommandInternal runs command in the session, starting a new
+// session first if the previous one has ended.
+func (s *SSHBashTool) executeCommandInternal(ctx context.Context, command string) (stdout string, stderr string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running() {
+		if err := s.startSession(); err != nil {
+			return "", "", fmt.Errorf("failed to start remote bash session: %w", err)
+		}
+	}
+
+	nonce := newNonce()
+	if _, err := io.WriteString(s.stdin, sessionInput(command, nonce)); err != nil {
+		return "", "", fmt.Errorf("failed to write command: %w", err)
+	}
+
+	marker := markerPrefix + nonce
+	echoStdout, echoStderr := newEchoWriters(s.Echo)
+	done := make(chan [2]markerResult, 1)
+	go func(stdoutPipe, stderrPipe io.Reader) {
+		stdoutDone := make(chan markerResult, 1)
+		go func() {
+			stdoutDone <- readUntilMarker(stdoutPipe, marker, echoStdout)
+		}()
+		stderrResult := readUntilMarker(stderrPipe, marker, echoStderr)
+		done <- [2]markerResult{<-stdoutDone, stderrResult}
+	}(s.stdout, s.stderr)
+
+	var results [2]markerResult
+	select {
+	case results = <-done:
+	case <-ctx.Done():
+		// Closing the session ends the read
+		s.stopSession()
+		results = <-done
+		return results[0].output, results[1].output, fmt.Errorf(
+			"%w; the bash session was restarted", interruptedError(ctx))
+	}
+	stdout, stderr = results[0].output, results[1].output
+
+	if !results[0].found || !results[1].found {
+		// The command ran exit or exec, or bash was killed
+		exitErr := errors.New("unknown status")
+		select {
+		case <-s.exited:
+			exitErr = s.exitState()
+		case <-time.After(killWaitDelay):
+		}
+		s.stopSession()
+		return stdout, stderr, s.Limits.check(stdout+stderr, fmt.Errorf(
+			"bash session ended with %w; a new session will be started "+
+				"for the next command", exitErr))
+	}
+
+	status, cwd, err := parseStatusTrailer(results[0].trailer)
+	if err != nil {
+		return stdout, stderr, err
+	}
+	s.cwd = cwd
+
+	return stdout, stderr, s.Limits.check(stdout+stderr, shellExitError(status))
+}
+
+// Restart terminates the current remote bash session and starts a new
+// one. This clears all session state.
+func (s *SSHBashTool) Restart() (message string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.startSession(); err != nil {
+		return "", fmt.Errorf("failed to restart remote bash session: %w", err)
+	}
+	return "Remote bash session restarted", nil
+}
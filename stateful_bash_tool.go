@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
-	"strings"
 	"sync"
+	"time"
 )
 
 // StatefulBashTool maintains a persistent bash session across command executions.
@@ -19,11 +20,34 @@ type StatefulBashTool struct {
 	stdout io.ReadCloser
 	stderr io.ReadCloser
 	mutex  sync.Mutex
+
+	// exited is closed once the bash process has exited
+	exited chan struct{}
+
+	// cwd is the working directory after the last command
+	cwd string
+
+	// Timeout is how long a command may run before it is killed,
+	// which restarts the session. Zero disables the timeout.
+	Timeout time.Duration
+
+	// Echo, if not nil, receives the command's output line by line
+	// as it arrives, with standard error lines set apart
+	Echo io.Writer
+
+	// Limits caps the resources of every process in the session
+	Limits ResourceLimits
+
+	// Sandbox, if not nil, confines the session
+	Sandbox *Sandbox
+
+	// Env controls the environment of the session
+	Env *Environment
 }
 
 // NewStatefulBashTool creates a new StatefulBashTool instance and starts a bash session.
 func NewStatefulBashTool() *StatefulBashTool {
-	tool := &StatefulBashTool{}
+	tool := &StatefulBashTool{Timeout: defaultCommandTimeout}
 	tool.startSession()
 	return tool
 }
@@ -33,169 +57,206 @@ func (s *StatefulBashTool) startSession() error {
 	// Clean up existing session if any
 	s.stopSession()
 
-	// Start a new bash process
-	s.cmd = exec.Command("bash")
-
-	var err error
-	s.stdin, err = s.cmd.StdinPipe()
+	// The pipes are created here rather than with StdoutPipe and
+	// friends so that waiting for the process does not close them
+	// while output is still being read
+	stdinR, stdinW, err := os.Pipe()
 	if err != nil {
 		return err
 	}
-
-	s.stdout, err = s.cmd.StdoutPipe()
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		closeAll(stdinR, stdinW)
+		return err
+	}
+	stderrR, stderrW, err := os.Pipe()
 	if err != nil {
-		s.stdin.Close()
+		closeAll(stdinR, stdinW, stdoutR, stdoutW)
 		return err
 	}
 
-	s.stderr, err = s.cmd.StderrPipe()
+	// Start a new bash process in its own process group, so that an
+	// interrupted command can be killed along with its children
+	args := s.Limits.wrap("bash")
+	s.cmd = exec.Command(args[0], args[1:]...)
+	s.cmd.Stdin = stdinR
+	s.cmd.Stdout = stdoutW
+	s.cmd.Stderr = stderrW
+	s.cmd.Env = s.Env.Environ()
+	setProcessGroup(s.cmd)
+
+	err = s.Sandbox.apply(s.cmd)
+	if err == nil {
+		err = s.cmd.Start()
+	}
+	closeAll(stdinR, stdoutW, stderrW)
 	if err != nil {
-		s.stdin.Close()
-		s.stdout.Close()
+		closeAll(stdinW, stdoutR, stderrR)
+		s.cmd = nil
 		return err
 	}
+	s.stdin, s.stdout, s.stderr = stdinW, stdoutR, stderrR
+	s.cwd = ""
+
+	exited := make(chan struct{})
+	s.exited = exited
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		close(exited)
+	}(s.cmd)
+	return nil
+}
 
-	return s.cmd.Start()
+// closeAll closes files, ignoring errors
+func closeAll(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// running reports whether the bash process is still alive
+func (s *StatefulBashTool) running() bool {
+	if s.cmd == nil {
+		return false
+	}
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
 }
 
 // stopSession terminates the bash process and closes all pipes.
 func (s *StatefulBashTool) stopSession() {
-	if s.cmd != nil && s.cmd.Process != nil {
-		if s.stdin != nil {
-			s.stdin.Close()
-		}
-		if s.stdout != nil {
-			s.stdout.Close()
-		}
-		if s.stderr != nil {
-			s.stderr.Close()
+	if s.cmd == nil {
+		return
+	}
+	killProcessGroup(s.cmd)
+	s.cmd.Process.Kill()
+	<-s.exited
+	s.stdin.Close()
+	s.stdout.Close()
+	s.stderr.Close()
+	s.cmd = nil
+}
+
+// exitState returns the error for how the bash process cmd ended
+func exitState(cmd *exec.Cmd) error {
+	if state := cmd.ProcessState; state != nil {
+		if err := processExitError(state); err != nil {
+			return err
 		}
-		s.cmd.Process.Kill()
-		s.cmd.Wait()
+		return errors.New("exit status 0")
 	}
+	return errors.New("unknown status")
+}
+
+// Cwd returns the working directory of the session after the last
+// command, or the empty string if no command has completed yet
+func (s *StatefulBashTool) Cwd() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cwd
 }
 
 // ExecuteCommand runs the given command in the persistent bash session.
-// It returns the command's stdout, stderr, and any execution error.
-func (s *StatefulBashTool) ExecuteCommand(command string) (stdout string, stderr string, err error) {
+// It returns the command's stdout, stderr, and any execution error. If
+// ctx is cancelled or the command times out, the session is killed and
+// restarted, which loses its state.
+func (s *StatefulBashTool) ExecuteCommand(ctx context.Context, command string) (stdout string, stderr string, err error) {
 	//
 	// Check command syntax first. If the syntax is fine, then
 	// execute the command for real
 	//
 	stdout, stderr, err = checkBashCommand(command)
 	if err == nil {
-		return s.executeCommandInternal(command, 0)
+		ctx, cancel := commandContext(ctx, s.Timeout)
+		defer cancel()
+		return s.executeCommandInternal(ctx, command)
 	}
 
 	return
 }
 
-// executeCommandInternal is the internal implementation with retry logic.
-func (s *StatefulBashTool) executeCommandInternal(command string, retryCount int) (stdout string, stderr string, err error) {
+// executeCommandInternal runs command in the session, starting a new
+// session first if the previous one has ended.
+func (s *StatefulBashTool) executeCommandInternal(ctx context.Context, command string) (stdout string, stderr string, err error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Prevent infinite recursion
-	if retryCount > 1 {
-		return "", "", fmt.Errorf("exceeded maximum retry count for command: %s", command)
-	}
-
 	// Check if session needs to be started or restarted (including if process died)
-	if s.cmd == nil || s.cmd.Process == nil || s.cmd.ProcessState != nil {
+	if !s.running() {
 		if err := s.startSession(); err != nil {
 			return "", "", fmt.Errorf("failed to start bash session: %w", err)
 		}
 	}
 
-	// Special handling for exit commands - they terminate the session
-	if strings.TrimSpace(command) == "exit 1" || strings.HasPrefix(strings.TrimSpace(command), "exit ") {
-		// For exit commands, we can't capture output normally since they terminate the session
-		_, writeErr := s.stdin.Write([]byte(command + "\n"))
-		if writeErr != nil {
-			return "", "", fmt.Errorf("failed to write exit command: %w", writeErr)
+	nonce := newNonce()
+	input := sessionInput(command, nonce)
+	if _, err := io.WriteString(s.stdin, input); err != nil {
+		// The session died since the last command; retry once in a
+		// new session
+		if err := s.startSession(); err != nil {
+			return "", "", fmt.Errorf("session died and failed to restart: %w", err)
 		}
-		// Wait a moment for the session to terminate
-		s.cmd.Wait()
-		// Extract exit code from the command if possible
-		parts := strings.Fields(strings.TrimSpace(command))
-		if len(parts) >= 2 && parts[0] == "exit" {
-			return "", "", fmt.Errorf("exit status %s", parts[1])
+		if _, err := io.WriteString(s.stdin, input); err != nil {
+			return "", "", fmt.Errorf("failed to write command: %w", err)
 		}
-		return "", "", fmt.Errorf("exit status 1")
 	}
 
-	// Create a unique marker to identify the end of command output
-	marker := fmt.Sprintf("__GOLLUM_CMD_END_%d__", s.cmd.Process.Pid)
-	exitCodeMarker := fmt.Sprintf("__GOLLUM_EXIT_CODE_%d__", s.cmd.Process.Pid)
-
-	// Write the command followed by echo statements to mark the end and capture exit code
-	fullCommand := fmt.Sprintf("%s\necho %s$? >&1\necho %s >&1\necho %s >&2\n", command, exitCodeMarker, marker, marker)
+	// Read both pipes in the background so that neither can fill up
+	// and an interrupt can stop the command while it is running
+	marker := markerPrefix + nonce
+	echoStdout, echoStderr := newEchoWriters(s.Echo)
+	done := make(chan [2]markerResult, 1)
+	go func(stdoutPipe, stderrPipe io.Reader) {
+		stdoutDone := make(chan markerResult, 1)
+		go func() {
+			stdoutDone <- readUntilMarker(stdoutPipe, marker, echoStdout)
+		}()
+		stderrResult := readUntilMarker(stderrPipe, marker, echoStderr)
+		done <- [2]markerResult{<-stdoutDone, stderrResult}
+	}(s.stdout, s.stderr)
 
-	_, err = s.stdin.Write([]byte(fullCommand))
-	if err != nil {
-		// Session might be dead, try to restart and retry
-		if restartErr := s.startSession(); restartErr != nil {
-			return "", "", fmt.Errorf("failed to write command and restart session: %w", restartErr)
+	var results [2]markerResult
+	select {
+	case results = <-done:
+	case <-ctx.Done():
+		// Killing the session closes the pipes, which ends the read
+		s.stopSession()
+		results = <-done
+		return results[0].output, results[1].output, fmt.Errorf(
+			"%w; the bash session was restarted", interruptedError(ctx))
+	case <-s.exited:
+		// The command exited the shell. Its output ends when the
+		// pipes close, unless a background process still holds them.
+		select {
+		case results = <-done:
+		case <-time.After(killWaitDelay):
+			s.stopSession()
+			results = <-done
 		}
-		// Unlock mutex temporarily for recursive call
-		s.mutex.Unlock()
-		result1, result2, result3 := s.executeCommandInternal(command, retryCount+1)
-		s.mutex.Lock()
-		return result1, result2, result3
-	}
-
-	// Read stdout until we see the markers
-	var stdoutBuffer bytes.Buffer
-	var exitCode string
-	stdoutScanner := bufio.NewScanner(s.stdout)
-	exitCodeFound := false
-	
-	for stdoutScanner.Scan() {
-		line := stdoutScanner.Text()
-		if strings.HasPrefix(line, exitCodeMarker) && !exitCodeFound {
-			exitCode = strings.TrimPrefix(line, exitCodeMarker)
-			exitCodeFound = true
-			continue
-		}
-		if strings.TrimSpace(line) == marker {
-			break
-		}
-		stdoutBuffer.WriteString(line + "\n")
 	}
+	stdout, stderr = results[0].output, results[1].output
 
-	// If we couldn't read anything due to scanner error, session might be dead
-	if err := stdoutScanner.Err(); err != nil {
-		// Try to restart and re-execute the command
-		if restartErr := s.startSession(); restartErr != nil {
-			return "", "", fmt.Errorf("session died and failed to restart: %w", restartErr)
-		}
-		// Unlock mutex temporarily for recursive call
-		s.mutex.Unlock()
-		result1, result2, result3 := s.executeCommandInternal(command, retryCount+1)
-		s.mutex.Lock()
-		return result1, result2, result3
-	}
-
-	// Read stderr until we see the marker
-	var stderrBuffer bytes.Buffer
-	stderrScanner := bufio.NewScanner(s.stderr)
-	for stderrScanner.Scan() {
-		line := stderrScanner.Text()
-		if strings.TrimSpace(line) == marker {
-			break
-		}
-		stderrBuffer.WriteString(line + "\n")
+	if !results[0].found || !results[1].found {
+		// The command ran exit or exec, or bash was killed
+		cmd := s.cmd
+		s.stopSession()
+		return stdout, stderr, s.Limits.check(stdout+stderr, fmt.Errorf(
+			"bash session ended with %w; a new session will be started "+
+				"for the next command", exitState(cmd)))
 	}
 
-	stdout = stdoutBuffer.String()
-	stderr = stderrBuffer.String()
-
-	// Check if command failed based on exit code
-	if exitCode != "0" && exitCode != "" {
-		err = fmt.Errorf("exit status %s", exitCode)
+	status, cwd, err := parseStatusTrailer(results[0].trailer)
+	if err != nil {
+		return stdout, stderr, err
 	}
+	s.cwd = cwd
 
-	return stdout, stderr, err
+	// Check if command failed based on exit code
+	return stdout, stderr, s.Limits.check(stdout+stderr, shellExitError(status))
 }
 
 // Restart terminates the current bash session and starts a new one.
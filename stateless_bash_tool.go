@@ -2,22 +2,43 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"os/exec"
+	"time"
 )
 
 // StatelessBashTool implements BashTool without maintaining state between command executions.
 // Each command is executed in a separate bash process.
 type StatelessBashTool struct {
+	// Timeout is how long a command may run before it is killed.
+	// Zero disables the timeout.
+	Timeout time.Duration
+
+	// Echo, if not nil, receives the command's output line by line
+	// as it arrives, with standard error lines set apart
+	Echo io.Writer
+
+	// Limits caps the resources of the command
+	Limits ResourceLimits
+
+	// Sandbox, if not nil, confines the command
+	Sandbox *Sandbox
+
+	// Env controls the environment of the command
+	Env *Environment
 }
 
 // NewStatelessBashTool creates a new StatelessBashTool instance.
 func NewStatelessBashTool() *StatelessBashTool {
-	return &StatelessBashTool{}
+	return &StatelessBashTool{Timeout: defaultCommandTimeout}
 }
 
 // ExecuteCommand runs the given command in a new bash process.
 // It returns the command's stdout, stderr, and any execution error.
-func (*StatelessBashTool) ExecuteCommand(command string) (stdout string, stderr string, err error) {
+// The command runs in its own process group, which is killed if ctx is
+// cancelled or the command times out.
+func (s *StatelessBashTool) ExecuteCommand(ctx context.Context, command string) (stdout string, stderr string, err error) {
 	var stdoutBuffer, stderrBuffer bytes.Buffer
 
 	//
@@ -26,13 +47,31 @@ func (*StatelessBashTool) ExecuteCommand(command string) (stdout string, stderr
 	//
 	stdout, stderr, err = checkBashCommand(command)
 	if err == nil {
-		cmd := exec.Command("bash", "-c", command)
-		cmd.Stdout = &stdoutBuffer
-		cmd.Stderr = &stderrBuffer
+		ctx, cancel := commandContext(ctx, s.Timeout)
+		defer cancel()
+
+		echoStdout, echoStderr := newEchoWriters(s.Echo)
+		defer echoStdout.Flush()
+		defer echoStderr.Flush()
+
+		args := s.Limits.wrap("bash", "-c", command)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = io.MultiWriter(&stdoutBuffer, echoStdout)
+		cmd.Stderr = io.MultiWriter(&stderrBuffer, echoStderr)
+		setProcessGroup(cmd)
+		cmd.Cancel = func() error { return killProcessGroup(cmd) }
+		cmd.WaitDelay = killWaitDelay
+		cmd.Env = s.Env.Environ()
 
-		err = cmd.Run()
+		if err = s.Sandbox.apply(cmd); err == nil {
+			err = exitError(cmd.Run())
+		}
 		stdout = stdoutBuffer.String()
 		stderr = stderrBuffer.String()
+		if ctx.Err() != nil {
+			err = interruptedError(ctx)
+		}
+		err = s.Limits.check(stdout+stderr, err)
 	}
 
 	return
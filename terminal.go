@@ -0,0 +1,73 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// escapeSequence matches the terminal escape sequences that programs
+// use for colors, cursor movement and window titles
+var escapeSequence = regexp.MustCompile(
+	`\x1b(?:\[[0-?]*[ -/]*[@-~]` + // CSI, such as colors
+		`|\][^\x07\x1b]*(?:\x07|\x1b\\)` + // OSC, such as titles
+		`|[()][0-9A-Za-z]` + // character set selection
+		`|[ -/]*[0-~])`) // other escapes
+
+// cleanTerminalOutput turns what a program wrote to a terminal into
+// plain text. Escape sequences are removed, and carriage returns and
+// backspaces overwrite text the way they would on screen, so that
+// progress bars leave only their final state.
+func cleanTerminalOutput(s string) string {
+	s = escapeSequence.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = renderLine(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderLine returns the visible text of a line that may contain
+// carriage returns, backspaces and other control characters
+func renderLine(line string) string {
+	var screen []rune
+	col := 0
+	for _, r := range line {
+		switch {
+		case r == '\r':
+			col = 0
+		case r == '\b':
+			col = max(col-1, 0)
+		case r == '\t':
+			screen, col = putRune(screen, col, r)
+		case r < 0x20 || r == 0x7f:
+			// Bells and other controls are not visible
+		default:
+			screen, col = putRune(screen, col, r)
+		}
+	}
+	return string(screen)
+}
+
+// putRune writes r at col of screen, overwriting what was there
+func putRune(screen []rune, col int, r rune) ([]rune, int) {
+	if col < len(screen) {
+		screen[col] = r
+	} else {
+		screen = append(screen, r)
+	}
+	return screen, col + 1
+}
+
+// lastLine returns the text after the last newline of output, which is
+// where a program that waits for input shows its prompt
+func lastLine(output string) string {
+	i := strings.LastIndexByte(output, '\n')
+	line := output[i+1:]
+	if !utf8.ValidString(line) {
+		line = strings.ToValidUTF8(line, "")
+	}
+	return strings.TrimSpace(renderLine(escapeSequence.ReplaceAllString(line, "")))
+}
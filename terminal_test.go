@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCleanTerminalOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello\nworld\n", "hello\nworld\n"},
+		{"crlf", "hello\r\nworld\r\n", "hello\nworld\n"},
+		{"colors", "\x1b[1;31mred\x1b[0m and \x1b[38;5;82mgreen\x1b[m", "red and green"},
+		{"title", "\x1b]0;my title\x07text", "text"},
+		{"title with ST", "\x1b]2;title\x1b\\text", "text"},
+		{"cursor", "\x1b[2K\x1b[1Gdone\x1b[?25h", "done"},
+		{"charset", "\x1b(Bplain", "plain"},
+		{"progress", "10%\r50%\r100%\n", "100%\n"},
+		{"partial overwrite", "abcdef\rxy", "xycdef"},
+		{"backspace", "ab\bc", "ac"},
+		{"bell", "ding\a", "ding"},
+		{"unicode", "héllo\r\x1b[32mwörld\x1b[0m", "wörld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanTerminalOutput(tt.in); got != tt.want {
+				t.Errorf("cleanTerminalOutput(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"output\nPassword: ", "Password:"},
+		{"\x1b[1mProceed? [y/N]\x1b[0m ", "Proceed? [y/N]"},
+		{"done\n", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := lastLine(tt.in); got != tt.want {
+			t.Errorf("lastLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
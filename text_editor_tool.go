@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -45,9 +47,60 @@ type TextEditorTool interface {
 	UndoEdit(path string) error
 }
 
+// fileSystem is the filesystem that SimpleTextEditorTool works on
+type fileSystem interface {
+	linkFileSystem
+	Stat(path string) (fs.FileInfo, error)
+	ReadDir(path string) ([]fs.DirEntry, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// localFileSystem is the filesystem of the machine Gollum runs on
+type localFileSystem struct{}
+
+func (localFileSystem) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localFileSystem) ReadDir(path string) ([]fs.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+func (localFileSystem) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (localFileSystem) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+
+func (localFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (localFileSystem) Getwd() (string, error) {
+	return os.Getwd()
+}
+
+func (localFileSystem) Lstat(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localFileSystem) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
 // SimpleTextEditorTool is a basic implementation of the TextEditorTool
 // interface that operates on the filesystem.
 type SimpleTextEditorTool struct {
+	// Workspace, if not nil, confines the editor to its directories
+	Workspace *Workspace
+
+	// fs is the filesystem that holds the files
+	fs fileSystem
+
 	// undoHistory maps file paths to their previous content for undo
 	// operations
 	undoHistory map[string]string
@@ -55,15 +108,41 @@ type SimpleTextEditorTool struct {
 
 // NewSimpleTextEditorTool creates a new instance of SimpleTextEditorTool.
 func NewSimpleTextEditorTool() *SimpleTextEditorTool {
+	return newTextEditorTool(localFileSystem{})
+}
+
+// newTextEditorTool creates a SimpleTextEditorTool that works on fsys
+func newTextEditorTool(fsys fileSystem) *SimpleTextEditorTool {
 	return &SimpleTextEditorTool{
+		fs:          fsys,
 		undoHistory: make(map[string]string),
 	}
 }
 
+// resolve returns the absolute path that path refers to, with its links
+// resolved
+func (s *SimpleTextEditorTool) resolve(path string) (string, error) {
+	return resolvePath(s.fs, path)
+}
+
+// workingDir returns the directory that relative paths are relative to
+func (s *SimpleTextEditorTool) workingDir() (string, error) {
+	return s.fs.Getwd()
+}
+
+// readFile returns the contents of the file at path, unchecked and
+// unchanged, so that edits can be recorded
+func (s *SimpleTextEditorTool) readFile(path string) ([]byte, error) {
+	return s.fs.ReadFile(path)
+}
+
 // View examines the contents of a file or lists the contents of a directory.
 func (s *SimpleTextEditorTool) View(path string, start *int, end *int) (
 	string, error) {
-	info, err := os.Stat(path)
+	if err := s.Workspace.Check(path, false); err != nil {
+		return "", err
+	}
+	info, err := s.fs.Stat(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to stat path %s: %w", path, err)
 	}
@@ -77,7 +156,7 @@ func (s *SimpleTextEditorTool) View(path string, start *int, end *int) (
 
 // viewDirectory lists the contents of a directory.
 func (s *SimpleTextEditorTool) viewDirectory(path string) (string, error) {
-	entries, err := os.ReadDir(path)
+	entries, err := s.fs.ReadDir(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to read directory %s: %w", path, err)
 	}
@@ -98,7 +177,7 @@ func (s *SimpleTextEditorTool) viewDirectory(path string) (string, error) {
 // specific line range.
 func (s *SimpleTextEditorTool) viewFile(path string, start *int, end *int) (
 	string, error) {
-	content, err := os.ReadFile(path)
+	content, err := s.fs.ReadFile(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file %s: %w", path, err)
 	}
@@ -159,7 +238,10 @@ func (s *SimpleTextEditorTool) viewFile(path string, start *int, end *int) (
 
 // StringReplace replaces a specific string in a file with a new string.
 func (s *SimpleTextEditorTool) StringReplace(path, from, to string) error {
-	content, err := os.ReadFile(path)
+	if err := s.Workspace.Check(path, true); err != nil {
+		return err
+	}
+	content, err := s.fs.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read file %s: %w", path, err)
 	}
@@ -180,7 +262,7 @@ func (s *SimpleTextEditorTool) StringReplace(path, from, to string) error {
 	s.undoHistory[path] = originalContent
 
 	newContent := strings.Replace(originalContent, from, to, 1)
-	err = os.WriteFile(path, []byte(newContent), 0644)
+	err = s.fs.WriteFile(path, []byte(newContent), 0644)
 	if err != nil {
 		// Remove from undo history on failure
 		delete(s.undoHistory, path)
@@ -192,20 +274,24 @@ func (s *SimpleTextEditorTool) StringReplace(path, from, to string) error {
 
 // Create creates a new file with the specified contents at the given path.
 func (s *SimpleTextEditorTool) Create(path, contents string) error {
+	if err := s.Workspace.Check(path, true); err != nil {
+		return err
+	}
+
 	// Check if file already exists
-	if _, err := os.Stat(path); err == nil {
+	if _, err := s.fs.Stat(path); err == nil {
 		return fmt.Errorf("file %s already exists", path)
-	} else if !os.IsNotExist(err) {
+	} else if !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to check if file %s exists: %w", path, err)
 	}
 
 	// Ensure directory exists
 	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := s.fs.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 
-	err := os.WriteFile(path, []byte(contents), 0644)
+	err := s.fs.WriteFile(path, []byte(contents), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create file %s: %w", path, err)
 	}
@@ -216,11 +302,14 @@ func (s *SimpleTextEditorTool) Create(path, contents string) error {
 // Insert inserts text at a specific location in a file.
 func (s *SimpleTextEditorTool) Insert(path string, afterLine int,
 	text string) error {
+	if err := s.Workspace.Check(path, true); err != nil {
+		return err
+	}
 	if afterLine < 0 {
 		return fmt.Errorf("afterLine must be >= 0, got %d", afterLine)
 	}
 
-	content, err := os.ReadFile(path)
+	content, err := s.fs.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read file %s: %w", path, err)
 	}
@@ -253,7 +342,7 @@ func (s *SimpleTextEditorTool) Insert(path string, afterLine int,
 		newContent += "\n"
 	}
 
-	err = os.WriteFile(path, []byte(newContent), 0644)
+	err = s.fs.WriteFile(path, []byte(newContent), 0644)
 	if err != nil {
 		// Remove from undo history on failure
 		delete(s.undoHistory, path)
@@ -265,12 +354,15 @@ func (s *SimpleTextEditorTool) Insert(path string, afterLine int,
 
 // UndoEdit reverts the last edit made to a file.
 func (s *SimpleTextEditorTool) UndoEdit(path string) error {
+	if err := s.Workspace.Check(path, true); err != nil {
+		return err
+	}
 	originalContent, exists := s.undoHistory[path]
 	if !exists {
 		return fmt.Errorf("no undo history available for file %s", path)
 	}
 
-	err := os.WriteFile(path, []byte(originalContent), 0644)
+	err := s.fs.WriteFile(path, []byte(originalContent), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to undo edit for file %s: %w", path, err)
 	}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// defaultContextWindow is the context window, in tokens, of all the
+// supported models
+const defaultContextWindow = 200000
+
+// contextWarnFraction is the fraction of the context window above which
+// the exact request size is checked before sending
+const contextWarnFraction = 0.9
+
+// contextWindow returns the size of the model's context window in
+// tokens
+func contextWindow(model anthropic.Model) int {
+	return defaultContextWindow
+}
+
+// RecordUsage remembers the size of the conversation as reported by the
+// API in the usage of its latest response. The count includes the
+// system prompt and tool definitions.
+func (c *Conversation) RecordUsage(usage anthropic.BetaUsage) {
+	c.usageTokens = int(usage.InputTokens + usage.CacheCreationInputTokens +
+		usage.CacheReadInputTokens + usage.OutputTokens)
+	c.usageMessages = len(c.messages)
+}
+
+// resetUsage forgets the recorded usage after the history was rewritten
+func (c *Conversation) resetUsage() {
+	c.usageTokens = 0
+	c.usageMessages = 0
+}
+
+// EstimatedTokens estimates the size of the conversation. It starts
+// from the exact size reported by the latest response, if any, and
+// adds an estimate for the messages that were added since.
+func (c *Conversation) EstimatedTokens() int {
+	if c.usageMessages == 0 || c.usageMessages > len(c.messages) {
+		return estimateTokens(c.messages)
+	}
+	return c.usageTokens + estimateTokens(c.messages[c.usageMessages:])
+}
+
+// countTokensTools converts tool definitions to their count-tokens
+// equivalents
+func countTokensTools(tools []anthropic.BetaToolUnionParam) (
+	[]anthropic.BetaMessageCountTokensParamsToolUnion, error) {
+	var converted []anthropic.BetaMessageCountTokensParamsToolUnion
+	for _, tool := range tools {
+		switch {
+		case tool.OfTool != nil:
+			converted = append(converted,
+				anthropic.BetaMessageCountTokensParamsToolUnion{
+					OfTool: tool.OfTool,
+				})
+		case tool.OfBashTool20250124 != nil:
+			converted = append(converted,
+				anthropic.BetaMessageCountTokensParamsToolUnion{
+					OfBashTool20250124: tool.OfBashTool20250124,
+				})
+		case tool.OfTextEditor20250124 != nil:
+			converted = append(converted,
+				anthropic.BetaMessageCountTokensParamsToolUnion{
+					OfTextEditor20250124: tool.OfTextEditor20250124,
+				})
+		case tool.OfTextEditor20250429 != nil:
+			converted = append(converted,
+				anthropic.BetaMessageCountTokensParamsToolUnion{
+					OfTextEditor20250429: tool.OfTextEditor20250429,
+				})
+		default:
+			return nil, fmt.Errorf("cannot count tokens for tool %v",
+				tool.GetName())
+		}
+	}
+	return converted, nil
+}
+
+// CountTokens asks the API for the exact size of the next request
+func (ac *AnthropicClient) CountTokens(ctx context.Context,
+	conversation *Conversation) (int, error) {
+	tools, err := countTokensTools(ac.toolParams())
+	if err != nil {
+		return 0, err
+	}
+
+	params := anthropic.BetaMessageCountTokensParams{
+		Model:    ac.model,
+		Messages: conversation.messages,
+		Tools:    tools,
+		Betas: []anthropic.AnthropicBeta{
+			anthropic.AnthropicBetaComputerUse2025_01_24,
+		},
+	}
+	if system := ac.systemParams(); system != nil {
+		params.System.OfBetaTextBlockArray = system
+	}
+
+	count, err := ac.client.Beta.Messages.CountTokens(ctx, params,
+		option.WithMaxRetries(ac.MaxRetries))
+	if err != nil {
+		return 0, fmt.Errorf("token count request failed: %w", err)
+	}
+	return int(count.InputTokens), nil
+}
+
+// CheckContext warns if the next request would not fit in the model's
+// context window. The exact size is only requested from the API once
+// the running estimate gets close to the limit.
+func (ac *AnthropicClient) CheckContext(ctx context.Context,
+	conversation *Conversation) {
+	window := contextWindow(ac.model)
+	limit := int(float64(window) * contextWarnFraction)
+	if conversation.EstimatedTokens()+minMaxTokens <= limit {
+		return
+	}
+
+	tokens, err := ac.CountTokens(ctx, conversation)
+	if err != nil {
+		tokens = conversation.EstimatedTokens()
+	}
+	switch {
+	case tokens+minMaxTokens > window:
+		fmt.Printf("\n[Warning: this request is %d tokens and may not fit "+
+			"in the %d token context window. Use /compact to free "+
+			"up space.]\n", tokens, window)
+	case tokens > limit:
+		fmt.Printf("\n[Warning: conversation is %d of %d tokens "+
+			"(%.0f%%). Consider using /compact.]\n", tokens, window,
+			100*float64(tokens)/float64(window))
+	}
+}
+
+// contextBreakdown estimates how the context is used, in tokens
+type contextBreakdown struct {
+	System        int
+	Tools         int
+	UserText      int
+	AssistantText int
+	ToolCalls     int
+	ToolResults   int
+}
+
+// total returns the sum of all categories
+func (b contextBreakdown) total() int {
+	return b.System + b.Tools + b.UserText + b.AssistantText +
+		b.ToolCalls + b.ToolResults
+}
+
+// estimateJSONTokens estimates the tokens in the JSON encoding of v
+func estimateJSONTokens(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data) / charsPerToken
+}
+
+// breakdownContext estimates the size of each part of a request
+func breakdownContext(systemPrompt string,
+	tools []anthropic.BetaToolUnionParam,
+	messages []anthropic.BetaMessageParam) contextBreakdown {
+	b := contextBreakdown{
+		System: len(systemPrompt) / charsPerToken,
+		Tools:  estimateJSONTokens(tools),
+	}
+	for _, message := range messages {
+		for _, block := range message.Content {
+			switch {
+			case block.OfText != nil:
+				tokens := len(block.OfText.Text) / charsPerToken
+				if message.Role == anthropic.BetaMessageParamRoleAssistant {
+					b.AssistantText += tokens
+				} else {
+					b.UserText += tokens
+				}
+			case block.OfToolUse != nil:
+				b.ToolCalls += estimateJSONTokens(block.OfToolUse.Input)
+			case block.OfToolResult != nil:
+				b.ToolResults += len(toolResultText(
+					block.OfToolResult)) / charsPerToken
+			default:
+				b.UserText += estimateJSONTokens(block)
+			}
+		}
+	}
+	return b
+}
+
+// scaled returns the breakdown with each category scaled so that the
+// categories add up to total
+func (b contextBreakdown) scaled(total int) contextBreakdown {
+	estimate := b.total()
+	if estimate == 0 || total <= 0 {
+		return b
+	}
+	scale := func(n int) int {
+		return int(float64(n) * float64(total) / float64(estimate))
+	}
+	return contextBreakdown{
+		System:        scale(b.System),
+		Tools:         scale(b.Tools),
+		UserText:      scale(b.UserText),
+		AssistantText: scale(b.AssistantText),
+		ToolCalls:     scale(b.ToolCalls),
+		ToolResults:   scale(b.ToolResults),
+	}
+}
+
+// printContextUsage writes a report of how the context window is used
+func printContextUsage(w io.Writer, b contextBreakdown, total, window int,
+	exact bool) {
+	kind := "estimated"
+	if exact {
+		kind = "counted"
+	}
+	fmt.Fprintf(w, "Context: %d of %d tokens used (%.1f%%, %s)\n",
+		total, window, 100*float64(total)/float64(window), kind)
+
+	rows := []struct {
+		label  string
+		tokens int
+	}{
+		{"System prompt", b.System},
+		{"Tool definitions", b.Tools},
+		{"User text", b.UserText},
+		{"Assistant text", b.AssistantText},
+		{"Tool calls", b.ToolCalls},
+		{"Tool results", b.ToolResults},
+		{"Free", max(0, window-total)},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(w, "  %-18s %8d  %5.1f%%\n", row.label, row.tokens,
+			100*float64(row.tokens)/float64(window))
+	}
+}
+
+// ReportContext writes a breakdown of the conversation's context usage
+// to w, using the count-tokens endpoint for the total when possible
+func (ac *AnthropicClient) ReportContext(ctx context.Context, w io.Writer,
+	conversation *Conversation) {
+	breakdown := breakdownContext(ac.systemPrompt, ac.toolParams(),
+		conversation.messages)
+
+	exact := true
+	total, err := ac.CountTokens(ctx, conversation)
+	if err != nil {
+		fmt.Fprintf(w, "Could not count tokens, showing estimate: %v\n", err)
+		exact = false
+		total = breakdown.total()
+	}
+
+	window := contextWindow(ac.model)
+	printContextUsage(w, breakdown.scaled(total), total, window, exact)
+	if total+minMaxTokens > window {
+		fmt.Fprintln(w, "Warning: the next request may not fit in the "+
+			"context window. Use /compact to free up space.")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestConversationEstimatedTokensUsesUsage(t *testing.T) {
+	c := NewConversation()
+	c.AddUserMessage("hello")
+	estimate := c.EstimatedTokens()
+
+	c.RecordUsage(anthropic.BetaUsage{
+		InputTokens:              1000,
+		CacheReadInputTokens:     200,
+		CacheCreationInputTokens: 30,
+		OutputTokens:             4,
+	})
+	if got := c.EstimatedTokens(); got != 1234 {
+		t.Errorf("EstimatedTokens() after RecordUsage() = %d, want 1234", got)
+	}
+
+	// Messages added after the usage was recorded are estimated
+	c.AddUserMessage(strings.Repeat("x", 400))
+	if got := c.EstimatedTokens(); got < 1334 || got > 1400 {
+		t.Errorf("EstimatedTokens() after new message = %d, want ~1340", got)
+	}
+
+	// Rewriting the history discards the recorded usage
+	if _, err := c.Rewind(1); err != nil {
+		t.Fatalf("Rewind() error = %v", err)
+	}
+	c.AddUserMessage("hello")
+	if got := c.EstimatedTokens(); got != estimate {
+		t.Errorf("EstimatedTokens() after Rewind() = %d, want %d",
+			got, estimate)
+	}
+}
+
+func TestBreakdownContext(t *testing.T) {
+	c := newTestConversation()
+	tools := []anthropic.BetaToolUnionParam{
+		{OfBashTool20250124: &anthropic.BetaToolBash20250124Param{}},
+	}
+
+	b := breakdownContext(strings.Repeat("s", 400), tools, c.messages)
+
+	if b.System != 100 {
+		t.Errorf("System = %d, want 100", b.System)
+	}
+	if b.Tools == 0 {
+		t.Error("Tools should not be zero")
+	}
+	wantUser := (len("first prompt") + len("second prompt")) / charsPerToken
+	if b.UserText != wantUser {
+		t.Errorf("UserText = %d, want %d", b.UserText, wantUser)
+	}
+	if b.AssistantText != len("There is main.go")/charsPerToken {
+		t.Errorf("AssistantText = %d, want %d", b.AssistantText,
+			len("There is main.go")/charsPerToken)
+	}
+	if b.ToolCalls == 0 {
+		t.Error("ToolCalls should not be zero")
+	}
+	if b.ToolResults != len("main.go")/charsPerToken {
+		t.Errorf("ToolResults = %d, want %d", b.ToolResults,
+			len("main.go")/charsPerToken)
+	}
+}
+
+func TestContextBreakdownScaled(t *testing.T) {
+	b := contextBreakdown{System: 100, Tools: 100, ToolResults: 200}
+
+	scaled := b.scaled(800)
+	want := contextBreakdown{System: 200, Tools: 200, ToolResults: 400}
+	if scaled != want {
+		t.Errorf("scaled(800) = %+v, want %+v", scaled, want)
+	}
+	if got := (contextBreakdown{}).scaled(800); got != (contextBreakdown{}) {
+		t.Errorf("scaled() of empty breakdown = %+v, want empty", got)
+	}
+}
+
+func TestCountTokensTools(t *testing.T) {
+	client := &AnthropicClient{model: anthropic.ModelClaudeSonnet4_0}
+
+	tools, err := countTokensTools(client.toolParams())
+	if err != nil {
+		t.Fatalf("countTokensTools() error = %v", err)
+	}
+	if len(tools) != 2 {
+		t.Fatalf("countTokensTools() returned %d tools, want 2", len(tools))
+	}
+	if tools[0].OfTool == nil || tools[0].OfTool.Name != "bash" {
+		t.Error("first tool should be the bash tool")
+	}
+	if tools[1].OfTextEditor20250429 == nil {
+		t.Error("second tool should be the Claude 4 text editor tool")
+	}
+}
+
+func TestPrintContextUsage(t *testing.T) {
+	var buf bytes.Buffer
+	b := contextBreakdown{System: 1000, Tools: 2000, ToolResults: 47000}
+	printContextUsage(&buf, b, 50000, 200000, true)
+	output := buf.String()
+
+	for _, want := range []string{
+		"50000 of 200000 tokens used (25.0%, counted)",
+		"Tool results",
+		"Free                 150000   75.0%",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("printContextUsage() output missing %q:\n%s",
+				want, output)
+		}
+	}
+}
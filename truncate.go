@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Default output budgets, in bytes, for the content of tool results
+const (
+	defaultBashOutputLimit   = 30000
+	defaultEditorOutputLimit = 50000
+)
+
+// Tool categories that have separate output budgets
+const (
+	bashOutput   = "bash"
+	editorOutput = "editor"
+)
+
+// OutputLimiter keeps tool results within a per-tool budget. Output
+// over budget keeps its head and tail, and the middle is replaced by a
+// marker that tells the model where the full output was saved.
+type OutputLimiter struct {
+	// limits maps a tool category to its budget in bytes. A missing
+	// or non-positive budget means the output is never truncated.
+	limits map[string]int
+
+	// TempDir is where the directory for full outputs is created, or
+	// the empty string for the default directory for temporary files.
+	// It must be readable by the commands that the model runs.
+	TempDir string
+
+	// NoSave drops the full outputs instead of saving them, for when
+	// the model's tools cannot read the files Gollum writes
+	NoSave bool
+
+	// dir holds the full outputs. It is created on first use.
+	dir   string
+	mutex sync.Mutex
+}
+
+// NewOutputLimiter creates an output limiter with the given budgets
+// for bash and text editor output
+func NewOutputLimiter(bashLimit, editorLimit int) *OutputLimiter {
+	return &OutputLimiter{
+		limits: map[string]int{
+			bashOutput:   bashLimit,
+			editorOutput: editorLimit,
+		},
+	}
+}
+
+// Dir returns the directory where full outputs are saved, or the empty
+// string if nothing has been saved yet
+func (l *OutputLimiter) Dir() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.dir
+}
+
+// spill saves output to a new file and returns its path
+func (l *OutputLimiter) spill(tool, output string) (string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.dir == "" {
+		if l.TempDir != "" {
+			if err := os.MkdirAll(l.TempDir, 0700); err != nil {
+				return "", err
+			}
+		}
+		dir, err := os.MkdirTemp(l.TempDir, "gollum-output-")
+		if err != nil {
+			return "", err
+		}
+		l.dir = dir
+	}
+
+	f, err := os.CreateTemp(l.dir, tool+"-*.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(output); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Close removes the saved outputs
+func (l *OutputLimiter) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(l.dir)
+	l.dir = ""
+	return err
+}
+
+// Limit returns output if it fits in the budget for tool. Otherwise it
+// returns the head and tail of output with the middle elided, and
+// saves the full output to a file that the model can page through.
+func (l *OutputLimiter) Limit(tool, output string) string {
+	if l == nil {
+		return output
+	}
+	limit := l.limits[tool]
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	head, tail := splitHeadTail(output, limit/2)
+	elided := output[len(head) : len(output)-len(tail)]
+	lines := strings.Count(elided, "\n")
+
+	var hint string
+	if l.NoSave && tool == bashOutput {
+		hint = "The full output was not saved; rerun the command with " +
+			"its output redirected to a file to page through it."
+	} else if l.NoSave {
+		hint = "The full output was not saved; view a smaller " +
+			"view_range to see the rest."
+	} else if path, err := l.spill(tool, output); err != nil {
+		hint = fmt.Sprintf("The full output could not be saved: %v.", err)
+	} else {
+		hint = fmt.Sprintf("The full output was saved to %s. Page "+
+			"through it with sed -n 'START,ENDp' or the text editor's "+
+			"view_range, or search it with grep.", path)
+	}
+
+	marker := fmt.Sprintf("\n[... %d bytes (%d lines) elided: output "+
+		"exceeded the %d byte limit. %s ...]\n", len(elided), lines,
+		limit, hint)
+	return head + marker + tail
+}
+
+// splitHeadTail returns at most n bytes from the start and from the end
+// of s, where s is longer than 2n bytes. The cuts are moved to line
+// boundaries when one is nearby, and never split a UTF-8 sequence.
+func splitHeadTail(s string, n int) (head, tail string) {
+	cut := n
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	head = s[:cut]
+	if i := strings.LastIndexByte(head, '\n'); i >= len(head)/2 {
+		head = head[:i+1]
+	}
+
+	cut = len(s) - n
+	for cut < len(s) && !utf8.RuneStart(s[cut]) {
+		cut++
+	}
+	tail = s[cut:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)/2 {
+		tail = tail[i+1:]
+	}
+	return head, tail
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// numberedLines returns n lines of the form "line N"
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	return b.String()
+}
+
+func TestOutputLimiterWithinBudget(t *testing.T) {
+	limiter := NewOutputLimiter(100, 0)
+
+	short := "short output\n"
+	if got := limiter.Limit(bashOutput, short); got != short {
+		t.Errorf("Limit() = %q, want output unchanged", got)
+	}
+
+	// A zero budget disables truncation
+	long := numberedLines(1000)
+	if got := limiter.Limit(editorOutput, long); got != long {
+		t.Error("Limit() truncated output of a tool without a budget")
+	}
+
+	// A nil limiter never truncates
+	var none *OutputLimiter
+	if got := none.Limit(bashOutput, long); got != long {
+		t.Error("nil Limit() truncated output")
+	}
+	if limiter.Dir() != "" {
+		t.Error("no output should have been saved")
+	}
+}
+
+func TestOutputLimiterTruncates(t *testing.T) {
+	limiter := NewOutputLimiter(200, 0)
+	defer func() {
+		if dir := limiter.Dir(); dir != "" {
+			os.RemoveAll(dir)
+		}
+	}()
+	output := numberedLines(1000)
+
+	got := limiter.Limit(bashOutput, output)
+
+	if !strings.HasPrefix(got, "line 1\nline 2\n") {
+		t.Errorf("Limit() should keep the head, got %q", got[:40])
+	}
+	if !strings.HasSuffix(got, "line 999\nline 1000\n") {
+		t.Errorf("Limit() should keep the tail, got %q", got[len(got)-40:])
+	}
+	if len(got) > 200+400 {
+		t.Errorf("Limit() returned %d bytes, want about 200 plus marker",
+			len(got))
+	}
+
+	match := regexp.MustCompile(`saved to (\S+)\. `).FindStringSubmatch(got)
+	if match == nil {
+		t.Fatalf("Limit() marker does not name the saved file: %q", got)
+	}
+	saved, err := os.ReadFile(match[1])
+	if err != nil {
+		t.Fatalf("failed to read saved output: %v", err)
+	}
+	if string(saved) != output {
+		t.Error("saved output differs from the full output")
+	}
+	if !strings.Contains(got, "elided") {
+		t.Errorf("Limit() marker should say output was elided: %q", got)
+	}
+}
+
+func TestOutputLimiterSaveLocation(t *testing.T) {
+	output := numberedLines(1000)
+
+	base := filepath.Join(t.TempDir(), "cache", "gollum")
+	limiter := NewOutputLimiter(200, 0)
+	limiter.TempDir = base
+	got := limiter.Limit(bashOutput, output)
+	dir := limiter.Dir()
+	if filepath.Dir(dir) != base || !strings.Contains(got, "saved to "+dir) {
+		t.Errorf("output saved in %q, want a directory in %q: %q", dir, base, got)
+	}
+	if err := limiter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Close() left %s behind: %v", dir, err)
+	}
+
+	// Remote tools cannot read local files, so nothing is saved
+	limiter = NewOutputLimiter(200, 200)
+	limiter.NoSave = true
+	for _, tool := range []string{bashOutput, editorOutput} {
+		got := limiter.Limit(tool, output)
+		if !strings.Contains(got, "not saved") || strings.Contains(got, "saved to") {
+			t.Errorf("Limit(%s) marker = %q, want no saved file", tool, got)
+		}
+	}
+	if limiter.Dir() != "" {
+		t.Error("no output should have been saved")
+	}
+}
+
+func TestSplitHeadTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		n        int
+		wantHead string
+		wantTail string
+	}{
+		{
+			name:     "LineBoundaries",
+			s:        "aaaa\nbbbb\ncccc\ndddd\neeee\n",
+			n:        8,
+			wantHead: "aaaa\n",
+			wantTail: "eeee\n",
+		},
+		{
+			name:     "NoNewlines",
+			s:        strings.Repeat("x", 30),
+			n:        10,
+			wantHead: strings.Repeat("x", 10),
+			wantTail: strings.Repeat("x", 10),
+		},
+		{
+			name:     "MultibyteRunes",
+			s:        strings.Repeat("é", 20),
+			n:        5,
+			wantHead: "éé",
+			wantTail: "éé",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, tail := splitHeadTail(tt.s, tt.n)
+			if head != tt.wantHead {
+				t.Errorf("head = %q, want %q", head, tt.wantHead)
+			}
+			if tail != tt.wantTail {
+				t.Errorf("tail = %q, want %q", tail, tt.wantTail)
+			}
+			if !utf8.ValidString(head) || !utf8.ValidString(tail) {
+				t.Error("head or tail split a UTF-8 sequence")
+			}
+		})
+	}
+}
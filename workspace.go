@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultProtected are the paths in the workspace that the text editor
+// may not touch unless told otherwise
+var defaultProtected = []string{".git/**", ".env", ".env.*"}
+
+// maxSymlinks bounds how many symbolic links a path may go through, as
+// the kernel does
+const maxSymlinks = 40
+
+// Workspace confines the text editor to a set of directory trees. Paths
+// are resolved through symbolic links and .. before they are checked,
+// so a link inside the workspace cannot lead the editor out of it.
+type Workspace struct {
+	// Roots are the directories the editor may use, with symbolic
+	// links resolved. The first is the workspace root.
+	Roots []string
+
+	// Protected are glob patterns for paths under the roots that the
+	// editor may not use. A pattern with a slash matches the path
+	// relative to its root, and ** in it matches any number of
+	// directories; a pattern without one matches any file or
+	// directory of that name.
+	Protected []string
+
+	// OutputDir, if set, returns the directory where long tool output
+	// is saved, so that the editor may read it
+	OutputDir func() string
+
+	// fs is the filesystem that paths are resolved on
+	fs linkFileSystem
+}
+
+// linkFileSystem is what a Workspace needs of a filesystem to resolve
+// paths on it
+type linkFileSystem interface {
+	Getwd() (string, error)
+	Lstat(path string) (fs.FileInfo, error)
+	Readlink(path string) (string, error)
+}
+
+// WorkspaceError reports that a path is outside the workspace or
+// protected
+type WorkspaceError struct {
+	Path   string
+	Reason string
+}
+
+func (e *WorkspaceError) Error() string {
+	return fmt.Sprintf("access to %s denied: %s", e.Path, e.Reason)
+}
+
+// NewWorkspace returns a workspace rooted at root that also allows the
+// comma-separated directories in extra
+func NewWorkspace(root, extra string, protected []string) (*Workspace, error) {
+	return newWorkspace(localFileSystem{}, root, extra, protected)
+}
+
+// newWorkspace returns a workspace on fsys
+func newWorkspace(fsys linkFileSystem, root, extra string, protected []string) (*Workspace, error) {
+	w := &Workspace{Protected: protected, fs: fsys}
+	dirs := []string{root}
+	for _, dir := range strings.Split(extra, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		resolved, err := resolvePath(fsys, dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace directory: %w", err)
+		}
+		// The resolved path has no links left to follow
+		if info, err := fsys.Lstat(resolved); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("workspace path %s is not a directory", dir)
+		}
+		w.Roots = append(w.Roots, resolved)
+	}
+	for _, pattern := range protected {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid protected pattern %q: %w", pattern, err)
+		}
+	}
+	return w, nil
+}
+
+// Check returns an error if the editor may not use the path. Writes
+// are only allowed under the roots, while the output directory may
+// also be read.
+func (w *Workspace) Check(name string, write bool) error {
+	if w == nil {
+		return nil
+	}
+	resolved, err := resolvePath(w.fs, name)
+	if err != nil {
+		return &WorkspaceError{Path: name, Reason: err.Error()}
+	}
+
+	for _, root := range w.Roots {
+		rel, ok := relativePath(root, resolved)
+		if !ok {
+			continue
+		}
+		if pattern := w.protected(rel); pattern != "" {
+			return &WorkspaceError{Path: name, Reason: fmt.Sprintf(
+				"it is protected by the pattern %q", pattern)}
+		}
+		return nil
+	}
+
+	if w.OutputDir != nil {
+		if dir := w.OutputDir(); dir != "" {
+			dir, err := resolvePath(w.fs, dir)
+			if _, ok := relativePath(dir, resolved); err == nil && ok {
+				if write {
+					return &WorkspaceError{Path: name, Reason: "saved " +
+						"output is read-only"}
+				}
+				return nil
+			}
+		}
+	}
+
+	reason := "it is outside the workspace"
+	if abs, err := absPath(w.fs, name); err == nil && resolved != filepath.Clean(abs) {
+		reason = fmt.Sprintf("it resolves to %s, which is outside the workspace",
+			resolved)
+	}
+	return &WorkspaceError{Path: name, Reason: fmt.Sprintf(
+		"%s; the text editor may only use files under %s", reason,
+		strings.Join(w.Roots, ", "))}
+}
+
+// protected returns the pattern that protects the path relative to a
+// root, or the empty string
+func (w *Workspace) protected(rel string) string {
+	if rel == "." {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, pattern := range w.Protected {
+		if !strings.Contains(pattern, "/") {
+			for _, part := range parts {
+				if ok, _ := path.Match(pattern, part); ok {
+					return pattern
+				}
+			}
+		} else if matchGlobParts(strings.Split(pattern, "/"), parts) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// matchGlobParts matches the parts of a path against the parts of a
+// pattern, where a ** part matches any number of path parts
+func matchGlobParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchGlobParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchGlobParts(pattern[1:], parts[1:])
+}
+
+// relativePath returns the path of name relative to dir, if it is
+// inside dir
+func relativePath(dir, name string) (string, bool) {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// absPath returns name relative to the working directory of fsys,
+// without cleaning it
+func absPath(fsys linkFileSystem, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	cwd, err := fsys.Getwd()
+	if err != nil {
+		return "", err
+	}
+	// Not filepath.Join, which would remove .. before the links are
+	// resolved
+	return cwd + string(filepath.Separator) + name, nil
+}
+
+// resolvePath returns the absolute path that name refers to on fsys,
+// with every symbolic link resolved. Unlike filepath.EvalSymlinks, it
+// also resolves paths that do not exist yet, as a file about to be
+// created, and follows a dangling link to where it points. A .. after a
+// link goes to the parent of the link's target, as it does for the
+// kernel.
+func resolvePath(fsys linkFileSystem, name string) (string, error) {
+	name, err := absPath(fsys, name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := filepath.VolumeName(name) + string(filepath.Separator)
+	rest := splitPath(name[len(filepath.VolumeName(name)):])
+	links := 0
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := fsys.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing below a missing directory can be a link
+			return filepath.Join(append([]string{next}, rest...)...), nil
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many symbolic links in %s", name)
+		}
+		target, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = filepath.VolumeName(target) + string(filepath.Separator)
+			target = target[len(filepath.VolumeName(target)):]
+		}
+		rest = append(splitPath(target), rest...)
+	}
+	return resolved, nil
+}
+
+// splitPath splits a path into its names, leaving out empty ones
+func splitPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
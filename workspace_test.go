@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := filepath.Join(root, "ws")
+	extra := filepath.Join(root, "extra")
+	outside := filepath.Join(root, "outside")
+	output := filepath.Join(root, "output")
+	for _, dir := range []string{ws, extra, outside, output, filepath.Join(ws, "sub", "deep")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"to-outside":     outside,
+		"to-secret":      filepath.Join(outside, "secret"),
+		"dangling":       filepath.Join(outside, "new.txt"),
+		"relative":       "../outside",
+		"to-sub":         "sub",
+		"sub/deep/up":    "..",
+		"sub/deep/loop1": "loop2",
+		"sub/deep/loop2": "loop1",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(ws, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWorkspace(ws, extra, defaultProtected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.OutputDir = func() string { return output }
+
+	tests := []struct {
+		path    string
+		write   bool
+		wantErr string
+	}{
+		{ws, true, ""},
+		{"main.go", true, ""},
+		{"sub/new/file.go", true, ""},
+		{"to-sub/file.go", true, ""},
+		{"sub/deep/up/file.go", true, ""},
+		{filepath.Join(extra, "notes.md"), true, ""},
+		{filepath.Join(output, "bash-1.txt"), false, ""},
+		{filepath.Join(output, "bash-1.txt"), true, "saved output is read-only"},
+		{"/etc/hosts", false, "it is outside the workspace; the text editor may only use files under " + ws},
+		{"../outside/secret", false, "outside the workspace"},
+		{"sub/../../outside/secret", false, "outside the workspace"},
+		{"to-outside/secret", false, "it resolves to " + filepath.Join(outside, "secret")},
+		{"to-secret", false, "outside the workspace"},
+		{"dangling", true, "it resolves to " + filepath.Join(outside, "new.txt")},
+		{"relative/secret", false, "outside the workspace"},
+		{"to-sub/../../outside/secret", false, "outside the workspace"},
+		{"sub/deep/up/../../outside", false, "outside the workspace"},
+		{"sub/deep/loop1", false, "too many symbolic links"},
+		{".git/config", false, `protected by the pattern ".git/**"`},
+		{".git", false, `protected by the pattern ".git/**"`},
+		{".env", true, `protected by the pattern ".env"`},
+		{"sub/.env", true, `protected by the pattern ".env"`},
+		{".env.local", true, `protected by the pattern ".env.*"`},
+		{"sub/.git/config", true, ""},
+		{".envrc", true, ""},
+	}
+
+	t.Chdir(ws)
+	for _, tt := range tests {
+		err := w.Check(tt.path, tt.write)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Check(%q, %v) error = %v", tt.path, tt.write, err)
+			}
+			continue
+		}
+		var wsErr *WorkspaceError
+		if !errors.As(err, &wsErr) || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Check(%q, %v) error = %v, want %q", tt.path, tt.write, err, tt.wantErr)
+		}
+	}
+
+	var unconfined *Workspace
+	if err := unconfined.Check("/etc/hosts", true); err != nil {
+		t.Errorf("nil workspace denied /etc/hosts: %v", err)
+	}
+}
+
+func TestNewWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+
+	if _, err := NewWorkspace(dir, " , ", defaultProtected); err != nil {
+		t.Errorf("NewWorkspace() error = %v", err)
+	}
+	if _, err := NewWorkspace(file, "", nil); err == nil {
+		t.Error("NewWorkspace() accepted a file as the root")
+	}
+	if _, err := NewWorkspace(dir, filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("NewWorkspace() accepted a missing directory")
+	}
+	if _, err := NewWorkspace(dir, "", []string{"[.env"}); err == nil {
+		t.Error("NewWorkspace() accepted an invalid pattern")
+	}
+}
+
+func TestTextEditorToolWorkspace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	root := t.TempDir()
+	ws := filepath.Join(root, "ws")
+	outside := filepath.Join(root, "outside")
+	os.Mkdir(ws, 0755)
+	os.Mkdir(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("password\n"), 0644)
+	os.Symlink(outside, filepath.Join(ws, "link"))
+
+	tool := NewSimpleTextEditorTool()
+	var err error
+	if tool.Workspace, err = NewWorkspace(ws, "", defaultProtected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tool.Create(filepath.Join(ws, "a", "b.txt"), "hi\n"); err != nil {
+		t.Errorf("Create() inside the workspace error = %v", err)
+	}
+	if _, err := tool.View(filepath.Join(ws, "link", "secret"), nil, nil); err == nil {
+		t.Error("View() read a file through a link out of the workspace")
+	}
+	if err := tool.StringReplace(filepath.Join(ws, "link", "secret"), "password", "x"); err == nil {
+		t.Error("StringReplace() edited a file through a link out of the workspace")
+	}
+	if err := tool.Insert(filepath.Join(outside, "secret"), 0, "x"); err == nil {
+		t.Error("Insert() edited a file outside the workspace")
+	}
+	if err := tool.Create(filepath.Join(ws, "link", "dir", "new.txt"), "x"); err == nil {
+		t.Error("Create() wrote outside the workspace")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "dir")); err == nil {
+		t.Error("Create() made a directory outside the workspace")
+	}
+	if err := tool.Create(filepath.Join(ws, ".git", "hooks", "pre-commit"), "x"); err == nil {
+		t.Error("Create() wrote into .git")
+	}
+	if err := tool.UndoEdit(filepath.Join(outside, "secret")); err == nil ||
+		!strings.Contains(err.Error(), "outside the workspace") {
+		t.Errorf("UndoEdit() error = %v, want the workspace boundary", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(outside, "secret")); string(content) != "password\n" {
+		t.Errorf("the file outside the workspace changed to %q", content)
+	}
+}